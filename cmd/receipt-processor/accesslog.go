@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats of the access log.
+const (
+	// accessLogJSON logs each request as a JSON record like every other log
+	// line.
+	accessLogJSON = "json"
+	// accessLogCombined logs each request in the Apache combined log format,
+	// with the latency in microseconds (%D) appended, for tools that read
+	// web server logs.
+	accessLogCombined = "combined"
+)
+
+// accessLogStdout is the --access-log destination that writes to standard
+// output.
+const accessLogStdout = "stdout"
+
+// accessLog writes the line logRequests logs for each request.
+type accessLog struct {
+	format string
+	// logger logs JSON lines; nil logs them with the default logger.
+	logger *slog.Logger
+	// out takes combined lines.
+	out  io.Writer
+	file *rotatingFile
+}
+
+var requestLog = &accessLog{format: accessLogJSON, out: os.Stdout}
+
+// openAccessLog opens the access log written to dest, standard output or a
+// file that is rotated once it reaches maxBytes, keeping backups old ones.
+func openAccessLog(dest, format string, maxBytes int64, backups int) (*accessLog, error) {
+	l := &accessLog{format: format, out: os.Stdout}
+	if dest == "" || dest == accessLogStdout {
+		return l, nil
+	}
+	f, err := openRotatingFile(dest, maxBytes, backups)
+	if err != nil {
+		return nil, err
+	}
+	l.file, l.out = f, f
+	l.logger = slog.New(contextHandler{slog.NewJSONHandler(f, nil)})
+	return l, nil
+}
+
+func (l *accessLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// log writes the access log line for r, which started at start and was
+// answered as rec records.
+func (l *accessLog) log(r *http.Request, rec *statusRecorder, start time.Time) {
+	latency := time.Since(start)
+	if l.format == accessLogCombined {
+		l.logCombined(r, rec, start, latency)
+		return
+	}
+
+	attrs := []any{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", rec.status,
+		"bytes", rec.bytes,
+		"latency_ms", float64(latency.Microseconds()) / 1000,
+		"remote_ip", clientIP(r),
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		attrs = append(attrs, "forwarded_for", fwd)
+	}
+	if info := requestInfoFrom(r.Context()); info != nil && info.ReceiptID != "" {
+		attrs = append(attrs, "receipt_id", info.ReceiptID)
+	}
+	if cn := clientCN(r); cn != "" {
+		attrs = append(attrs, "client_cn", cn)
+	}
+	logger := l.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.InfoContext(r.Context(), "request", attrs...)
+}
+
+// logCombined writes the line for r in the combined log format:
+//
+//	host - user [time] "request line" status bytes "referer" "user agent" µs
+func (l *accessLog) logCombined(r *http.Request, rec *statusRecorder, start time.Time, latency time.Duration) {
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	} else if cn := clientCN(r); cn != "" {
+		user = cn
+	}
+	size := "-"
+	if rec.bytes > 0 {
+		size = strconv.FormatInt(rec.bytes, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s %d\n",
+		clientIP(r), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto), rec.status, size,
+		quoteHeader(r.Referer()), quoteHeader(r.UserAgent()), latency.Microseconds())
+	if _, err := io.WriteString(l.out, line); err != nil {
+		slog.ErrorContext(r.Context(), "writing access log failed", "error", err)
+	}
+}
+
+// quoteHeader quotes a header value for the combined log format, which
+// writes a missing one as "-".
+func quoteHeader(v string) string {
+	if v == "" {
+		return `"-"`
+	}
+	return strconv.Quote(v)
+}
+
+// rotatingFile is a file written by many goroutines that, once it reaches
+// maxBytes, is renamed path.1, shifting older ones up to path.<backups> and
+// removing the oldest, and started again. A maxBytes of 0 never rotates it.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past
+// maxBytes. A line is never split across files.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			slog.Error("rotating access log failed", "error", err, "path", f.path)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the full file aside and starts a new one. If the file cannot
+// be moved, it is reopened and written past maxBytes rather than losing
+// lines.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	var err error
+	if f.backups == 0 {
+		err = os.Remove(f.path)
+	}
+	for i := f.backups; i > 0 && err == nil; i-- {
+		from := f.path
+		if i > 1 {
+			from = f.path + "." + strconv.Itoa(i-1)
+		}
+		if err = os.Rename(from, f.path+"."+strconv.Itoa(i)); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"time"
+
+	"receipt-processor/points"
+)
+
+const recalculatePageSize = 500
+
+type recalculateReport struct {
+	Scanned int `json:"scanned"`
+	Changed int `json:"changed"`
+	Skipped int `json:"skipped"`
+}
+
+func recalculateHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := recalculate(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "recalculate failed", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to recalculate points.")
+		return
+	}
+	audit.record(r.Context(), auditEntry{Action: auditRecalculated, Details: report})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// recalculate rescores every stored receipt with the rules and campaigns
+// currently in effect. Receipts no current rule set covers are left untouched.
+func recalculate(ctx context.Context) (recalculateReport, error) {
+	var report recalculateReport
+	for offset := 0; ; offset += recalculatePageSize {
+		recs, _, err := store.List(ctx, ListOptions{Limit: recalculatePageSize, Offset: offset})
+		if err != nil {
+			return report, err
+		}
+		for _, rec := range recs {
+			report.Scanned++
+			if rec.RuleVersion == refundRuleVersion {
+				// Refunds keep the points taken back when they were
+				// processed.
+				continue
+			}
+			old := rec
+			err := scoreRecord(&rec)
+			if errors.Is(err, points.ErrInvalidReceipt) {
+				report.Skipped++
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			if rec.Points == old.Points && rec.RuleVersion == old.RuleVersion && slices.Equal(rec.Campaigns, old.Campaigns) {
+				continue
+			}
+			change := rec.Points - old.Points
+			if err := store.Save(ctx, rec); err != nil {
+				return report, err
+			}
+			leaderboard.record(rec, change)
+			stats.remove(old)
+			stats.add(rec)
+			if err := recordTransaction(ctx, rec, txAdjustment, change); err != nil {
+				return report, err
+			}
+			report.Changed++
+		}
+		if len(recs) < recalculatePageSize {
+			return report, nil
+		}
+	}
+}
+
+// exportHandler streams every stored receipt, across all tenants, as one
+// JSON record per line. Receipts written during the export may be missed.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+
+	// What was sent is recorded even if the export is cut short.
+	exported := 0
+	defer func() {
+		audit.record(r.Context(), auditEntry{Action: auditExported, Details: map[string]any{"receipts": exported}})
+	}()
+	enc := json.NewEncoder(w)
+	for offset := 0; ; offset += recalculatePageSize {
+		recs, _, err := store.List(r.Context(), ListOptions{Limit: recalculatePageSize, Offset: offset})
+		if err != nil {
+			// The status has been sent; cutting the stream short is all
+			// that is left.
+			slog.ErrorContext(r.Context(), "export failed", "error", err, "offset", offset)
+			return
+		}
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+			exported++
+		}
+		rc.Flush()
+		if len(recs) < recalculatePageSize {
+			return
+		}
+	}
+}
+
+const maxImportErrors = 100
+
+type importError struct {
+	Record int    `json:"record"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error"`
+}
+
+type importReport struct {
+	Imported    int           `json:"imported"`
+	Overwritten int           `json:"overwritten"`
+	Skipped     int           `json:"skipped"`
+	Failed      int           `json:"failed"`
+	Errors      []importError `json:"errors,omitempty"`
+}
+
+func (r *importReport) fail(e importError) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, e)
+	}
+}
+
+// importHandler loads receipts in the format exportHandler writes.
+// Receipts whose ID is already stored are skipped,
+// or replaced with ?onConflict=overwrite. Imported points are not credited
+// to users' ledgers.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	overwrite := false
+	switch r.URL.Query().Get("onConflict") {
+	case "", "skip":
+	case "overwrite":
+		overwrite = true
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "onConflict must be skip or overwrite.")
+		return
+	}
+
+	// Receipts are checked as they were when submitted, with refunds
+	// accepted as --refunds accepts them, but not for age, which exported
+	// receipts gain while they are stored.
+	check := validator
+	check.MaxAgeDays = 0
+
+	ctx := r.Context()
+	var report importReport
+	// What was imported is recorded even if the import stops partway.
+	defer func() {
+		if report.Imported+report.Overwritten > 0 {
+			audit.record(ctx, auditEntry{Action: auditImported, Details: report})
+		}
+	}()
+	dec := json.NewDecoder(r.Body)
+	for n := 1; ; n++ {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeDecodeError(w, r, err, "")
+			return
+		}
+		if err != nil {
+			// The decoder cannot resume after a syntax error, so what was
+			// imported so far stays and the rest is not read.
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf(
+				"Record %d is not valid JSON; %d receipts were imported or overwritten before it.", n, report.Imported+report.Overwritten))
+			return
+		}
+		if rec.ID == "" {
+			report.fail(importError{Record: n, Error: "id is required"})
+			continue
+		}
+		if err := check.Validate(rec.Receipt); err != nil {
+			report.fail(importError{Record: n, ID: rec.ID, Error: err.Error()})
+			continue
+		}
+		if rec.Tenant == "" {
+			rec.Tenant = defaultTenant
+		}
+
+		existing, err := store.Get(ctx, rec.ID)
+		found := err == nil
+		if err != nil && !errors.Is(err, errNotFound) {
+			slog.ErrorContext(ctx, "import failed", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to import receipts.")
+			return
+		}
+		if found && !overwrite {
+			report.Skipped++
+			continue
+		}
+		if err := store.Save(ctx, rec); err != nil {
+			slog.ErrorContext(ctx, "import failed", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to import receipts.")
+			return
+		}
+		if found {
+			leaderboard.record(existing, -existing.Points)
+			stats.remove(existing)
+			report.Overwritten++
+		} else {
+			report.Imported++
+		}
+		leaderboard.record(rec, rec.Points)
+		stats.add(rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// adminCredentials guard the /admin/* routes: a request must carry either
+// the basic auth user and password or the key as X-Admin-Key, whichever are
+// set. With neither set every request is refused; main does not serve the
+// routes at all then.
+type adminCredentials struct {
+	user, password string
+	key            string
+}
+
+func (c adminCredentials) configured() bool {
+	return c.password != "" || c.key != ""
+}
+
+func (c adminCredentials) allow(r *http.Request) bool {
+	if !c.configured() {
+		return false
+	}
+	if key := r.Header.Get("X-Admin-Key"); c.key != "" && key != "" {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(c.key)) == 1
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || c.password == "" {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.user))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.password))
+	return userOK&passwordOK == 1
+}
+
+// adminHandler serves the /admin/* routes, including the debug endpoints,
+// behind the admin credentials.
+func adminHandler(creds adminCredentials) http.Handler {
+	mux := newProblemMux()
+	mux.HandleFunc("POST /admin/recalculate", recalculateHandler)
+	mux.HandleFunc("GET /admin/export", exportHandler)
+	mux.HandleFunc("POST /admin/import", importHandler)
+	mux.HandleFunc("POST /admin/purge", purgeHandler)
+	mux.HandleFunc("DELETE /admin/users/{userId}/data", eraseUserHandler)
+	mux.HandleFunc("POST /admin/reload", reloadHandler)
+	mux.HandleFunc("GET /admin/campaigns", listCampaignsHandler)
+	mux.HandleFunc("POST /admin/campaigns", putCampaignHandler)
+	mux.HandleFunc("DELETE /admin/campaigns/{id}", deleteCampaignHandler)
+	mux.HandleFunc("GET /admin/retailer-aliases", listRetailerAliasesHandler)
+	mux.HandleFunc("POST /admin/retailer-aliases", putRetailerAliasHandler)
+	mux.HandleFunc("DELETE /admin/retailer-aliases/{alias}", deleteRetailerAliasHandler)
+	mux.HandleFunc("POST /admin/simulate", simulateHandler)
+	mux.HandleFunc("GET /admin/audit", auditHandler)
+	mux.HandleFunc("GET /admin/flagged", listFlaggedHandler)
+	mux.HandleFunc("POST /admin/flagged/{id}/approve", approveFlaggedHandler)
+	mux.HandleFunc("POST /admin/flagged/{id}/reject", rejectFlaggedHandler)
+
+	// The runtime's profiles and expvar variables, which show the command
+	// line and memory, are only registered behind configured credentials.
+	// pprof.Index finds the profile to serve under /debug/pprof/, so it
+	// gets the path without /admin.
+	if creds.configured() {
+		mux.Handle("GET /admin/debug/pprof/", http.StripPrefix("/admin", http.HandlerFunc(pprof.Index)))
+		mux.HandleFunc("GET /admin/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /admin/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /admin/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("POST /admin/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /admin/debug/pprof/trace", pprof.Trace)
+		mux.Handle("GET /admin/debug/vars", expvar.Handler())
+	}
+	return chain(mux, creds.require)
+}
+
+// require lets through only requests that carry the admin credentials.
+func (c adminCredentials) require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.allow(r) {
+			if c.password != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="receipt-processor admin", charset="UTF-8"`)
+			}
+			writeProblem(w, r, http.StatusUnauthorized, "Admin credentials are required.")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withActor(r.Context(), c.actor(r))))
+	})
+}
+
+// actor names the admin an allowed request came from for the audit log.
+func (c adminCredentials) actor(r *http.Request) string {
+	if c.key != "" && r.Header.Get("X-Admin-Key") != "" {
+		return "admin-key"
+	}
+	if user, _, ok := r.BasicAuth(); ok && c.password != "" {
+		return "admin:" + user
+	}
+	return "admin"
+}
+
+type purgeReport struct {
+	Matched int  `json:"matched"`
+	Deleted int  `json:"deleted"`
+	DryRun  bool `json:"dryRun"`
+}
+
+// purgeHandler serves POST /admin/purge?before=2022-01-01, which deletes
+// every receipt purchased before the date, of one tenant with ?tenant= or
+// of all of them. Like deleting a receipt through the API, it takes the
+// points back out of users' balances. With ?dryRun=true it only counts
+// them.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	before, err := time.Parse(points.DateLayout, q.Get("before"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "before must be a date in YYYY-MM-DD format.")
+		return
+	}
+	dryRun, err := queryBool(r, "dryRun")
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "dryRun must be true or false.")
+		return
+	}
+	ctx := r.Context()
+	if tenant := q.Get("tenant"); tenant != "" {
+		if !tenantPattern.MatchString(tenant) {
+			writeProblem(w, r, http.StatusBadRequest, "tenant is not a valid tenant ID.")
+			return
+		}
+		ctx = withTenantContext(ctx, tenant)
+	}
+
+	opts := ListOptions{Limit: recalculatePageSize, To: before.AddDate(0, 0, -1).Format(points.DateLayout)}
+	report := purgeReport{DryRun: dryRun}
+	_, report.Matched, err = store.List(ctx, ListOptions{Limit: 1, To: opts.To})
+	for err == nil && !dryRun {
+		// Deleted receipts drop out of the listing, so every page is
+		// read from the start.
+		var recs []Record
+		if recs, _, err = store.List(ctx, opts); err != nil || len(recs) == 0 {
+			break
+		}
+		for _, rec := range recs {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if err = deleteRecord(ctx, rec); errors.Is(err, errNotFound) {
+				err = nil
+				continue
+			}
+			if err != nil {
+				break
+			}
+			report.Deleted++
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "purge failed", "error", err, "deleted", report.Deleted)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to purge receipts.")
+		return
+	}
+	audit.record(ctx, auditEntry{Action: auditPurged, Details: struct {
+		Before string `json:"before"`
+		purgeReport
+	}{q.Get("before"), report}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+type erasureReport struct {
+	UserID       string   `json:"userId"`
+	Tenants      []string `json:"tenants"`
+	Receipts     int      `json:"receipts"`
+	Transactions int      `json:"transactions"`
+}
+
+// eraseUserHandler serves DELETE /admin/users/{userId}/data, which deletes
+// the user's receipts and ledger, of one tenant with ?tenant= or of all of
+// them, and drops the receipts from the leaderboard and stats, to honor a
+// data subject's request for erasure. The report lists the tenants that held
+// any of the user's data. Copies already sent elsewhere, such as webhooks,
+// published events and backups, are out of its reach.
+func eraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userId")
+	if !userIDPattern.MatchString(userID) {
+		writeProblem(w, r, http.StatusBadRequest, "The user ID is invalid.")
+		return
+	}
+	ctx := r.Context()
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" {
+		if !tenantPattern.MatchString(tenant) {
+			writeProblem(w, r, http.StatusBadRequest, "tenant is not a valid tenant ID.")
+			return
+		}
+		ctx = withTenantContext(ctx, tenant)
+	}
+
+	report, err := eraseUser(ctx, tenant, userID)
+	// Whatever was deleted is recorded, even if the erasure failed partway.
+	audit.record(ctx, auditEntry{Action: auditUserErased, Target: userID, Details: report})
+	if err != nil {
+		slog.ErrorContext(ctx, "erasing user data failed", "error", err,
+			"receipts", report.Receipts, "transactions", report.Transactions)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to erase the user's data.")
+		return
+	}
+	slog.InfoContext(ctx, "erased user data", "tenants", report.Tenants,
+		"receipts", report.Receipts, "transactions", report.Transactions)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// eraseUser deletes userID's receipts and then their ledger, in tenant or,
+// if it is empty, in every tenant. The receipts' points are not adjusted out
+// of the balance first, since the whole ledger goes with them.
+func eraseUser(ctx context.Context, tenant, userID string) (erasureReport, error) {
+	report := erasureReport{UserID: userID, Tenants: []string{}}
+	tenants := map[string]bool{}
+	opts := ListOptions{Limit: recalculatePageSize, UserID: userID}
+	for {
+		// Deleted receipts drop out of the listing, so every page is
+		// read from the start.
+		recs, _, err := store.List(ctx, opts)
+		if err != nil {
+			return report, err
+		}
+		if len(recs) == 0 {
+			break
+		}
+		for _, rec := range recs {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			err := store.Delete(ctx, rec.ID)
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			forgetReceipt(rec)
+			tenants[rec.Tenant] = true
+			report.Receipts++
+		}
+	}
+
+	accounts, err := ledger.Accounts(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, a := range accounts {
+		if a.UserID == userID && (tenant == "" || a.Tenant == tenant) {
+			tenants[a.Tenant] = true
+		}
+	}
+	// With the receipts gone, the ledger goes too even if the client gives
+	// up, so that no balance is left without them.
+	ctx, cancel := commitContext(ctx)
+	defer cancel()
+	for _, t := range slices.Sorted(maps.Keys(tenants)) {
+		n, err := ledger.DeleteAccount(ctx, t, userID)
+		if err != nil {
+			return report, err
+		}
+		report.Transactions += n
+		report.Tenants = append(report.Tenants, t)
+	}
+	return report, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"receipt-processor/points"
+)
+
+func TestAdminCredentialsAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds adminCredentials
+		key   string
+		user  string
+		pass  string
+		want  bool
+	}{
+		{name: "none configured", want: false},
+		{name: "none configured with a key", key: "k", want: false},
+		{name: "none configured with basic auth", user: "admin", pass: "", want: false},
+		{name: "key", creds: adminCredentials{key: "k"}, key: "k", want: true},
+		{name: "wrong key", creds: adminCredentials{key: "k"}, key: "x", want: false},
+		{name: "no key", creds: adminCredentials{key: "k"}, want: false},
+		{name: "basic auth", creds: adminCredentials{user: "admin", password: "p"}, user: "admin", pass: "p", want: true},
+		{name: "wrong password", creds: adminCredentials{user: "admin", password: "p"}, user: "admin", pass: "x", want: false},
+		{name: "key without a key configured", creds: adminCredentials{user: "admin", password: "p"}, key: "", want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/admin/export", nil)
+		if tt.key != "" {
+			r.Header.Set("X-Admin-Key", tt.key)
+		}
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		if got := tt.creds.allow(r); got != tt.want {
+			t.Errorf("%s: allow = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestAdminDebugRoutes checks that the profiles and expvar variables are
+// refused without credentials and served with them.
+func TestAdminDebugRoutes(t *testing.T) {
+	for _, path := range []string{"/admin/debug/pprof/", "/admin/debug/pprof/cmdline", "/admin/debug/vars"} {
+		w := httptest.NewRecorder()
+		adminHandler(adminCredentials{}).ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("GET %s without credentials configured: status %d", path, w.Code)
+		}
+
+		h := adminHandler(adminCredentials{key: "k"})
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a key: status %d, want 401", path, w.Code)
+		}
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("X-Admin-Key", "k")
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s with the key: status %d, want 200", path, w.Code)
+		}
+	}
+}
+
+// TestExportImportRoundTrip exports a receipt and its refund and imports
+// them into an empty store, which must then hold the same records.
+func TestExportImportRoundTrip(t *testing.T) {
+	oldStore, oldValidator := store, validator
+	t.Cleanup(func() { store, validator = oldStore, oldValidator })
+	// Both receipts are older than MaxAgeDays, which only applies to new
+	// submissions.
+	validator = points.Validator{AllowNegative: true, MaxAgeDays: 30}
+	store = newMemoryStore(0)
+
+	ctx := context.Background()
+	recs := []Record{
+		{ID: "r1", Tenant: "acme", UserID: "alice", Points: 31, RuleVersion: "2022", StoredAt: time.Date(2022, 1, 1, 19, 5, 0, 0, time.UTC), Receipt: points.Receipt{
+			Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "6.49",
+			Items: []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+		}},
+		{ID: "r2", Tenant: "acme", UserID: "alice", Points: -31, RuleVersion: refundRuleVersion, StoredAt: time.Date(2022, 1, 2, 16, 0, 0, 0, time.UTC), Receipt: points.Receipt{
+			Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "-6.49", RefundOf: "r1",
+			Items: []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "-6.49"}},
+		}},
+	}
+	for _, rec := range recs {
+		if err := store.Save(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	exportHandler(w, httptest.NewRequest("GET", "/admin/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status %d: %s", w.Code, w.Body)
+	}
+
+	store = newMemoryStore(0)
+	imported := httptest.NewRecorder()
+	importHandler(imported, httptest.NewRequest("POST", "/admin/import", w.Body))
+	var report importReport
+	if err := json.NewDecoder(imported.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != len(recs) || report.Failed != 0 {
+		t.Fatalf("import report = %+v, want %d imported", report, len(recs))
+	}
+	for _, want := range recs {
+		got, err := store.Get(ctx, want.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("imported %+v, want %+v", got, want)
+		}
+	}
+}
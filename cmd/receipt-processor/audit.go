@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	auditReceiptSubmitted = "receipt.submitted"
+	auditReceiptDeleted   = "receipt.deleted"
+	auditReceiptCorrected = "receipt.corrected"
+	auditRulesReloaded    = "rules.reloaded"
+	auditCampaignSaved    = "campaign.saved"
+	auditCampaignDeleted  = "campaign.deleted"
+	auditRecalculated     = "receipts.recalculated"
+	auditExported         = "receipts.exported"
+	auditImported         = "receipts.imported"
+	auditPurged           = "receipts.purged"
+	auditUserErased       = "user.erased"
+	auditReceiptFlagged   = "receipt.flagged"
+	auditReceiptRejected  = "receipt.rejected"
+	auditFlagApproved     = "flag.approved"
+	auditFlagRejected     = "flag.rejected"
+	auditAliasSaved       = "alias.saved"
+	auditAliasDeleted     = "alias.deleted"
+)
+
+var auditActions = []string{
+	auditReceiptSubmitted, auditReceiptDeleted, auditReceiptCorrected, auditRulesReloaded, auditCampaignSaved,
+	auditCampaignDeleted, auditRecalculated, auditExported, auditImported, auditPurged, auditUserErased,
+	auditReceiptFlagged, auditReceiptRejected, auditFlagApproved, auditFlagRejected,
+	auditAliasSaved, auditAliasDeleted,
+}
+
+// maxAuditEntries is how many entries are kept in memory when there is no
+// --audit-log.
+const maxAuditEntries = 10000
+
+// auditEntry records who did what, and when. Actor names the caller: the
+// admin user, or a fingerprint of the API key, which is never recorded
+// itself. Target is the receipt, campaign or user acted on.
+type auditEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Actor      string    `json:"actor,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Details    any       `json:"details,omitempty"`
+}
+
+// auditLog is an append-only trail of submissions, deletions, rule changes
+// and admin actions. With a file, each entry is appended to it as a line of
+// JSON and the file is the whole history; without one, only the latest
+// maxAuditEntries are kept, in memory.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries []auditEntry
+}
+
+var audit = &auditLog{}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, file: f}, nil
+}
+
+type actorKey struct{}
+
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// keyActor names the holder of an API key by a fingerprint of it, or
+// returns "" if no key was sent.
+func keyActor(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "api-key:" + hex.EncodeToString(sum[:4])
+}
+
+// record appends e, filling in when it happened and, from ctx, who did it.
+// A failure to write the file is logged; the action has already happened.
+func (a *auditLog) record(ctx context.Context, e auditEntry) {
+	e.ID = generateID()
+	e.Time = time.Now().UTC()
+	e.Actor = actorFrom(ctx)
+	if e.Tenant == "" {
+		e.Tenant, _ = tenantFrom(ctx)
+	}
+	if info := requestInfoFrom(ctx); info != nil {
+		e.RequestID, e.RemoteAddr = info.ID, info.RemoteAddr
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		// Trimming in bulk keeps appends cheap.
+		a.entries = append(a.entries, e)
+		if len(a.entries) >= 2*maxAuditEntries {
+			a.entries = slices.Clone(a.entries[len(a.entries)-maxAuditEntries:])
+		}
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		_, err = a.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "writing audit log", "error", err, "action", e.Action, "target", e.Target)
+	}
+}
+
+// auditFilter selects entries from From, inclusive, to To, exclusive, with
+// one of Actions and of Tenant. Zero fields match everything.
+type auditFilter struct {
+	From, To time.Time
+	Actions  []string
+	Tenant   string
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	return (f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || e.Time.Before(f.To)) &&
+		(len(f.Actions) == 0 || slices.Contains(f.Actions, e.Action)) &&
+		(f.Tenant == "" || e.Tenant == f.Tenant)
+}
+
+// each calls fn with the entries f matches, oldest first, until fn returns
+// false.
+func (a *auditLog) each(f auditFilter, fn func(auditEntry) bool) error {
+	if a.path == "" {
+		a.mu.Lock()
+		entries := a.entries[max(0, len(a.entries)-maxAuditEntries):]
+		entries = slices.Clone(entries)
+		a.mu.Unlock()
+		for _, e := range entries {
+			if f.match(e) && !fn(e) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without its newline is still being written.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e auditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("audit log %s: %w", a.path, err)
+		}
+		if f.match(e) && !fn(e) {
+			return nil
+		}
+	}
+}
+
+func (a *auditLog) close() error {
+	if a.file == nil {
+		return nil
+	}
+	return errors.Join(a.file.Sync(), a.file.Close())
+}
+
+// auditHandler serves GET /admin/audit?from=...&to=...&action=...&tenant=...,
+// a page of the matching entries, newest first, or with ?format=ndjson all of
+// them, oldest first, one per line.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var f auditFilter
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, p.name+" must be an RFC 3339 timestamp.")
+				return
+			}
+			*p.t = t
+		}
+	}
+	if v := q.Get("action"); v != "" {
+		for _, action := range strings.Split(v, ",") {
+			if !slices.Contains(auditActions, action) {
+				writeProblem(w, r, http.StatusBadRequest, "action must be one or more of "+strings.Join(auditActions, ", ")+".")
+				return
+			}
+			f.Actions = append(f.Actions, action)
+		}
+	}
+	if f.Tenant = q.Get("tenant"); f.Tenant != "" && !tenantPattern.MatchString(f.Tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "tenant is not a valid tenant ID.")
+		return
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		err := audit.each(f, func(e auditEntry) bool {
+			return enc.Encode(e) == nil
+		})
+		if err != nil {
+			// The status has been sent; cutting the stream short is all
+			// that is left.
+			slog.ErrorContext(r.Context(), "audit export failed", "error", err)
+		}
+		return
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "format must be json or ndjson.")
+		return
+	}
+
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", maxPageSize))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "offset must be a non-negative integer.")
+		return
+	}
+	var entries []auditEntry
+	if err := audit.each(f, func(e auditEntry) bool {
+		entries = append(entries, e)
+		return true
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "reading audit log", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to read the audit log.")
+		return
+	}
+	slices.Reverse(entries)
+	start, end := ListOptions{Limit: limit, Offset: offset}.page(len(entries))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries []auditEntry `json:"entries"`
+		Total   int          `json:"total"`
+		Limit   int          `json:"limit"`
+		Offset  int          `json:"offset"`
+	}{append([]auditEntry{}, entries[start:end]...), len(entries), limit, offset})
+}
+
+// remoteHost is the address a request came from, without its port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"receipt-processor/points"
+)
+
+const maxBatchSize = 10000
+
+type batchResult struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id,omitempty"`
+	Points    int    `json:"points"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+
+	Errors []points.FieldError `json:"errors,omitempty"`
+}
+
+func processBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var receipts []submission
+	if err := decodeJSON(r.Body, &receipts, strict); err != nil {
+		writeDecodeError(w, r, err, "The batch is invalid. Please verify input.")
+		return
+	}
+	if len(receipts) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "The batch is invalid. Please verify input.")
+		return
+	}
+	if len(receipts) > maxBatchSize {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("A batch may contain at most %d receipts.", maxBatchSize))
+		return
+	}
+
+	if async, err := queryBool(r, "async"); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "async must be true or false.")
+		return
+	} else if async {
+		submitJob(w, r, receipts)
+		return
+	}
+
+	var results []batchResult
+	if err := ingest.do(r.Context(), func(ctx context.Context) {
+		results = processSubmissions(ctx, receipts)
+	}); err != nil {
+		writeIngestError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// processSubmissions processes each receipt independently and reports a
+// result per input position.
+func processSubmissions(ctx context.Context, receipts []submission) []batchResult {
+	results := make([]batchResult, len(receipts))
+	for i, sub := range receipts {
+		results[i] = processSubmission(ctx, i, sub)
+	}
+	return results
+}
+
+// processSubmission processes the receipt at index i of a batch and reports
+// its result.
+func processSubmission(ctx context.Context, i int, sub submission) batchResult {
+	result := batchResult{Index: i}
+	rec, duplicate, err := processReceipt(ctx, sub.Receipt, sub.UserID)
+	switch {
+	case errors.Is(err, points.ErrInvalidReceipt):
+		result.Error = "The receipt is invalid. Please verify input."
+		var v *points.ValidationError
+		if errors.As(err, &v) {
+			result.Errors = v.Fields
+		}
+	case errors.Is(err, errReceiptRejected):
+		result.Error = rejectedMessage(err)
+	case errors.Is(err, errVelocityLimit):
+		var v *velocityError
+		errors.As(err, &v)
+		result.Error, result.Code = v.message(), velocityLimitCode
+	case err != nil && ctx.Err() != nil:
+		result.Error = "The request ended before this receipt was processed."
+	case err != nil:
+		result.Error = "Failed to store receipt."
+	default:
+		result.ID = rec.ID
+		result.Points = rec.Points
+		result.Duplicate = duplicate
+	}
+	return result
+}
+
+// maxPointsBatch is how many IDs one points lookup may ask for.
+const maxPointsBatch = 1000
+
+// pointsLookup is the points of one receipt asked for in a points lookup, or
+// a marker that there is no such receipt.
+type pointsLookup struct {
+	ID       string `json:"id"`
+	Points   *int   `json:"points,omitempty"`
+	NotFound bool   `json:"notFound,omitempty"`
+}
+
+// batchPointsHandler serves POST /receipts/points/batch, which takes an
+// array of receipt IDs and returns the points of each, in order, saving a
+// GET /receipts/{id}/points per receipt, e.g. after a batch import.
+func batchPointsHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	if err := decodeJSON(r.Body, &ids, strict); err != nil {
+		writeDecodeError(w, r, err, "The list of IDs is invalid. Please verify input.")
+		return
+	}
+	if len(ids) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "The list of IDs is invalid. Please verify input.")
+		return
+	}
+	if len(ids) > maxPointsBatch {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("A lookup may ask for at most %d IDs.", maxPointsBatch))
+		return
+	}
+
+	results := make([]pointsLookup, len(ids))
+	for i, id := range ids {
+		results[i].ID = id
+		points, err := store.GetPoints(r.Context(), id)
+		if errors.Is(err, errNotFound) {
+			results[i].NotFound = true
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "points lookup failed", "error", err, "receipt_id", id)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt.")
+			return
+		}
+		results[i].Points = &points
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
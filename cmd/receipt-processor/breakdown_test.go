@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"receipt-processor/points"
+)
+
+// TestBreakdownAfterCampaignEnds checks that a receipt's breakdown keeps
+// adding up to its points after the campaign that scored it is removed.
+func TestBreakdownAfterCampaignEnds(t *testing.T) {
+	oldStore := store
+	t.Cleanup(func() { store = oldStore })
+	store = newMemoryStore(0)
+	campaigns.put(points.Campaign{ID: "double-target", From: "2022-01-01", To: "2022-02-01", Retailer: "Target", Multiplier: 2})
+	t.Cleanup(func() { campaigns.remove("double-target") })
+
+	ctx := context.Background()
+	rec, _, err := processReceipt(ctx, points.Receipt{
+		Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "6.49",
+		Items: []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Campaigns) == 0 {
+		t.Fatal("no campaign results were stored with the receipt")
+	}
+	campaigns.remove("double-target")
+
+	_, results, err := receiptBreakdown(ctx, rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := points.Total(results); got != rec.Points {
+		t.Errorf("breakdown adds up to %d, receipt has %d points", got, rec.Points)
+	}
+	for _, r := range results {
+		if r.Rule == unaccountedRule {
+			t.Errorf("breakdown has an unaccounted entry of %d points", r.Points)
+		}
+	}
+}
+
+// TestBreakdownUnaccounted checks that a receipt whose points its breakdown
+// cannot explain, as one stored before campaign results were kept, gets an
+// entry making up the difference.
+func TestBreakdownUnaccounted(t *testing.T) {
+	rec := Record{ID: "r1", Receipt: points.Receipt{
+		Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "6.49",
+		Items: []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	}}
+	if err := scoreRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	rec.Points += 40
+	results, err := evaluateRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := results[len(results)-1]
+	if last.Rule != unaccountedRule || last.Points != 40 {
+		t.Errorf("last breakdown entry = %+v, want %d %s points", last, 40, unaccountedRule)
+	}
+	if got := points.Total(results); got != rec.Points {
+		t.Errorf("breakdown adds up to %d, receipt has %d points", got, rec.Points)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"receipt-processor/points"
+)
+
+// campaignSet holds the campaigns in effect. They start from --campaigns and
+// may be changed through /admin/campaigns; changes are not written back to
+// the file.
+type campaignSet struct {
+	mu   sync.RWMutex
+	list points.Campaigns
+}
+
+var campaigns = &campaignSet{}
+
+func (s *campaignSet) all() points.Campaigns {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(points.Campaigns(nil), s.list...)
+}
+
+func (s *campaignSet) set(list points.Campaigns) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = list
+}
+
+// apply returns the campaign results for a receipt the base rules scored as
+// results. Retailers are matched by the names they are known by, so a
+// campaign at a retailer applies to receipts from its aliases.
+func (s *campaignSet) apply(receipt points.Receipt, results []points.Result) []points.Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	receipt.Retailer = retailerAliases.canonical(receipt.Retailer)
+	list := slices.Clone(s.list)
+	for i := range list {
+		if list[i].Retailer != "" {
+			list[i].Retailer = retailerAliases.canonical(list[i].Retailer)
+		}
+	}
+	return list.Apply(receipt, results)
+}
+
+// put adds c, replacing any campaign with the same ID, and reports whether
+// one was replaced.
+func (s *campaignSet) put(c points.Campaign) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.list {
+		if s.list[i].ID == c.ID {
+			s.list[i] = c
+			return true
+		}
+	}
+	s.list = append(s.list, c)
+	return false
+}
+
+func (s *campaignSet) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.list {
+		if s.list[i].ID == id {
+			s.list = append(s.list[:i:i], s.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// listCampaignsHandler serves GET /admin/campaigns.
+func listCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(campaigns.all())
+}
+
+// putCampaignHandler serves POST /admin/campaigns, which adds a campaign or
+// replaces the one with the same ID. Like deleting one, it only changes
+// stored points after /admin/recalculate.
+func putCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	var c points.Campaign
+	if err := decodeJSON(r.Body, &c, true); err != nil {
+		writeDecodeError(w, r, err, "The campaign is invalid. Please verify input.")
+		return
+	}
+	if err := c.Validate(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The campaign is invalid: "+strings.ReplaceAll(err.Error(), "\n", "; ")+".")
+		return
+	}
+	replaced := campaigns.put(c)
+	audit.record(r.Context(), auditEntry{Action: auditCampaignSaved, Target: c.ID, Details: c})
+	w.Header().Set("Content-Type", "application/json")
+	if !replaced {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+// deleteCampaignHandler serves DELETE /admin/campaigns/{id}.
+func deleteCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	if !campaigns.remove(r.PathValue("id")) {
+		writeProblem(w, r, http.StatusNotFound, "No campaign found for that ID.")
+		return
+	}
+	audit.record(r.Context(), auditEntry{Action: auditCampaignDeleted, Target: r.PathValue("id")})
+	w.WriteHeader(http.StatusNoContent)
+}
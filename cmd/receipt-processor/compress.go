@@ -0,0 +1,249 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressor that can be reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() any { return gzip.NewWriter(nil) }},
+	"zstd": {New: func() any {
+		// Concurrency 1 keeps the encoder from starting goroutines of
+		// its own for each response.
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// decompressBody decodes request bodies sent with Content-Encoding gzip or
+// zstd, so that batches and imports can be uploaded compressed. The decoded
+// body is held to limit too, so that a small compressed body cannot expand
+// without bound, except where unlimitedBody lets the route bound each line.
+func decompressBody(limit int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body io.ReadCloser
+			switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					writeDecodeError(w, r, err, "The request body is not valid gzip.")
+					return
+				}
+				body = zr
+			case "zstd":
+				zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+				if err != nil {
+					writeDecodeError(w, r, err, "The request body is not valid zstd.")
+					return
+				}
+				body = zr.IOReadCloser()
+			default:
+				writeProblem(w, r, http.StatusUnsupportedMediaType, "Content-Encoding "+enc+" is not supported; use gzip or zstd.")
+				return
+			}
+			defer body.Close()
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			r.Body = body
+			if !unlimitedBody(r) {
+				r.Body = http.MaxBytesReader(w, body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// compressResponses compresses responses with whichever of encodings the
+// client accepts, preferring them in the order given. Responses shorter than
+// minSize are sent as they are, unless the handler flushes first, as the
+// event stream and CSV exports do.
+func compressResponses(encodings []string, minSize int) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding returns the first of offered that the Accept-Encoding
+// header accepts with the highest quality, or "" if it accepts none.
+func negotiateEncoding(header string, offered []string) string {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if coding != "" {
+			quality[coding] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range offered {
+		q, ok := quality[enc]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether the
+// response is worth compressing, then either compresses it or passes it
+// through unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	enc     encoder
+	decided bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	h := c.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" ||
+		compressedType(h.Get("Content-Type")) {
+		c.start(false)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) < c.minSize {
+			return len(p), nil
+		}
+		if err := c.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// start sends the header, compressed or not, and whatever has been buffered.
+func (c *compressWriter) start(compress bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if compress {
+		c.Header().Set("Content-Encoding", c.encoding)
+		c.Header().Del("Content-Length")
+		c.enc = encoders[c.encoding].Get().(encoder)
+		c.enc.Reset(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if c.enc != nil {
+		_, err := c.enc.Write(buf)
+		return err
+	}
+	_, err := c.ResponseWriter.Write(buf)
+	return err
+}
+
+// FlushError compresses whatever has been written so far and sends it.
+func (c *compressWriter) FlushError() error {
+	if !c.decided {
+		if err := c.start(true); err != nil {
+			return err
+		}
+	}
+	if c.enc != nil {
+		if err := c.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// extend the write deadline of a streamed response.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 && len(c.buf) == 0 {
+			// The handler wrote nothing; let net/http send its default.
+			return
+		}
+		c.start(false)
+	}
+	if c.enc != nil {
+		c.enc.Close()
+		c.enc.Reset(nil)
+		encoders[c.encoding].Put(c.enc)
+	}
+}
+
+// compressedType reports whether content of this type is already compressed,
+// so that compressing it again would only cost time.
+func compressedType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"),
+		mediaType == "application/zip", mediaType == "application/gzip", mediaType == "application/zstd",
+		mediaType == "application/pdf", mediaType == "application/octet-stream":
+		return true
+	}
+	return false
+}
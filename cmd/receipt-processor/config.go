@@ -0,0 +1,362 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"receipt-processor/points"
+)
+
+const envPrefix = "RECEIPT_PROCESSOR_"
+
+type config struct {
+	Addr           string
+	GRPCAddr       string
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	RequestTimeout time.Duration
+	MaxHeaderBytes int
+	MaxBodyBytes   int64
+	DrainTimeout   time.Duration
+
+	Compression      string
+	CompressMinBytes int
+
+	RulesPath     string
+	CampaignsPath string
+	AliasesPath   string
+	Dedup         bool
+	IDScheme      string
+	IDSeed        uint64
+	Strict        bool
+	PointsMaxAge  time.Duration
+	Store         storeConfig
+
+	LegacyRoutes bool
+	LegacySunset time.Time
+
+	IngestWorkers int
+	IngestQueue   int
+
+	AsyncWorkers int
+	AsyncQueue   int
+	JobTTL       time.Duration
+
+	CheckTotal     bool
+	TotalTolerance float64
+	RejectFuture   bool
+	MaxAgeDays     int
+	Lenient        bool
+	Refunds        string
+
+	Fraud          fraudConfig
+	VelocityLimits []*velocityLimit
+
+	ExpireMonths   int
+	ExpireInterval time.Duration
+	ExpiringSoon   time.Duration
+
+	NATS natsConfig
+
+	OCR        string
+	OCRCommand string
+	OCRURL     string
+
+	BaseCurrency string
+	FX           string
+	FXRates      string
+	FXURL        string
+
+	KafkaBrokers    string
+	KafkaTopic      string
+	KafkaOutboxSize int
+
+	TenantHeader string
+	APIKeysPath  string
+
+	TLS tlsConfig
+
+	AdminAddr     string
+	AdminUser     string
+	AdminPassword string
+	AdminKey      string
+	AuditLogPath  string
+
+	AccessLog           string
+	AccessLogFormat     string
+	AccessLogMaxMB      int
+	AccessLogMaxBackups int
+
+	RateLimit float64
+	RateBurst int
+
+	TrustedProxies string
+
+	CORSOrigins string
+	CORSMethods string
+	CORSHeaders string
+	CORSMaxAge  time.Duration
+}
+
+// loadConfig parses command-line flags. Any flag not given on the command
+// line falls back to an environment variable named after it, e.g. --db-path
+// reads RECEIPT_PROCESSOR_DB_PATH.
+func loadConfig(args []string) (config, error) {
+	var (
+		cfg    config
+		sunset string
+	)
+	fs := flag.NewFlagSet("receipt-processor", flag.ContinueOnError)
+
+	fs.StringVar(&cfg.Addr, "addr", ":8080", "address to listen on")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", "", "address to serve the gRPC API on (empty disables it)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 10*time.Second, "maximum duration for reading a request")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "maximum duration for writing a response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 120*time.Second, "how long keep-alive connections may sit idle")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", 20*time.Second, "how long an API request or RPC may take before its work is abandoned (0 disables)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", 1<<20, "maximum size of request headers")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", 10<<20, "maximum size of a request body")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", 15*time.Second, "how long to wait for in-flight requests on shutdown")
+	fs.StringVar(&cfg.Compression, "compression", "gzip", "comma-separated response encodings offered to clients, in order of preference: gzip, zstd (empty disables compression)")
+	fs.IntVar(&cfg.CompressMinBytes, "compress-min-bytes", 1024, "smallest response worth compressing")
+
+	fs.StringVar(&cfg.RulesPath, "rules", "", "JSON file overriding the default scoring rules")
+	fs.StringVar(&cfg.CampaignsPath, "campaigns", "", "JSON file of promotional campaigns applied after the scoring rules")
+	fs.StringVar(&cfg.AliasesPath, "retailer-aliases", "", "JSON file of retailer aliases, each an alias and the retailer it names, e.g. {\"alias\": \"M and M Corner Market\", \"retailer\": \"M&M Corner Market\"}")
+	fs.BoolVar(&cfg.Dedup, "dedup", false, "return the existing ID when an identical receipt is resubmitted")
+	fs.StringVar(&cfg.IDScheme, "id-scheme", "uuidv4", "how receipt IDs are made: uuidv4 (random), uuidv7 or ulid (sortable by submission time), or content (derived from the receipt; needs --dedup); for tests, sequence (the same IDs on every run, from --id-seed)")
+	fs.Uint64Var(&cfg.IDSeed, "id-seed", 1, "seed of the IDs made by --id-scheme=sequence")
+	fs.BoolVar(&cfg.Strict, "strict", false, "reject request bodies with unknown fields or data after the JSON document")
+	fs.BoolVar(&cfg.LegacyRoutes, "legacy-routes", true, "also serve the API at its deprecated unversioned paths, e.g. /receipts/process as well as /v1/receipts/process")
+	fs.StringVar(&sunset, "legacy-sunset", "", "date (YYYY-MM-DD) the unversioned paths will be removed, sent in their Sunset header")
+	fs.DurationVar(&cfg.PointsMaxAge, "points-max-age", time.Hour, "how long clients and caches may reuse GET /receipts/{id}/points before revalidating; recalculations and deletions may go unseen that long")
+
+	fs.IntVar(&cfg.IngestWorkers, "ingest-workers", 0, "workers processing receipt submissions (0 processes each on its request)")
+	fs.IntVar(&cfg.IngestQueue, "ingest-queue", 1000, "submissions that may wait for an ingest worker before requests get 429")
+	fs.IntVar(&cfg.AsyncWorkers, "async-workers", 4, "workers processing ?async=true submissions")
+	fs.IntVar(&cfg.AsyncQueue, "async-queue", 100, "jobs that may wait for a worker before submissions get 503")
+	fs.DurationVar(&cfg.JobTTL, "job-ttl", time.Hour, "how long finished jobs can be fetched from /jobs/{id}")
+
+	fs.BoolVar(&cfg.CheckTotal, "check-total", false, "reject receipts whose item prices do not sum to the total")
+	fs.Float64Var(&cfg.TotalTolerance, "total-tolerance", 0, "how far, in dollars, the item prices may differ from the total under --check-total or on receipts with tax or discounts")
+	fs.BoolVar(&cfg.RejectFuture, "reject-future", false, "reject receipts with a purchase date and time in the future")
+	fs.IntVar(&cfg.MaxAgeDays, "max-age-days", 0, "reject receipts purchased more than this many days ago (0 disables)")
+	fs.StringVar(&cfg.Refunds, "refunds", refundsReject, "what to do with negative prices and totals: reject them, store refunds with zero points, or deduct the refunded receipt's points in proportion")
+	fs.BoolVar(&cfg.Lenient, "lenient", false, "accept amounts with a decimal comma (12,50), day-first dates (31/12/2022) and 12-hour times (1:05 PM), stored in canonical form")
+
+	fs.StringVar(&cfg.Fraud.Action, "fraud-action", fraudFlag, "what to do with a receipt a fraud check finds suspicious: flag it for review at /admin/flagged, or reject it")
+	fs.DurationVar(&cfg.Fraud.DuplicateWindow, "fraud-duplicate-window", 0, "find receipts with the retailer and total of a stored one purchased this close to it (0 disables)")
+	fs.IntVar(&cfg.Fraud.MaxItems, "fraud-max-items", 0, "find receipts with more items than this (0 disables)")
+	fs.IntVar(&cfg.Fraud.VelocityLimit, "fraud-velocity-limit", 0, "find users submitting more receipts than this within --fraud-velocity-window (0 disables)")
+	fs.DurationVar(&cfg.Fraud.VelocityWindow, "fraud-velocity-window", time.Hour, "window --fraud-velocity-limit counts submissions over")
+	velocity := fs.String("velocity-limits", "", "comma-separated limits on a user's receipts, as scope:count/window with scope user or user-retailer, e.g. user:5/1h,user-retailer:1/24h")
+
+	fs.IntVar(&cfg.ExpireMonths, "points-expire-months", 0, "expire user points this many months after the purchase date (0 keeps them forever)")
+	fs.DurationVar(&cfg.ExpireInterval, "expire-interval", time.Hour, "how often the expiration job runs")
+	fs.DurationVar(&cfg.ExpiringSoon, "expiring-soon", 30*24*time.Hour, "how far ahead the points endpoint reports expiring points")
+
+	fs.StringVar(&cfg.NATS.URL, "nats-url", "", "NATS server to consume receipts from through JetStream (empty disables)")
+	fs.StringVar(&cfg.NATS.Stream, "nats-stream", "RECEIPTS", "JetStream stream holding submitted receipts, created if missing")
+	fs.StringVar(&cfg.NATS.Subject, "nats-subject", "receipts.submit", "subject receipts are published to")
+	fs.StringVar(&cfg.NATS.Consumer, "nats-consumer", "receipt-processor", "durable consumer name, shared by every instance")
+	fs.StringVar(&cfg.NATS.DeadLetter, "nats-dead-letter", "receipts.dead", "subject invalid receipts are republished to")
+
+	fs.StringVar(&cfg.OCR, "ocr", "", "OCR provider for POST /receipts/upload: tesseract or http (empty disables uploads)")
+	fs.StringVar(&cfg.OCRCommand, "ocr-command", "tesseract", "Tesseract executable for --ocr=tesseract")
+	fs.StringVar(&cfg.OCRURL, "ocr-url", "", "service images are posted to for --ocr=http, responding with the text")
+
+	fs.StringVar(&cfg.BaseCurrency, "base-currency", "USD", "ISO 4217 currency of receipts that name none, and that stats and reports convert spend into")
+	fs.StringVar(&cfg.FX, "fx", "", "exchange rate provider for converting spend into --base-currency: static or http (empty converts none)")
+	fs.StringVar(&cfg.FXRates, "fx-rates", "", "JSON file of the units of each currency one unit of --base-currency buys for --fx=static, e.g. {\"EUR\": 0.92}")
+	fs.StringVar(&cfg.FXURL, "fx-url", "", "service asked for rates from ?base= the base currency for --fx=http, responding with {\"rates\": {\"EUR\": 0.92}}")
+
+	fs.StringVar(&cfg.KafkaBrokers, "kafka-brokers", "", "comma-separated Kafka brokers to publish receipt.processed events to (empty disables)")
+	fs.StringVar(&cfg.KafkaTopic, "kafka-topic", "receipts", "Kafka topic for receipt events")
+	fs.IntVar(&cfg.KafkaOutboxSize, "kafka-outbox-size", 10000, "events held while Kafka is unreachable before the oldest are dropped")
+
+	fs.StringVar(&cfg.TenantHeader, "tenant-header", "X-Tenant-ID", "request header naming the tenant when no API keys are configured")
+	fs.StringVar(&cfg.APIKeysPath, "api-keys", "", "JSON file mapping API keys (sent as X-API-Key) to tenants")
+
+	fs.StringVar(&cfg.TLS.CertFile, "tls-cert", "", "certificate file to serve HTTPS on --addr with, reloaded on SIGHUP")
+	fs.StringVar(&cfg.TLS.KeyFile, "tls-key", "", "private key file for --tls-cert")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", "", "CA bundle client certificates must be signed by (mutual TLS); empty accepts clients without one")
+	fs.StringVar(&cfg.TLS.AutocertDomains, "autocert-domains", "", "comma-separated domains to get Let's Encrypt certificates for, instead of --tls-cert")
+	fs.StringVar(&cfg.TLS.AutocertCacheDir, "autocert-cache-dir", "autocert", "directory Let's Encrypt certificates and the account key are kept in")
+	fs.StringVar(&cfg.TLS.AutocertEmail, "autocert-email", "", "contact address for the Let's Encrypt account")
+	fs.StringVar(&cfg.TLS.RedirectAddr, "redirect-addr", "", "address of a plain HTTP listener redirecting to HTTPS, e.g. :80; autocert needs it on port 80")
+
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", "", "separate address to serve /admin/* on instead of --addr (empty serves them with the API)")
+	fs.StringVar(&cfg.AdminUser, "admin-user", "", "user name for basic authentication to /admin/*")
+	fs.StringVar(&cfg.AdminPassword, "admin-password", "", "password for basic authentication to /admin/*")
+	fs.StringVar(&cfg.AdminKey, "admin-key", "", "key admin requests may send as X-Admin-Key instead of basic authentication")
+	fs.StringVar(&cfg.AuditLogPath, "audit-log", "", "file the audit trail is appended to (empty keeps the latest 10000 entries in memory)")
+
+	fs.StringVar(&cfg.AccessLog, "access-log", accessLogStdout, "where to write a line per request: stdout, with the other logs, or a file")
+	fs.StringVar(&cfg.AccessLogFormat, "access-log-format", accessLogJSON, "format of the access log: json, or combined (Apache combined log format with the latency in microseconds appended)")
+	fs.IntVar(&cfg.AccessLogMaxMB, "access-log-max-mb", 100, "megabytes the access log file may reach before it is rotated (0 never rotates it)")
+	fs.IntVar(&cfg.AccessLogMaxBackups, "access-log-max-backups", 5, "rotated access log files kept, as <access-log>.1 (newest) to .N")
+
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", 0, "requests per second allowed per client (0 disables rate limiting)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", 20, "requests a client may burst above the rate limit")
+
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "comma-separated CIDRs or addresses of proxies, e.g. a load balancer, whose X-Forwarded-For and X-Real-IP give the client IP for rate limiting and logs")
+
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", "", "comma-separated origins browsers may call the API from, e.g. https://pos.example.com, https://*.example.com or * (empty disables CORS)")
+	fs.StringVar(&cfg.CORSMethods, "cors-methods", "GET, POST, DELETE", "methods allowed in cross-origin requests")
+	fs.StringVar(&cfg.CORSHeaders, "cors-headers", "Content-Type, Authorization, X-API-Key, X-Tenant-ID, X-Request-ID, Last-Event-ID, API-Version", "request headers allowed in cross-origin requests; include --tenant-header if renamed")
+	fs.DurationVar(&cfg.CORSMaxAge, "cors-max-age", 10*time.Minute, "how long browsers may cache a preflight response")
+
+	fs.StringVar(&cfg.Store.Kind, "store", "memory", "storage backend (memory, sqlite, postgres, redis)")
+	fs.StringVar(&cfg.Store.DBPath, "db-path", "receipts.db", "database file for the sqlite store")
+	fs.StringVar(&cfg.Store.DBURL, "db-url", "", "connection string for the postgres store")
+	fs.IntVar(&cfg.Store.DBMaxConns, "db-max-conns", 10, "maximum open connections for the postgres store")
+	fs.StringVar(&cfg.Store.RedisURL, "redis-url", "redis://localhost:6379/0", "connection URL for the redis store")
+	fs.StringVar(&cfg.Store.RedisPrefix, "redis-prefix", "receipt-processor:", "key prefix for the redis store")
+	fs.DurationVar(&cfg.Store.RedisTTL, "redis-ttl", 0, "expiry for stored receipts in redis (0 keeps them forever)")
+	fs.StringVar(&cfg.Store.WALDir, "wal-dir", "", "directory for the memory store's write-ahead log and snapshots (empty keeps nothing on disk)")
+	fs.DurationVar(&cfg.Store.WALCompactInterval, "wal-compact-interval", 10*time.Minute, "how often the write-ahead log is compacted into a snapshot")
+	fs.StringVar(&cfg.Store.SnapshotPath, "snapshot-path", "", "file the memory store is periodically saved to and restored from; a .gob name selects gob over JSON")
+	fs.DurationVar(&cfg.Store.SnapshotInterval, "snapshot-interval", 5*time.Minute, "how often the memory store is saved to --snapshot-path")
+	fs.DurationVar(&cfg.Store.Retention, "retention", 0, "how long the memory store keeps a receipt before evicting it (0 keeps them forever)")
+	fs.DurationVar(&cfg.Store.RetentionInterval, "retention-interval", 10*time.Minute, "how often receipts past --retention are evicted")
+	fs.IntVar(&cfg.Store.MaxEntries, "max-receipts", 0, "most receipts the memory store holds, give or take a few, before evicting the least recently used (0 for no limit)")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if err := applyEnv(fs); err != nil {
+		return cfg, err
+	}
+	if sunset != "" {
+		t, err := time.Parse("2006-01-02", sunset)
+		if err != nil {
+			return cfg, fmt.Errorf("legacy-sunset must be a YYYY-MM-DD date")
+		}
+		cfg.LegacySunset = t
+	}
+	if cfg.PointsMaxAge < 0 {
+		return cfg, fmt.Errorf("points-max-age must not be negative")
+	}
+	if cfg.CORSMaxAge < 0 {
+		return cfg, fmt.Errorf("cors-max-age must not be negative")
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 1 {
+		return cfg, fmt.Errorf("rate-limit must not be negative and rate-burst must be positive")
+	}
+	if cfg.TotalTolerance < 0 || cfg.MaxAgeDays < 0 {
+		return cfg, fmt.Errorf("total-tolerance and max-age-days must not be negative")
+	}
+	if cfg.ExpireMonths < 0 || cfg.ExpireInterval <= 0 || cfg.ExpiringSoon < 0 {
+		return cfg, fmt.Errorf("points-expire-months and expiring-soon must not be negative and expire-interval must be positive")
+	}
+	if cfg.RequestTimeout < 0 {
+		return cfg, fmt.Errorf("request-timeout must not be negative")
+	}
+	if cfg.IngestWorkers < 0 || cfg.IngestQueue < 0 {
+		return cfg, fmt.Errorf("ingest-workers and ingest-queue must not be negative")
+	}
+	if cfg.AsyncWorkers < 1 || cfg.AsyncQueue < 0 || cfg.JobTTL <= 0 {
+		return cfg, fmt.Errorf("async-workers and job-ttl must be positive and async-queue must not be negative")
+	}
+	if cfg.Fraud.Action != fraudFlag && cfg.Fraud.Action != fraudReject {
+		return cfg, fmt.Errorf("fraud-action must be flag or reject")
+	}
+	if cfg.Fraud.DuplicateWindow < 0 || cfg.Fraud.MaxItems < 0 || cfg.Fraud.VelocityLimit < 0 || cfg.Fraud.VelocityWindow <= 0 {
+		return cfg, fmt.Errorf("fraud-duplicate-window, fraud-max-items and fraud-velocity-limit must not be negative and fraud-velocity-window must be positive")
+	}
+	limits, err := parseVelocityLimits(*velocity)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.VelocityLimits = limits
+	if cfg.Refunds != refundsReject && cfg.Refunds != refundsZero && cfg.Refunds != refundsDeduct {
+		return cfg, fmt.Errorf("refunds must be reject, zero or deduct")
+	}
+	if !points.ValidCurrency(cfg.BaseCurrency) {
+		return cfg, fmt.Errorf("base-currency %q is not an ISO 4217 currency code", cfg.BaseCurrency)
+	}
+	if cfg.Store.Retention < 0 || cfg.Store.RetentionInterval <= 0 {
+		return cfg, fmt.Errorf("retention must not be negative and retention-interval must be positive")
+	}
+	if cfg.Store.MaxEntries < 0 {
+		return cfg, fmt.Errorf("max-receipts must not be negative")
+	}
+	if (cfg.Store.Retention > 0 || cfg.Store.MaxEntries > 0) && cfg.Store.Kind != "memory" {
+		return cfg, fmt.Errorf("retention and max-receipts apply to the memory store only; use redis-ttl or POST /admin/purge with the %s store", cfg.Store.Kind)
+	}
+	if cfg.Store.WALCompactInterval <= 0 || cfg.Store.SnapshotInterval <= 0 {
+		return cfg, fmt.Errorf("wal-compact-interval and snapshot-interval must be positive")
+	}
+	if cfg.Store.WALDir != "" && cfg.Store.SnapshotPath != "" {
+		return cfg, fmt.Errorf("wal-dir and snapshot-path cannot be used together")
+	}
+	if cfg.KafkaOutboxSize < 1 {
+		return cfg, fmt.Errorf("kafka-outbox-size must be positive")
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") || cfg.TLS.CertFile != "" && cfg.TLS.AutocertDomains != "" {
+		return cfg, fmt.Errorf("tls-cert and tls-key must be set together, and not with autocert-domains")
+	}
+	if (cfg.TLS.RedirectAddr != "" || cfg.TLS.ClientCA != "") && !cfg.TLS.enabled() {
+		return cfg, fmt.Errorf("redirect-addr and tls-client-ca need tls-cert or autocert-domains")
+	}
+	if (cfg.AdminUser == "") != (cfg.AdminPassword == "") {
+		return cfg, fmt.Errorf("admin-user and admin-password must be set together")
+	}
+	if cfg.AdminAddr != "" && cfg.AdminPassword == "" && cfg.AdminKey == "" {
+		return cfg, fmt.Errorf("admin-addr needs admin-user and admin-password or admin-key")
+	}
+	if cfg.AccessLogFormat != accessLogJSON && cfg.AccessLogFormat != accessLogCombined {
+		return cfg, fmt.Errorf("unknown access-log-format %q (want json or combined)", cfg.AccessLogFormat)
+	}
+	if cfg.AccessLogMaxMB < 0 || cfg.AccessLogMaxBackups < 0 {
+		return cfg, fmt.Errorf("access-log-max-mb and access-log-max-backups must not be negative")
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return cfg, fmt.Errorf("trusted-proxies: %w", err)
+	}
+	if cfg.IDScheme == "content" && !cfg.Dedup {
+		return cfg, fmt.Errorf("id-scheme=content needs dedup, or identical receipts would share an ID")
+	}
+	if cfg.MaxBodyBytes < 1 {
+		return cfg, fmt.Errorf("max-body-bytes must be positive")
+	}
+	for _, enc := range cfg.compressionEncodings() {
+		if _, ok := encoders[enc]; !ok {
+			return cfg, fmt.Errorf("unknown compression %q (want gzip or zstd)", enc)
+		}
+	}
+	return cfg, nil
+}
+
+func (c config) compressionEncodings() []string {
+	var encodings []string
+	for _, enc := range strings.Split(c.Compression, ",") {
+		if enc = strings.ToLower(strings.TrimSpace(enc)); enc != "" {
+			encodings = append(encodings, enc)
+		}
+	}
+	return encodings
+}
+
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
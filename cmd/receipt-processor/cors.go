@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposedHeaders are the response headers browsers let scripts read.
+const corsExposedHeaders = "X-Request-ID, Location, Retry-After, Content-Disposition, API-Version, Deprecation, Sunset, Link"
+
+// corsPolicy lets browser pages on other origins call the API. Origins are
+// matched exactly, "*" allows any, and "https://*.example.com" allows any
+// subdomain of example.com over HTTPS.
+type corsPolicy struct {
+	origins []string
+	methods string
+	headers string
+	maxAge  time.Duration
+}
+
+func newCORSPolicy(origins, methods, headers string, maxAge time.Duration) corsPolicy {
+	p := corsPolicy{methods: methods, headers: headers, maxAge: maxAge}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			p.origins = append(p.origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return p
+}
+
+func (p corsPolicy) allowed(origin string) bool {
+	for _, o := range p.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(o, "://*."); ok {
+			rest, found := strings.CutPrefix(origin, scheme+"://")
+			if found && strings.HasSuffix(strings.ToLower(rest), "."+strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// middleware adds the CORS headers to responses to allowed origins and
+// answers their preflight requests itself. Requests from other origins are
+// served without the headers, so browsers withhold the response.
+func (p corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !p.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", p.methods)
+			w.Header().Set("Access-Control-Allow-Headers", p.headers)
+			if p.maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
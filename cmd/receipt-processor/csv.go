@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const formatProblem = "format must be json or csv."
+
+// wantsCSV reports whether a request asks for CSV, through ?format=csv or an
+// Accept header preferring text/csv to JSON. ok is false if format is
+// neither json nor csv.
+func wantsCSV(r *http.Request) (asCSV, ok bool) {
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		return true, true
+	case "json":
+		return false, true
+	case "":
+		return acceptsCSV(r), true
+	}
+	return false, false
+}
+
+// acceptsCSV reports whether the Accept header asks for text/csv ahead of
+// JSON.
+func acceptsCSV(r *http.Request) bool {
+	for _, mt := range strings.Split(r.Header.Get("Accept"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(mt), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "text/csv":
+			return true
+		case "application/json", "application/*", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// newCSVResponse starts a CSV download named filename with the given header
+// row.
+func newCSVResponse(w http.ResponseWriter, filename string, header ...string) *csv.Writer {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	return cw
+}
+
+// csvText guards free text against being run as a formula by spreadsheets,
+// which treat cells starting with =, +, - or @ as one.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeReceiptsCSV streams the receipts opts selects, a page of the store at
+// a time, flushing each page to the client.
+func writeReceiptsCSV(w http.ResponseWriter, r *http.Request, opts ListOptions) {
+	rc := http.NewResponseController(w)
+	cw := newCSVResponse(w, "receipts.csv",
+		"id", "retailer", "purchaseDate", "purchaseTime", "total", "items", "points", "userId")
+	remaining := opts.Limit
+	for {
+		opts.Limit = recalculatePageSize
+		if remaining > 0 {
+			opts.Limit = min(remaining, recalculatePageSize)
+		}
+		recs, _, err := store.List(r.Context(), opts)
+		if err != nil {
+			// The status has been sent; cutting the file short is all
+			// that is left.
+			slog.ErrorContext(r.Context(), "CSV export failed", "error", err, "offset", opts.Offset)
+			return
+		}
+		for _, rec := range recs {
+			cw.Write([]string{rec.ID, csvText(rec.Receipt.Retailer), rec.Receipt.PurchaseDate, rec.Receipt.PurchaseTime,
+				rec.Receipt.Total, strconv.Itoa(len(rec.Receipt.Items)), strconv.Itoa(rec.Points), csvText(rec.UserID)})
+		}
+		cw.Flush()
+		if cw.Error() != nil {
+			return
+		}
+		rc.Flush()
+		opts.Offset += len(recs)
+		if remaining > 0 {
+			if remaining -= len(recs); remaining == 0 {
+				return
+			}
+		}
+		if len(recs) < opts.Limit {
+			return
+		}
+	}
+}
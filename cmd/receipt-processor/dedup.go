@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"receipt-processor/points"
+)
+
+// hashLocks serialize, in dedup mode, storing receipts with the same hash,
+// so that two copies submitted at once, as when a client retries, cannot
+// both miss the lookup for the other and both be stored and credited. They
+// are held per instance, from the lookup until the receipt is stored.
+var hashLocks [memoryShards]sync.Mutex
+
+// receiptHash identifies a tenant's receipt by content so resubmissions can
+// be detected. Surrounding whitespace is ignored since it never affects
+// points, and the retailer is normalized. Retailer aliases are left out:
+// they can change after a receipt is stored, which would leave its hash
+// behind, so a receipt resubmitted under an alias is not a duplicate.
+func receiptHash(tenant string, receipt points.Receipt) string {
+	return hashReceipt(tenant, receipt, points.NormalizeRetailer(receipt.Retailer))
+}
+
+// legacyReceiptHash is the hash receipts were stored with before retailer
+// names were normalized, which kept the name as sent.
+func legacyReceiptHash(tenant string, receipt points.Receipt) string {
+	return hashReceipt(tenant, receipt, strings.TrimSpace(receipt.Retailer))
+}
+
+func hashReceipt(tenant string, receipt points.Receipt, retailer string) string {
+	canonical := points.Receipt{
+		Retailer:     retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Timezone:     strings.TrimSpace(receipt.Timezone),
+		Total:        receipt.Total,
+		Tax:          receipt.Tax,
+		Currency:     receipt.Currency,
+		RefundOf:     receipt.RefundOf,
+		Items:        make([]points.Item, len(receipt.Items)),
+	}
+	for _, discount := range receipt.Discounts {
+		canonical.Discounts = append(canonical.Discounts, points.Discount{
+			Description: strings.TrimSpace(discount.Description),
+			Amount:      discount.Amount,
+		})
+	}
+	for i, item := range receipt.Items {
+		canonical.Items[i] = points.Item{
+			ShortDescription: strings.TrimSpace(item.ShortDescription),
+			Price:            item.Price,
+			Quantity:         item.Quantity,
+			UnitPrice:        item.UnitPrice,
+			Category:         strings.TrimSpace(item.Category),
+			SKU:              strings.TrimSpace(item.SKU),
+		}
+	}
+	data, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(append([]byte(tenant+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"receipt-processor/points"
+)
+
+// TestDedupIgnoresAliasChanges checks that adding an alias for a stored
+// receipt's retailer neither changes its hash nor keeps a resubmission of
+// it from being found as a duplicate.
+func TestDedupIgnoresAliasChanges(t *testing.T) {
+	oldStore, oldDedup, oldAliases := store, dedup, retailerAliases
+	t.Cleanup(func() { store, dedup, retailerAliases = oldStore, oldDedup, oldAliases })
+	store, dedup, retailerAliases = newMemoryStore(0), true, newRetailerAliasTable()
+
+	receipt := points.Receipt{
+		Retailer: "M and M Corner Market", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "6.49",
+		Items: []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	}
+	ctx := context.Background()
+	rec, _, err := processReceipt(ctx, receipt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := retailerAliases.put(retailerAlias{Alias: "M and M Corner Market", Retailer: "M&M Corner Market"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiptHash(rec.Tenant, receipt); got != rec.Hash {
+		t.Errorf("hash changed from %s to %s with the alias", rec.Hash, got)
+	}
+	again, duplicate, err := processReceipt(ctx, receipt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !duplicate || again.ID != rec.ID {
+		t.Errorf("resubmission stored as %s (duplicate %v), want %s", again.ID, duplicate, rec.ID)
+	}
+}
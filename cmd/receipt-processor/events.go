@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const eventReceiptProcessed = "receipt.processed"
+
+// receiptEvent announces a newly processed receipt.
+type receiptEvent struct {
+	Type      string    `json:"type"`
+	ReceiptID string    `json:"receiptId"`
+	Tenant    string    `json:"tenant"`
+	Retailer  string    `json:"retailer"`
+	Total     string    `json:"total"`
+	Points    int       `json:"points"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newReceiptEvent(rec Record) receiptEvent {
+	return receiptEvent{
+		Type:      eventReceiptProcessed,
+		ReceiptID: rec.ID,
+		Tenant:    rec.Tenant,
+		Retailer:  rec.Receipt.Retailer,
+		Total:     rec.Receipt.Total,
+		Points:    rec.Points,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// events is nil unless --kafka-brokers is set.
+var events *outbox
+
+// publishProcessed sends the event for a newly stored receipt to live
+// streams and queues it for Kafka.
+func publishProcessed(rec Record) {
+	e := newReceiptEvent(rec)
+	live.publish(e)
+	if events != nil {
+		events.add(e)
+	}
+}
+
+const (
+	outboxBatchSize  = 100
+	outboxMaxBackoff = 30 * time.Second
+)
+
+// outbox holds events until Kafka acknowledges them, retrying with backoff
+// while the broker is unreachable. Events are delivered at least once, keyed
+// by receipt ID. It lives in memory: if more than max events are waiting the
+// oldest are dropped, and events still waiting at shutdown are lost.
+type outbox struct {
+	writer *kafka.Writer
+	max    int
+	wake   chan struct{}
+
+	// sendMu keeps run and close from sending, and trimming, the same batch.
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []receiptEvent
+	// dropped counts events ever dropped from the front of pending.
+	dropped int
+}
+
+func newOutbox(brokers []string, topic string, max int) *outbox {
+	return &outbox{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  1,
+		},
+		max:  max,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) add(e receiptEvent) {
+	o.mu.Lock()
+	if len(o.pending) >= o.max {
+		o.pending = o.pending[1:]
+		o.dropped++
+		eventsDropped.Inc()
+	}
+	o.pending = append(o.pending, e)
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) depth() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// send publishes up to outboxBatchSize of the oldest events and removes
+// them once Kafka has them. It reports how many were sent.
+func (o *outbox) send(ctx context.Context) (int, error) {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+	o.mu.Lock()
+	batch := append([]receiptEvent(nil), o.pending[:min(len(o.pending), outboxBatchSize)]...)
+	dropped := o.dropped
+	o.mu.Unlock()
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	msgs := make([]kafka.Message, len(batch))
+	for i, e := range batch {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		msgs[i] = kafka.Message{Key: []byte(e.ReceiptID), Value: value}
+	}
+	if err := o.writer.WriteMessages(ctx, msgs...); err != nil {
+		return 0, err
+	}
+
+	// The batch was the front of pending; add may since have dropped some
+	// of it, but only from the front.
+	o.mu.Lock()
+	o.pending = o.pending[max(0, len(batch)-(o.dropped-dropped)):]
+	o.mu.Unlock()
+	eventsPublished.Add(float64(len(batch)))
+	return len(batch), nil
+}
+
+// run publishes events as they arrive until ctx is done.
+func (o *outbox) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		n, err := o.send(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			slog.Warn("publishing events", "error", err, "pending", o.depth(), "retry_in", backoff.String())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, outboxMaxBackoff)
+			continue
+		case n == outboxBatchSize:
+			backoff = time.Second
+			continue
+		}
+		backoff = time.Second
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		}
+	}
+}
+
+// close tries to publish the remaining events until ctx is done.
+func (o *outbox) close(ctx context.Context) error {
+	for o.depth() > 0 && ctx.Err() == nil {
+		if _, err := o.send(ctx); err != nil {
+			break
+		}
+	}
+	if n := o.depth(); n > 0 {
+		slog.Warn("dropping unpublished events", "events", n)
+	}
+	return o.writer.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"receipt-processor/points"
+)
+
+// expiryPolicy controls when awarded points expire. Points expire months
+// after the purchase date of the receipt that earned them; zero months
+// keeps them forever.
+type expiryPolicy struct {
+	months int
+	// soon is how far ahead the points endpoint looks for expiring points.
+	soon time.Duration
+}
+
+var pointsExpiry expiryPolicy
+
+func (p expiryPolicy) enabled() bool { return p.months > 0 }
+
+// expiresAt returns when points earned by receipt expire, or nil if they
+// never do.
+func (p expiryPolicy) expiresAt(receipt points.Receipt) *time.Time {
+	if !p.enabled() {
+		return nil
+	}
+	date, err := time.Parse(points.DateLayout, receipt.PurchaseDate)
+	if err != nil {
+		return nil
+	}
+	t := date.AddDate(0, p.months, 0)
+	return &t
+}
+
+// expiringPoints returns how many points in txs expire by t. Debits are
+// taken from the points that expire first, so credits expiring by t only
+// count for what earlier debits have not already used up.
+func expiringPoints(txs []Transaction, t time.Time) int {
+	due, spent := 0, 0
+	for _, tx := range txs {
+		switch {
+		case tx.Points < 0:
+			spent -= tx.Points
+		case tx.ExpiresAt != nil && !tx.ExpiresAt.After(t):
+			due += tx.Points
+		}
+	}
+	return max(0, due-spent)
+}
+
+// expirePoints records an expiration transaction for every user with points
+// past their expiry, and returns how many points expired.
+func expirePoints(ctx context.Context, now time.Time) (int, error) {
+	accounts, err := ledger.Accounts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, a := range accounts {
+		txs, _, err := ledger.Transactions(ctx, a.Tenant, a.UserID, ListOptions{})
+		if err != nil {
+			return expired, err
+		}
+		n := expiringPoints(txs, now)
+		if n == 0 {
+			continue
+		}
+		// Redeem rather than Append so a redemption made since the
+		// transactions were read cannot take the balance below zero. The
+		// next run picks up whatever is skipped.
+		_, err = ledger.Redeem(ctx, Transaction{
+			ID:        generateID(),
+			Tenant:    a.Tenant,
+			UserID:    a.UserID,
+			Kind:      txExpiration,
+			Points:    -n,
+			CreatedAt: now,
+		})
+		if errors.Is(err, errInsufficientPoints) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired += n
+	}
+	pointsExpired.Add(float64(expired))
+	return expired, nil
+}
+
+// runExpiry calls expirePoints every interval until ctx is done.
+func runExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := expirePoints(ctx, time.Now().UTC())
+		if err != nil {
+			slog.Error("expiring points", "error", err)
+		} else if n > 0 {
+			slog.Info("expired points", "points", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"receipt-processor/points"
+)
+
+// fraudConfig enables the built-in fraud checks; each is off at zero.
+type fraudConfig struct {
+	Action          string
+	DuplicateWindow time.Duration
+	MaxItems        int
+	VelocityLimit   int
+	VelocityWindow  time.Duration
+}
+
+// What happens to a receipt a fraud check finds suspicious.
+const (
+	// fraudFlag stores and credits the receipt as usual and holds it for
+	// review at /admin/flagged.
+	fraudFlag = "flag"
+	// fraudReject refuses the receipt.
+	fraudReject = "reject"
+)
+
+// errReceiptRejected is returned, wrapped in a *fraudError, for a receipt
+// refused by the fraud checks.
+var errReceiptRejected = errors.New("receipt rejected")
+
+type fraudError struct {
+	Reasons []string
+}
+
+func (e *fraudError) Error() string {
+	return "receipt rejected: " + strings.Join(e.Reasons, "; ")
+}
+
+func (e *fraudError) Unwrap() error {
+	return errReceiptRejected
+}
+
+// fraudCheck looks for signs of fraud in a receipt about to be stored, whose
+// ID, tenant, user and points are set. It returns why the receipt is
+// suspicious, or "" if it is not.
+type fraudCheck interface {
+	Name() string
+	Check(ctx context.Context, rec Record) (string, error)
+}
+
+// fraudPolicy runs the configured checks on every receipt before its points
+// are awarded. With no checks, receipts are not inspected.
+type fraudPolicy struct {
+	checks []fraudCheck
+	action string
+}
+
+var fraud fraudPolicy
+
+func newFraudPolicy(cfg fraudConfig) fraudPolicy {
+	p := fraudPolicy{action: cfg.Action}
+	if cfg.DuplicateWindow > 0 {
+		p.checks = append(p.checks, duplicateCheck{window: cfg.DuplicateWindow})
+	}
+	if cfg.MaxItems > 0 {
+		p.checks = append(p.checks, itemCountCheck{max: cfg.MaxItems})
+	}
+	if cfg.VelocityLimit > 0 {
+		p.checks = append(p.checks, velocityCheck{limit: cfg.VelocityLimit, events: newWindowCounter(cfg.VelocityWindow)})
+	}
+	return p
+}
+
+// inspect returns why rec is suspicious, if any check finds it so. A check
+// that fails is logged and skipped rather than holding up the receipt.
+func (p fraudPolicy) inspect(ctx context.Context, rec Record) []string {
+	var reasons []string
+	for _, c := range p.checks {
+		reason, err := c.Check(ctx, rec)
+		if err != nil {
+			slog.WarnContext(ctx, "fraud check failed", "check", c.Name(), "error", err)
+			continue
+		}
+		if reason != "" {
+			fraudDetections.WithLabelValues(c.Name(), p.action).Inc()
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// duplicateCheck finds receipts from the same retailer, for the same total,
+// purchased within window of one already stored for the tenant: the same
+// receipt submitted again with small changes.
+type duplicateCheck struct {
+	window time.Duration
+}
+
+func (duplicateCheck) Name() string { return "duplicate" }
+
+func (c duplicateCheck) Check(ctx context.Context, rec Record) (string, error) {
+	at, err := rec.Receipt.PurchasedAt()
+	if err != nil {
+		return "", err
+	}
+	from, to := at.Add(-c.window), at.Add(c.window)
+	recs, _, err := store.List(ctx, ListOptions{
+		Retailer: rec.Receipt.Retailer,
+		From:     from.Format(points.DateLayout),
+		To:       to.Format(points.DateLayout),
+	})
+	if err != nil {
+		return "", err
+	}
+	total, _ := points.ParseAmount(rec.Receipt.Total, rec.Receipt.Currency)
+	for _, other := range recs {
+		otherTotal, _ := points.ParseAmount(other.Receipt.Total, other.Receipt.Currency)
+		otherAt, err := other.Receipt.PurchasedAt()
+		if err != nil || otherTotal != total || receiptCurrency(other.Receipt) != receiptCurrency(rec.Receipt) || retailerKey(other.Receipt.Retailer) != retailerKey(rec.Receipt.Retailer) {
+			continue
+		}
+		if !otherAt.Before(from) && !otherAt.After(to) {
+			return fmt.Sprintf("same retailer and total as receipt %s, purchased within %s of it", other.ID, c.window), nil
+		}
+	}
+	return "", nil
+}
+
+// itemCountCheck finds receipts with more items than a real purchase would.
+type itemCountCheck struct {
+	max int
+}
+
+func (itemCountCheck) Name() string { return "items" }
+
+func (c itemCountCheck) Check(ctx context.Context, rec Record) (string, error) {
+	if n := len(rec.Receipt.Items); n > c.max {
+		return fmt.Sprintf("%d items is more than %d", n, c.max), nil
+	}
+	return "", nil
+}
+
+// velocityCheck finds users submitting more than limit receipts within
+// window. Submissions are counted in memory, per instance, whether or not
+// they are stored.
+type velocityCheck struct {
+	limit  int
+	events *windowCounter
+}
+
+func (velocityCheck) Name() string { return "velocity" }
+
+func (c velocityCheck) Check(ctx context.Context, rec Record) (string, error) {
+	if rec.UserID == "" {
+		return "", nil
+	}
+	if n := c.events.add(ledgerKey(rec.Tenant, rec.UserID), time.Now()); n > c.limit {
+		return fmt.Sprintf("user %s submitted %d receipts within %s", rec.UserID, n, c.events.window), nil
+	}
+	return "", nil
+}
+
+// flaggedReceipt is a stored receipt held for review.
+type flaggedReceipt struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	UserID    string    `json:"userId,omitempty"`
+	Points    int       `json:"points"`
+	Reasons   []string  `json:"reasons"`
+	FlaggedAt time.Time `json:"flaggedAt"`
+}
+
+// flagQueue holds flagged receipts until they are reviewed or deleted. It is
+// kept in memory only, so flags are lost on restart.
+type flagQueue struct {
+	mu sync.Mutex
+	m  map[string]flaggedReceipt
+}
+
+var flagged = &flagQueue{m: make(map[string]flaggedReceipt)}
+
+func (q *flagQueue) add(rec Record, reasons []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.m[rec.ID] = flaggedReceipt{rec.ID, rec.Tenant, rec.UserID, rec.Points, reasons, time.Now().UTC()}
+}
+
+func (q *flagQueue) has(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.m[id]
+	return ok
+}
+
+// remove drops the flag on the receipt with id and reports whether there
+// was one.
+func (q *flagQueue) remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.m[id]
+	delete(q.m, id)
+	return ok
+}
+
+// list returns the flagged receipts of tenant, or of every tenant if it is
+// empty, oldest first.
+func (q *flagQueue) list(tenant string) []flaggedReceipt {
+	q.mu.Lock()
+	var list []flaggedReceipt
+	for _, f := range q.m {
+		if tenant == "" || f.Tenant == tenant {
+			list = append(list, f)
+		}
+	}
+	q.mu.Unlock()
+	slices.SortFunc(list, func(a, b flaggedReceipt) int {
+		return cmp.Or(a.FlaggedAt.Compare(b.FlaggedAt), strings.Compare(a.ID, b.ID))
+	})
+	return list
+}
+
+// listFlaggedHandler serves GET /admin/flagged, a page of the receipts
+// awaiting review, oldest first, of every tenant or one with ?tenant=.
+func listFlaggedHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "tenant is not a valid tenant ID.")
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", maxPageSize))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "offset must be a non-negative integer.")
+		return
+	}
+
+	list := flagged.list(tenant)
+	start, end := ListOptions{Limit: limit, Offset: offset}.page(len(list))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Flagged []flaggedReceipt `json:"flagged"`
+		Total   int              `json:"total"`
+		Limit   int              `json:"limit"`
+		Offset  int              `json:"offset"`
+	}{append([]flaggedReceipt{}, list[start:end]...), len(list), limit, offset})
+}
+
+// approveFlaggedHandler serves POST /admin/flagged/{id}/approve, which
+// clears the flag and leaves the receipt and its points as they are.
+func approveFlaggedHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !flagged.remove(id) {
+		writeProblem(w, r, http.StatusNotFound, "No flagged receipt found for that ID.")
+		return
+	}
+	audit.record(r.Context(), auditEntry{Action: auditFlagApproved, Target: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectFlaggedHandler serves POST /admin/flagged/{id}/reject, which deletes
+// the receipt, taking its points back out of the user's balance.
+func rejectFlaggedHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !flagged.has(id) {
+		writeProblem(w, r, http.StatusNotFound, "No flagged receipt found for that ID.")
+		return
+	}
+	// Deleting the receipt drops its flag.
+	rec, err := store.Get(r.Context(), id)
+	if err == nil {
+		err = deleteRecord(r.Context(), rec)
+	}
+	if errors.Is(err, errNotFound) {
+		// Deleted since it was flagged.
+		flagged.remove(id)
+		writeProblem(w, r, http.StatusNotFound, "No flagged receipt found for that ID.")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "rejecting flagged receipt failed", "error", err, "receipt_id", id)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to delete receipt.")
+		return
+	}
+	audit.record(r.Context(), auditEntry{Action: auditFlagRejected, Tenant: rec.Tenant, Target: id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"receipt-processor/points"
+)
+
+// fxProvider gives exchange rates from the base currency: how many units of
+// currency one unit of the base currency buys.
+type fxProvider interface {
+	Rate(ctx context.Context, currency string) (*big.Rat, error)
+}
+
+// fx is nil, and spend in currencies other than baseCurrency is not
+// converted, unless --fx is set.
+var fx fxProvider
+
+// baseCurrency is the currency of receipts that do not name one and the
+// currency reported spend is converted into.
+var baseCurrency = "USD"
+
+var errNoRate = errors.New("no exchange rate")
+
+// fxCacheTTL is how long rates fetched by --fx=http are reused.
+const fxCacheTTL = time.Hour
+
+func newFXProvider(kind, base, ratesPath, url string) (fxProvider, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "static":
+		if ratesPath == "" {
+			return nil, errors.New("--fx=static needs --fx-rates")
+		}
+		data, err := os.ReadFile(ratesPath)
+		if err != nil {
+			return nil, err
+		}
+		rates, err := parseRates(data)
+		if err != nil {
+			return nil, fmt.Errorf("exchange rates file %s: %w", ratesPath, err)
+		}
+		return staticFX(rates), nil
+	case "http":
+		if url == "" {
+			return nil, errors.New("--fx=http needs --fx-url")
+		}
+		return &httpFX{url: url, base: base, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unknown FX provider %q", kind)
+}
+
+// parseRates reads a JSON object mapping currency codes to rates, keeping
+// the rates exact.
+func parseRates(data []byte) (map[string]*big.Rat, error) {
+	var raw map[string]json.Number
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rates := make(map[string]*big.Rat, len(raw))
+	for code, n := range raw {
+		if !points.ValidCurrency(code) {
+			return nil, fmt.Errorf("%q is not an ISO 4217 currency code", code)
+		}
+		rate, ok := new(big.Rat).SetString(n.String())
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("rate for %s must be a positive number", code)
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
+
+// staticFX serves the rates in the --fx-rates file, e.g. {"EUR": 0.92}.
+type staticFX map[string]*big.Rat
+
+func (s staticFX) Rate(ctx context.Context, currency string) (*big.Rat, error) {
+	if rate, ok := s[currency]; ok {
+		return rate, nil
+	}
+	return nil, fmt.Errorf("%w for %s", errNoRate, currency)
+}
+
+// httpFX fetches rates from a service such as Frankfurter, which is asked
+// for ?base= the base currency and responds with JSON
+// {"rates": {"EUR": 0.92, ...}}. Rates are fetched at most once an hour.
+type httpFX struct {
+	url    string
+	base   string
+	client *http.Client
+
+	mu        sync.Mutex
+	rates     map[string]*big.Rat
+	fetchedAt time.Time
+}
+
+func (h *httpFX) Rate(ctx context.Context, currency string) (*big.Rat, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rates == nil || time.Since(h.fetchedAt) > fxCacheTTL {
+		rates, err := h.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.rates, h.fetchedAt = rates, time.Now()
+	}
+	if rate, ok := h.rates[currency]; ok {
+		return rate, nil
+	}
+	return nil, fmt.Errorf("%w for %s", errNoRate, currency)
+}
+
+func (h *httpFX) fetch(ctx context.Context) (map[string]*big.Rat, error) {
+	u, err := url.Parse(h.url)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("base", h.base)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("FX service returned %s", resp.Status)
+	}
+	var v struct {
+		Rates json.RawMessage `json:"rates"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&v); err != nil {
+		return nil, err
+	}
+	return parseRates(v.Rates)
+}
+
+// receiptCurrency returns the currency receipt is in.
+func receiptCurrency(receipt points.Receipt) string {
+	if receipt.Currency == "" {
+		return baseCurrency
+	}
+	return receipt.Currency
+}
+
+// currencyTotals sums receipt totals per currency, in its minor units.
+type currencyTotals map[string]points.Money
+
+// add adds receipt's total, or subtracts it if sign is negative.
+func (c currencyTotals) add(receipt points.Receipt, sign int) {
+	total, err := points.ParseAmount(receipt.Total, receipt.Currency)
+	if err != nil {
+		return
+	}
+	// Receipts that name no currency have two decimal places, whatever
+	// the base currency's minor units.
+	currency := receiptCurrency(receipt)
+	total = total.Rescale(points.MinorUnits(receipt.Currency), points.MinorUnits(currency))
+	if c[currency] += points.Money(sign) * total; c[currency] == 0 {
+		delete(c, currency)
+	}
+}
+
+// convert returns the sum of the totals in the base currency, each
+// converted and rounded to the nearest of its minor units.
+func (c currencyTotals) convert(ctx context.Context) (points.Money, error) {
+	var sum points.Money
+	for currency, amount := range c {
+		if currency == baseCurrency {
+			sum += amount
+			continue
+		}
+		if fx == nil {
+			return 0, fmt.Errorf("%w for %s: --fx is not set", errNoRate, currency)
+		}
+		rate, err := fx.Rate(ctx, currency)
+		if err != nil {
+			return 0, err
+		}
+		// amount is in minor units of currency, and the sum in those of
+		// the base currency.
+		scale := new(big.Rat).SetFrac(pow10(points.MinorUnits(baseCurrency)), pow10(points.MinorUnits(currency)))
+		converted := new(big.Rat).Quo(new(big.Rat).SetInt64(int64(amount)), rate)
+		converted.Mul(converted, scale)
+		// Round half away from zero.
+		q, m := new(big.Int).QuoRem(converted.Num(), converted.Denom(), new(big.Int))
+		if m.Abs(m).Lsh(m, 1).Cmp(converted.Denom()) >= 0 {
+			q.Add(q, big.NewInt(int64(converted.Sign())))
+		}
+		sum += points.Money(q.Int64())
+	}
+	return sum, nil
+}
+
+// spendTotal is what receipts added up to per currency and, if every
+// currency could be converted, in the base currency.
+type spendTotal struct {
+	Currency   string            `json:"currency"`
+	Amount     string            `json:"amount,omitempty"`
+	ByCurrency map[string]string `json:"byCurrency"`
+}
+
+// spend reports c, leaving out Amount, and logging why, if it cannot be
+// converted.
+func (c currencyTotals) spend(ctx context.Context) spendTotal {
+	s := spendTotal{Currency: baseCurrency, ByCurrency: make(map[string]string, len(c))}
+	for currency, amount := range c {
+		s.ByCurrency[currency] = amount.Format(currency)
+	}
+	if amount, err := c.convert(ctx); err != nil {
+		slog.WarnContext(ctx, "converting spend failed", "error", err)
+	} else {
+		s.Amount = amount.Format(baseCurrency)
+	}
+	return s
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/graph-gophers/graphql-go"
+
+	"receipt-processor/points"
+)
+
+//go:embed schema.graphql
+var graphQLSchema string
+
+var gqlSchema = graphql.MustParseSchema(graphQLSchema, &gqlQuery{},
+	graphql.MaxDepth(8),
+)
+
+// graphQLHandler serves POST /graphql. Queries see only the caller's
+// tenant, as the REST endpoints do.
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+	if err := decodeJSON(r.Body, &req, false); err != nil {
+		writeDecodeError(w, r, err, "The request is not a GraphQL query. Please verify input.")
+		return
+	}
+	resp := gqlSchema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type gqlQuery struct{}
+
+// missing turns errNotFound into a null result.
+func missing[T any](v *T, err error) (*T, error) {
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (gqlQuery) Receipt(ctx context.Context, args struct{ ID graphql.ID }) (*gqlReceipt, error) {
+	rec, err := store.Get(ctx, string(args.ID))
+	return missing(&gqlReceipt{rec}, err)
+}
+
+func (gqlQuery) Points(ctx context.Context, args struct{ ID graphql.ID }) (*int32, error) {
+	p, err := store.GetPoints(ctx, string(args.ID))
+	n := int32(p)
+	return missing(&n, err)
+}
+
+func (gqlQuery) Breakdown(ctx context.Context, args struct{ ID graphql.ID }) (*gqlBreakdown, error) {
+	rec, err := store.Get(ctx, string(args.ID))
+	if err != nil {
+		return missing[gqlBreakdown](nil, err)
+	}
+	return gqlReceipt{rec}.Breakdown()
+}
+
+type gqlReceiptFilter struct {
+	Limit     int32
+	Offset    int32
+	Retailer  *string
+	From      *string
+	To        *string
+	MinPoints *int32
+	MaxPoints *int32
+	Sort      *string
+}
+
+func (gqlQuery) Receipts(ctx context.Context, args struct{ Filter *gqlReceiptFilter }) (*gqlReceiptPage, error) {
+	opts := ListOptions{Limit: defaultPageSize}
+	if f := args.Filter; f != nil {
+		opts.Limit, opts.Offset = int(f.Limit), int(f.Offset)
+		opts.Retailer, opts.From, opts.To = deref(f.Retailer), deref(f.From), deref(f.To)
+		if !validDate(opts.From) || !validDate(opts.To) {
+			return nil, errors.New("from and to must be dates in YYYY-MM-DD format")
+		}
+		if f.MinPoints != nil {
+			n := int(*f.MinPoints)
+			opts.MinPoints = &n
+		}
+		if f.MaxPoints != nil {
+			n := int(*f.MaxPoints)
+			opts.MaxPoints = &n
+		}
+		var ok bool
+		if opts.Sort, opts.Desc, ok = parseSort(deref(f.Sort)); !ok {
+			return nil, errors.New("sort must be id, points, purchaseDate or retailer, optionally prefixed with - for descending order")
+		}
+	}
+	if opts.Limit < 1 || opts.Limit > maxPageSize {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	if opts.Offset < 0 {
+		return nil, errors.New("offset must be a non-negative integer")
+	}
+	recs, total, err := store.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	page := &gqlReceiptPage{total: int32(total)}
+	for _, rec := range recs {
+		page.receipts = append(page.receipts, gqlReceipt{rec})
+	}
+	return page, nil
+}
+
+type gqlReceiptPage struct {
+	receipts []gqlReceipt
+	total    int32
+}
+
+func (p gqlReceiptPage) Receipts() []gqlReceipt { return p.receipts }
+func (p gqlReceiptPage) Total() int32           { return p.total }
+
+type gqlReceipt struct{ rec Record }
+
+func (r gqlReceipt) ID() graphql.ID       { return graphql.ID(r.rec.ID) }
+func (r gqlReceipt) Retailer() string     { return r.rec.Receipt.Retailer }
+func (r gqlReceipt) PurchaseDate() string { return r.rec.Receipt.PurchaseDate }
+func (r gqlReceipt) PurchaseTime() string { return r.rec.Receipt.PurchaseTime }
+func (r gqlReceipt) Timezone() *string    { return optional(r.rec.Receipt.Timezone) }
+func (r gqlReceipt) Total() string        { return r.rec.Receipt.Total }
+func (r gqlReceipt) Tax() *string         { return optional(r.rec.Receipt.Tax) }
+func (r gqlReceipt) Currency() *string    { return optional(r.rec.Receipt.Currency) }
+func (r gqlReceipt) RefundOf() *string    { return optional(r.rec.Receipt.RefundOf) }
+func (r gqlReceipt) Points() int32        { return int32(r.rec.Points) }
+func (r gqlReceipt) RuleVersion() string  { return r.rec.RuleVersion }
+func (r gqlReceipt) UserID() *string      { return optional(r.rec.UserID) }
+
+func (r gqlReceipt) Discounts() []gqlDiscount {
+	discounts := make([]gqlDiscount, len(r.rec.Receipt.Discounts))
+	for i, discount := range r.rec.Receipt.Discounts {
+		discounts[i] = gqlDiscount{discount}
+	}
+	return discounts
+}
+
+func (r gqlReceipt) Items() []gqlItem {
+	items := make([]gqlItem, len(r.rec.Receipt.Items))
+	for i, item := range r.rec.Receipt.Items {
+		items[i] = gqlItem{item}
+	}
+	return items
+}
+
+func (r gqlReceipt) Breakdown() (*gqlBreakdown, error) {
+	results, err := evaluateRecord(r.rec)
+	if errors.Is(err, errRuleSetMissing) {
+		return nil, fmt.Errorf("rule set %q is no longer configured", r.rec.RuleVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gqlBreakdown{r.rec.RuleVersion, results}, nil
+}
+
+type gqlItem struct{ item points.Item }
+
+func (i gqlItem) ShortDescription() string { return i.item.ShortDescription }
+func (i gqlItem) Price() string            { return i.item.Price }
+func (i gqlItem) Quantity() *float64       { return optionalNumber(i.item.Quantity) }
+func (i gqlItem) UnitPrice() *string       { return optional(i.item.UnitPrice) }
+func (i gqlItem) Category() *string        { return optional(i.item.Category) }
+func (i gqlItem) Sku() *string             { return optional(i.item.SKU) }
+
+type gqlDiscount struct{ discount points.Discount }
+
+func (d gqlDiscount) Description() *string { return optional(d.discount.Description) }
+func (d gqlDiscount) Amount() string       { return d.discount.Amount }
+
+type gqlBreakdown struct {
+	ruleVersion string
+	results     []points.Result
+}
+
+func (b gqlBreakdown) Points() int32       { return int32(points.Total(b.results)) }
+func (b gqlBreakdown) RuleVersion() string { return b.ruleVersion }
+
+func (b gqlBreakdown) Rules() []gqlRuleResult {
+	rules := make([]gqlRuleResult, len(b.results))
+	for i, res := range b.results {
+		rules[i] = gqlRuleResult{res}
+	}
+	return rules
+}
+
+type gqlRuleResult struct{ res points.Result }
+
+func (r gqlRuleResult) Rule() string        { return r.res.Rule }
+func (r gqlRuleResult) Description() string { return r.res.Description }
+func (r gqlRuleResult) Points() int32       { return int32(r.res.Points) }
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// optional maps an empty string to null.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func optionalNumber(n json.Number) *float64 {
+	f, err := n.Float64()
+	if err != nil {
+		return nil
+	}
+	return &f
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"receipt-processor/points"
+	"receipt-processor/receiptpb"
+)
+
+type grpcServer struct {
+	receiptpb.UnimplementedReceiptProcessorServer
+}
+
+// newGRPCServer returns the gRPC server, with RPCs abandoned after timeout
+// unless it is zero or the client set an earlier deadline. With tlsCfg, the
+// API listener's TLS configuration, it only accepts TLS connections.
+func newGRPCServer(timeout time.Duration, tlsCfg *tls.Config) *grpc.Server {
+	interceptors := []grpc.UnaryServerInterceptor{grpcLabelClient, grpcRecoverPanics}
+	if timeout > 0 {
+		interceptors = append(interceptors, grpcDeadline(timeout))
+	}
+	interceptors = append(interceptors, grpcTenantInterceptor)
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(interceptors...)}
+	if tlsCfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	srv := grpc.NewServer(opts...)
+	receiptpb.RegisterReceiptProcessorServer(srv, grpcServer{})
+	return srv
+}
+
+// grpcRecoverPanics answers an RPC whose handler panics with Internal, as
+// recoverPanics does for HTTP, where grpc-go would let the panic crash the
+// server.
+func grpcRecoverPanics(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic(ctx, "grpc", v, "method", info.FullMethod)
+			resp, err = nil, status.Error(codes.Internal, "the server failed to handle the request")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// grpcLabelClient logs each call made with a verified client certificate,
+// sets its common name on the call's trace span and counts it in
+// clientRequests, as the HTTP middleware do for client_cn.
+func grpcLabelClient(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	cn := grpcClientCN(ctx)
+	if cn == "" {
+		return handler(ctx, req)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("tls.client.common_name", cn))
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	clientRequests.WithLabelValues(cn, code.String()).Inc()
+	slog.InfoContext(ctx, "grpc request", "method", info.FullMethod, "code", code.String(),
+		"latency_ms", float64(time.Since(start).Microseconds())/1000, "client_cn", cn)
+	return resp, err
+}
+
+func grpcDeadline(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// grpcTenantInterceptor resolves the tenant from x-api-key / tenant header
+// metadata the same way the HTTP handlers do.
+func grpcTenantInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	tenant, err := tenancy.resolve(first("x-api-key"), first(strings.ToLower(tenancy.header)))
+	switch {
+	case errors.Is(err, errUnauthorized):
+		return nil, status.Error(codes.Unauthenticated, "a valid API key is required")
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, "the tenant ID is invalid")
+	}
+	return handler(withActor(withTenantContext(ctx, tenant), keyActor(first("x-api-key"))), req)
+}
+
+func (grpcServer) ProcessReceipt(ctx context.Context, req *receiptpb.ProcessReceiptRequest) (*receiptpb.ProcessReceiptResponse, error) {
+	var rec Record
+	var err error
+	if qerr := ingest.do(ctx, func(ctx context.Context) {
+		rec, _, err = processReceipt(ctx, receiptFromProto(req.GetReceipt()), req.GetUserId())
+	}); qerr != nil {
+		if errors.Is(qerr, errQueueFull) {
+			return nil, status.Error(codes.ResourceExhausted, "the server is busy")
+		}
+		return nil, status.FromContextError(qerr).Err()
+	}
+	if errors.Is(err, points.ErrInvalidReceipt) {
+		return nil, invalidReceiptStatus(err)
+	}
+	if errors.Is(err, errReceiptRejected) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, errVelocityLimit) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "grpc ProcessReceipt failed", "error", err)
+		return nil, status.Error(codes.Internal, "failed to store receipt")
+	}
+	return &receiptpb.ProcessReceiptResponse{Id: rec.ID}, nil
+}
+
+func (grpcServer) GetPoints(ctx context.Context, req *receiptpb.GetPointsRequest) (*receiptpb.GetPointsResponse, error) {
+	points, err := store.GetPoints(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+	return &receiptpb.GetPointsResponse{Points: int64(points)}, nil
+}
+
+func (grpcServer) GetBreakdown(ctx context.Context, req *receiptpb.GetBreakdownRequest) (*receiptpb.GetBreakdownResponse, error) {
+	rec, results, err := receiptBreakdown(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+	resp := &receiptpb.GetBreakdownResponse{Points: int64(rec.Points), RuleVersion: rec.RuleVersion}
+	for _, r := range results {
+		resp.Breakdown = append(resp.Breakdown, &receiptpb.RuleResult{Rule: r.Rule, Description: r.Description, Points: int64(r.Points)})
+	}
+	return resp, nil
+}
+
+// invalidReceiptStatus reports a rejected receipt, attaching the failing
+// fields as a BadRequest detail.
+func invalidReceiptStatus(err error) error {
+	st := status.New(codes.InvalidArgument, "The receipt is invalid. Please verify input.")
+	var v *points.ValidationError
+	if !errors.As(err, &v) {
+		return st.Err()
+	}
+	br := &errdetails.BadRequest{}
+	for _, f := range v.Fields {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+	}
+	if detailed, err := st.WithDetails(br); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+func grpcStoreError(ctx context.Context, err error) error {
+	if errors.Is(err, errNotFound) {
+		return status.Error(codes.NotFound, "No receipt found for that ID.")
+	}
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	slog.ErrorContext(ctx, "grpc store call failed", "error", err)
+	return status.Error(codes.Internal, "failed to load receipt")
+}
+
+func receiptFromProto(pb *receiptpb.Receipt) points.Receipt {
+	receipt := points.Receipt{
+		Retailer:     pb.GetRetailer(),
+		PurchaseDate: pb.GetPurchaseDate(),
+		PurchaseTime: pb.GetPurchaseTime(),
+		Timezone:     pb.GetTimezone(),
+		Total:        pb.GetTotal(),
+		Tax:          pb.GetTax(),
+		Currency:     pb.GetCurrency(),
+		RefundOf:     pb.GetRefundOf(),
+	}
+	for _, item := range pb.GetItems() {
+		receipt.Items = append(receipt.Items, points.Item{
+			ShortDescription: item.GetShortDescription(),
+			Price:            item.GetPrice(),
+			Quantity:         json.Number(item.GetQuantity()),
+			UnitPrice:        item.GetUnitPrice(),
+			Category:         item.GetCategory(),
+			SKU:              item.GetSku(),
+		})
+	}
+	for _, d := range pb.GetDiscounts() {
+		receipt.Discounts = append(receipt.Discounts, points.Discount{
+			Description: d.GetDescription(),
+			Amount:      d.GetAmount(),
+		})
+	}
+	return receipt
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"receipt-processor/receiptpb"
+)
+
+// TestGRPCMatchesHTTP submits the same receipt, with quantities, tax and a
+// discount, over HTTP and gRPC and checks that both store it alike and
+// award it the same points.
+func TestGRPCMatchesHTTP(t *testing.T) {
+	const body = `{
+		"retailer": "Target",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "13:01",
+		"timezone": "America/Chicago",
+		"currency": "USD",
+		"items": [
+			{"shortDescription": "Mountain Dew 12PK", "price": "12.98", "quantity": "2", "unitPrice": "6.49"},
+			{"shortDescription": "Emils Cheese Pizza", "price": "12.25"}
+		],
+		"tax": "2.00",
+		"discounts": [{"description": "Coupon", "amount": "1.23"}],
+		"total": "26.00"
+	}`
+	pb := &receiptpb.Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Timezone:     "America/Chicago",
+		Currency:     "USD",
+		Items: []*receiptpb.Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "12.98", Quantity: "2", UnitPrice: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+		},
+		Tax:       "2.00",
+		Discounts: []*receiptpb.Discount{{Description: "Coupon", Amount: "1.23"}},
+		Total:     "26.00",
+	}
+
+	// Separate tenants keep the second submission from being found as a
+	// duplicate of the first.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(body))
+	r = r.WithContext(withTenantContext(r.Context(), "http"))
+	processReceiptHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HTTP: status %d: %s", w.Code, w.Body)
+	}
+	var created struct{ ID string }
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	overHTTP, err := store.Get(context.Background(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := grpcServer{}.ProcessReceipt(withTenantContext(context.Background(), "grpc"),
+		&receiptpb.ProcessReceiptRequest{Receipt: pb})
+	if err != nil {
+		t.Fatalf("gRPC: %v", err)
+	}
+	overGRPC, err := store.Get(context.Background(), resp.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(overGRPC.Receipt, overHTTP.Receipt) {
+		t.Errorf("gRPC stored %+v, HTTP stored %+v", overGRPC.Receipt, overHTTP.Receipt)
+	}
+	if overGRPC.Points != overHTTP.Points {
+		t.Errorf("gRPC awarded %d points, HTTP %d", overGRPC.Points, overHTTP.Points)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// errVersionNotFound is returned for a version a receipt does not have.
+var errVersionNotFound = errors.New("receipt version not found")
+
+// versions returns every version of rec's receipt, oldest first, ending with
+// the latest.
+func (rec Record) versions() []ReceiptVersion {
+	versions := make([]ReceiptVersion, 0, len(rec.History)+1)
+	for i, v := range rec.History {
+		v.Version = i + 1
+		versions = append(versions, v)
+	}
+	return append(versions, ReceiptVersion{
+		Version:     len(rec.History) + 1,
+		Receipt:     rec.Receipt,
+		Points:      rec.Points,
+		RuleVersion: rec.RuleVersion,
+	})
+}
+
+// versionPoints returns the points version of the receipt with id was
+// scored.
+func versionPoints(ctx context.Context, id string, version int) (int, error) {
+	rec, err := store.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	versions := rec.versions()
+	if version < 1 || version > len(versions) {
+		return 0, errVersionNotFound
+	}
+	return versions[version-1].Points, nil
+}
+
+// receiptHistoryHandler serves GET /receipts/{id}/history, every version of
+// a receipt from the one first submitted to the latest, with its points.
+func receiptHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := store.Get(r.Context(), receiptID(r))
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt.")
+		return
+	}
+
+	versions := rec.versions()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID       string           `json:"id"`
+		Current  int              `json:"current"`
+		Versions []ReceiptVersion `json:"versions"`
+	}{rec.ID, len(versions), versions})
+}
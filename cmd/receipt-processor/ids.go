@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+// idGenerator makes the IDs of new receipts.
+type idGenerator interface {
+	NewID(rec Record) string
+}
+
+// receiptIDs makes receipt IDs in the --id-scheme.
+var receiptIDs idGenerator = uuidV4IDs{}
+
+func newIDGenerator(kind string, seed uint64) (idGenerator, error) {
+	switch kind {
+	case "", "uuidv4":
+		return uuidV4IDs{}, nil
+	case "uuidv7":
+		return &uuidV7IDs{}, nil
+	case "ulid":
+		return &ulidIDs{}, nil
+	case "content":
+		return contentIDs{}, nil
+	case "sequence":
+		return newSequenceIDs(seed), nil
+	}
+	return nil, fmt.Errorf("unknown ID scheme %q (want uuidv4, uuidv7, ulid, content or sequence)", kind)
+}
+
+// generateID returns a random (version 4) UUID, the ID of requests, jobs,
+// transactions and audit entries, and by default of receipts. crypto/rand
+// does not fail; it crashes the program if the system's source of
+// randomness does.
+func generateID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+func formatUUID(b [16]byte) string {
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
+
+// uuidV4IDs are random UUIDs.
+type uuidV4IDs struct{}
+
+func (uuidV4IDs) NewID(Record) string {
+	return generateID()
+}
+
+// uuidV7IDs are UUIDs that begin with the millisecond they were made in, so
+// they sort, and the stores list receipts, in the order they were submitted.
+// Within a millisecond, a 12-bit counter keeps them in order; the 4097th ID
+// in one borrows the next. The rest of each ID is random. The order holds
+// for IDs made by one instance.
+type uuidV7IDs struct {
+	mu  sync.Mutex
+	ms  int64
+	seq uint64
+}
+
+func (g *uuidV7IDs) NewID(Record) string {
+	g.mu.Lock()
+	if ms := time.Now().UnixMilli(); ms > g.ms {
+		g.ms, g.seq = ms, 0
+	} else if g.seq++; g.seq > 0xfff {
+		g.ms, g.seq = g.ms+1, 0
+	}
+	ms, seq := g.ms, g.seq
+	g.mu.Unlock()
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(ms)<<16|0x7000|seq)
+	rand.Read(b[8:])
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// crockford is the Base32 alphabet of ULIDs, which leaves out I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidIDs are ULIDs: 26 characters that begin with the millisecond they were
+// made in, so they sort in the order receipts were submitted, followed by 80
+// random bits. Within a millisecond, each ID's random bits are one more than
+// the last's, keeping them in order.
+type ulidIDs struct {
+	mu      sync.Mutex
+	ms      int64
+	entropy [10]byte
+}
+
+func (g *ulidIDs) NewID(Record) string {
+	g.mu.Lock()
+	if ms := time.Now().UnixMilli(); ms > g.ms {
+		g.ms = ms
+		rand.Read(g.entropy[:])
+	} else if !increment(g.entropy[:]) {
+		g.ms++
+		rand.Read(g.entropy[:])
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(g.ms)<<16)
+	copy(b[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+// increment adds one to the big-endian number b, reporting false if it
+// overflowed.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i]++; b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// contentNamespace is the namespace of content-derived receipt IDs.
+var contentNamespace = [16]byte{0x6b, 0x1f, 0x3c, 0x52, 0x0e, 0x8d, 0x4a, 0x07, 0x9b, 0x62, 0x41, 0xd5, 0x2c, 0x93, 0x7e, 0x18}
+
+// contentIDs are name-based (version 5) UUIDs of each receipt's tenant and
+// dedup hash, so the same receipt always gets the same ID, e.g. when
+// reloaded into another instance. They need --dedup, which stores each
+// receipt once.
+type contentIDs struct{}
+
+func (contentIDs) NewID(rec Record) string {
+	h := sha1.New()
+	h.Write(contentNamespace[:])
+	h.Write([]byte(receiptHash(rec.Tenant, rec.Receipt)))
+	var b [16]byte
+	copy(b[:], h.Sum(nil))
+	b[6] = b[6]&0x0f | 0x50
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// sequenceIDs are UUIDs drawn from a pseudorandom sequence seeded with
+// --id-seed, so a run that submits the same receipts in the same order gets
+// the same IDs, for test fixtures and graders to assert. They are for
+// testing only: anyone can predict them, and every restart begins the
+// sequence again, skipping IDs already stored.
+type sequenceIDs struct {
+	mu  sync.Mutex
+	rng *mathrand.ChaCha8
+}
+
+func newSequenceIDs(seed uint64) *sequenceIDs {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	return &sequenceIDs{rng: mathrand.NewChaCha8(key)}
+}
+
+func (g *sequenceIDs) NewID(Record) string {
+	var b [16]byte
+	g.mu.Lock()
+	g.rng.Read(b[:])
+	g.mu.Unlock()
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// claimID makes sure no receipt is already stored under rec.ID, which can
+// only happen with deterministic IDs. A sequence ID that is taken by any
+// tenant, e.g. after a restart, is replaced with the next. Content-derived
+// IDs give the same ID to a receipt submitted again after it was corrected,
+// when its old dedup hash no longer finds it; the corrected receipt is
+// returned with duplicate set.
+func claimID(ctx context.Context, rec *Record) (existing Record, duplicate bool, err error) {
+	switch gen := receiptIDs.(type) {
+	case contentIDs:
+		existing, err = store.Get(ctx, rec.ID)
+		if errors.Is(err, errNotFound) {
+			return Record{}, false, nil
+		}
+		return existing, err == nil, err
+	case *sequenceIDs:
+		for {
+			_, err := store.Get(allTenants(ctx), rec.ID)
+			if errors.Is(err, errNotFound) {
+				return Record{}, false, nil
+			}
+			if err != nil {
+				return Record{}, false, err
+			}
+			rec.ID = gen.NewID(*rec)
+		}
+	}
+	return Record{}, false, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+)
+
+var errQueueFull = errors.New("ingestion queue is full")
+
+// ingestQueue bounds how many submissions are scored and stored at once.
+// Requests beyond what the workers and queue can hold are turned away
+// rather than piling up behind the store.
+type ingestQueue struct {
+	tasks chan func()
+}
+
+// ingest is nil, and submissions are processed by the goroutine handling
+// the request, unless --ingest-workers is set.
+var ingest *ingestQueue
+
+func newIngestQueue(workers, size int) *ingestQueue {
+	q := &ingestQueue{tasks: make(chan func(), size)}
+	for range workers {
+		go func() {
+			for task := range q.tasks {
+				task()
+			}
+		}()
+	}
+	return q
+}
+
+// do runs fn on a worker and waits for it to finish. It returns errQueueFull
+// without running fn if no worker or queue slot is free, and ctx's error if
+// ctx is done first; fn is then skipped if it has not started. If fn panics,
+// do panics in the caller with it, so that the caller's recovery handles it
+// rather than the panic killing the worker and the process.
+func (q *ingestQueue) do(ctx context.Context, fn func(context.Context)) error {
+	if q == nil {
+		fn(ctx)
+		return nil
+	}
+	done := make(chan *workerPanic, 1)
+	task := func() {
+		defer func() {
+			if v := recover(); v != nil {
+				p := &workerPanic{value: v, stack: debug.Stack()}
+				if ctx.Err() != nil {
+					// The caller may have stopped waiting.
+					logPanic(ctx, "ingest", *p)
+				}
+				done <- p
+				return
+			}
+			done <- nil
+		}()
+		if ctx.Err() == nil {
+			fn(ctx)
+		}
+	}
+	select {
+	case q.tasks <- task:
+	default:
+		ingestRejected.Inc()
+		return errQueueFull
+	}
+	select {
+	case p := <-done:
+		if p != nil {
+			panic(*p)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *ingestQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.tasks)
+}
+
+// writeIngestError responds to a submission do turned away.
+func writeIngestError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, http.StatusTooManyRequests, "The server is busy. Please retry later.")
+		return
+	}
+	writeProblem(w, r, http.StatusServiceUnavailable, "The request was cancelled before it was processed.")
+}
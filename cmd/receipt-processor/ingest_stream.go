@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"receipt-processor/points"
+)
+
+// maxLineBytes bounds each line of a streamed submission, as --max-body-bytes
+// bounds other request bodies.
+var maxLineBytes int64 = 10 << 20
+
+// errLineTooLong is returned for a line of a streamed submission longer than
+// maxLineBytes.
+var errLineTooLong = errors.New("line too long")
+
+// unlimitedBody reports whether r is to a route that reads its body a line
+// at a time, and so takes a body of any size, holding each line to
+// maxLineBytes instead.
+func unlimitedBody(r *http.Request) bool {
+	_, path, _ := splitVersion(r.URL.Path)
+	return r.Method == http.MethodPost && path == "/receipts/process/stream"
+}
+
+// streamRetryDelay is how long a streamed submission waits to try again
+// when every ingest worker and queue slot is taken.
+const streamRetryDelay = 100 * time.Millisecond
+
+// processStreamHandler serves POST /receipts/process/stream, which reads
+// receipts as newline-delimited JSON and writes a result line for each, as
+// /receipts/process/batch reports them, as soon as it is processed. Only one
+// line is held at a time, so bodies may be any size. A line that is not a
+// receipt gets an error result and the stream goes on. With --ingest-workers,
+// receipts wait for a free worker rather than being turned away, which slows
+// the reading of the body. The stream outlives --read-timeout,
+// --write-timeout and --request-timeout.
+func processStreamHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	// HTTP/1.1 otherwise stops reading the body once the response starts.
+	rc.EnableFullDuplex()
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	liftDeadline(ctx)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	br := bufio.NewReader(r.Body)
+	enc := json.NewEncoder(w)
+	for i, n := 0, 1; ctx.Err() == nil; n++ {
+		line, err := readLine(br, maxLineBytes)
+		if err == io.EOF {
+			return
+		}
+		var result batchResult
+		switch {
+		case errors.Is(err, errLineTooLong):
+			result = batchResult{Index: i, Error: fmt.Sprintf("Line %d is longer than %d bytes.", n, maxLineBytes)}
+		case err != nil:
+			// The client went away or the connection broke.
+			slog.WarnContext(ctx, "reading streamed receipts failed", "error", err, "line", n)
+			return
+		case len(bytes.TrimSpace(line)) == 0:
+			continue
+		default:
+			var sub submission
+			if err := decodeJSON(bytes.NewReader(line), &sub, strict); err != nil {
+				result = batchResult{Index: i, Error: fmt.Sprintf("Line %d is not a valid receipt. Please verify input.", n)}
+				var v *points.ValidationError
+				if errors.As(err, &v) {
+					result.Errors = v.Fields
+				}
+			} else {
+				result = processStreamed(ctx, i, sub)
+			}
+		}
+		if i == 0 {
+			// Not before the body is first read, which sends any 100
+			// Continue the client is waiting for.
+			w.WriteHeader(http.StatusOK)
+		}
+		i++
+		if err := enc.Encode(result); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+}
+
+// processStreamed processes one streamed receipt on an ingest worker,
+// waiting for one to be free.
+func processStreamed(ctx context.Context, i int, sub submission) batchResult {
+	for {
+		var result batchResult
+		err := ingest.do(ctx, func(ctx context.Context) {
+			result = processSubmission(ctx, i, sub)
+		})
+		if err == nil {
+			return result
+		}
+		if !errors.Is(err, errQueueFull) {
+			return batchResult{Index: i, Error: "The request ended before this receipt was processed."}
+		}
+		select {
+		case <-ctx.Done():
+			return batchResult{Index: i, Error: "The request ended before this receipt was processed."}
+		case <-time.After(streamRetryDelay):
+		}
+	}
+}
+
+// readLine reads the next line from br, without its newline. A line longer
+// than limit is skipped and reported with errLineTooLong. The last line need
+// not end in a newline; io.EOF is returned once there are no more.
+func readLine(br *bufio.Reader, limit int64) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLong {
+			if int64(len(line)+len(chunk)) > limit+1 {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err == io.EOF && (len(line) > 0 || tooLong):
+		case err != nil:
+			return nil, err
+		}
+		if tooLong {
+			return nil, errLineTooLong
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), nil
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job statuses.
+const (
+	jobPending  = "pending"
+	jobComplete = "complete"
+	// jobFailed means at least one receipt in the job was rejected or could
+	// not be stored; its result says why.
+	jobFailed = "failed"
+)
+
+// job is a set of receipts submitted with ?async=true, processed in the
+// background.
+type job struct {
+	ID          string        `json:"id"`
+	Tenant      string        `json:"-"`
+	Status      string        `json:"status"`
+	Results     []batchResult `json:"results,omitempty"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	CompletedAt *time.Time    `json:"completedAt,omitempty"`
+
+	receipts []submission
+	actor    string
+	// request is the request that submitted the job, whose metadata its
+	// receipts are stored with.
+	request *requestInfo
+}
+
+// jobQueue runs jobs on a fixed pool of workers. Jobs live in memory only:
+// they are lost on restart, and finished jobs are forgotten after ttl.
+type jobQueue struct {
+	queue chan *job
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+var jobs *jobQueue
+
+func newJobQueue(workers, size int, ttl time.Duration) *jobQueue {
+	q := &jobQueue{queue: make(chan *job, size), ttl: ttl, jobs: make(map[string]*job)}
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+func (q *jobQueue) work() {
+	for j := range q.queue {
+		ctx := withActor(withTenantContext(context.Background(), j.Tenant), j.actor)
+		if j.request != nil {
+			ctx = context.WithValue(ctx, requestInfoKey{}, j.request)
+		}
+		results := processSubmissions(ctx, j.receipts)
+		status := jobComplete
+		for _, r := range results {
+			if r.Error != "" {
+				status = jobFailed
+				break
+			}
+		}
+		now := time.Now().UTC()
+		q.mu.Lock()
+		j.Status, j.Results, j.CompletedAt, j.receipts = status, results, &now, nil
+		q.mu.Unlock()
+	}
+}
+
+// submit queues j, or reports false if the queue is full.
+func (q *jobQueue) submit(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	select {
+	case q.queue <- j:
+		q.jobs[j.ID] = j
+		return true
+	default:
+		return false
+	}
+}
+
+// prune forgets jobs that finished more than ttl ago. The caller must hold
+// q.mu.
+func (q *jobQueue) prune() {
+	cutoff := time.Now().Add(-q.ttl)
+	for id, j := range q.jobs {
+		if j.CompletedAt != nil && j.CompletedAt.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// get returns a copy of the job, if it exists and belongs to tenant.
+func (q *jobQueue) get(tenant, id string) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || j.Tenant != tenant {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// submitJob queues receipts for processing and responds 202 with the job.
+func submitJob(w http.ResponseWriter, r *http.Request, receipts []submission) {
+	tenant, _ := tenantFrom(r.Context())
+	j := &job{
+		ID:        generateID(),
+		Tenant:    tenant,
+		Status:    jobPending,
+		CreatedAt: time.Now().UTC(),
+		receipts:  receipts,
+		actor:     actorFrom(r.Context()),
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		request := *info
+		j.request = &request
+	}
+	resp := *j
+	if !jobs.submit(j) {
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, http.StatusServiceUnavailable, "The job queue is full. Please retry later.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r.Context(), "/jobs/"+j.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// jobHandler serves GET /jobs/{id}.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, _ := tenantFrom(r.Context())
+	j, ok := jobs.get(tenant, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "No job found for that ID.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
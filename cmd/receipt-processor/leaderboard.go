@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"receipt-processor/points"
+)
+
+const (
+	defaultLeaderboardDays = 30
+	maxLeaderboardDays     = 366
+	defaultLeaderboardSize = 10
+	maxLeaderboardSize     = 100
+)
+
+// leaderboardIndex keeps running point totals per tenant, purchase date, and
+// user or retailer, updated as receipts are stored, rescored, and deleted.
+// A query sums at most maxLeaderboardDays days instead of reading the store.
+// Totals for dates older than that are dropped. Retailers are kept by
+// normalized name, as in tenantStats. With a shared store, which this
+// instance does not see every change to, each query builds an index of its
+// own from the store instead.
+type leaderboardIndex struct {
+	mu    sync.Mutex
+	days  map[string]map[string]*dayTotals
+	names map[string]retailerNames
+}
+
+type dayTotals struct {
+	users     map[string]int
+	retailers map[string]int
+}
+
+var leaderboard = newLeaderboardIndex()
+
+func newLeaderboardIndex() *leaderboardIndex {
+	return &leaderboardIndex{days: make(map[string]map[string]*dayTotals), names: make(map[string]retailerNames)}
+}
+
+// record adds change to the totals of rec's user and retailer on its
+// purchase date.
+func (l *leaderboardIndex) record(rec Record, change int) {
+	date, err := time.Parse(points.DateLayout, rec.Receipt.PurchaseDate)
+	if change == 0 || err != nil || date.Before(leaderboardCutoff(maxLeaderboardDays)) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	byDate := l.days[rec.Tenant]
+	if byDate == nil {
+		byDate = make(map[string]*dayTotals)
+		l.days[rec.Tenant] = byDate
+		l.names[rec.Tenant] = make(retailerNames)
+	}
+	day := byDate[rec.Receipt.PurchaseDate]
+	if day == nil {
+		l.prune()
+		day = &dayTotals{users: make(map[string]int), retailers: make(map[string]int)}
+		byDate[rec.Receipt.PurchaseDate] = day
+	}
+	if rec.UserID != "" {
+		// A user whose receipts are all deleted is dropped, so that
+		// erasing a user's data leaves no trace of them here.
+		if day.users[rec.UserID] += change; day.users[rec.UserID] == 0 {
+			delete(day.users, rec.UserID)
+		}
+	}
+	day.retailers[l.names[rec.Tenant].note(rec.Receipt.Retailer)] += change
+}
+
+// prune drops dates no query can reach. The caller must hold l.mu.
+func (l *leaderboardIndex) prune() {
+	cutoff := leaderboardCutoff(maxLeaderboardDays).Format(points.DateLayout)
+	for _, byDate := range l.days {
+		for date := range byDate {
+			if date < cutoff {
+				delete(byDate, date)
+			}
+		}
+	}
+}
+
+// load builds the index from the stored receipts opts matches.
+func (l *leaderboardIndex) load(ctx context.Context, opts ListOptions) error {
+	opts.Limit = recalculatePageSize
+	for opts.Offset = 0; ; opts.Offset += recalculatePageSize {
+		recs, _, err := store.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			l.record(rec, rec.Points)
+		}
+		if len(recs) < recalculatePageSize {
+			return nil
+		}
+	}
+}
+
+type leaderboardEntry struct {
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+}
+
+// top returns the n highest totals for tenant over receipts purchased in the
+// last days days, by user or by retailer.
+func (l *leaderboardIndex) top(tenant string, byRetailer bool, days, n int) []leaderboardEntry {
+	cutoff := leaderboardCutoff(days).Format(points.DateLayout)
+	totals := make(map[string]int)
+	l.mu.Lock()
+	for date, day := range l.days[tenant] {
+		if date < cutoff {
+			continue
+		}
+		m := day.users
+		if byRetailer {
+			m = day.retailers
+		}
+		for name, p := range m {
+			totals[name] += p
+		}
+	}
+	if byRetailer {
+		totals = l.names[tenant].group(totals)
+	}
+	l.mu.Unlock()
+
+	entries := make([]leaderboardEntry, 0, len(totals))
+	for name, p := range totals {
+		if p > 0 {
+			entries = append(entries, leaderboardEntry{name, p})
+		}
+	}
+	slices.SortFunc(entries, func(a, b leaderboardEntry) int {
+		return cmp.Or(cmp.Compare(b.Points, a.Points), strings.Compare(a.Name, b.Name))
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// leaderboardCutoff is the earliest purchase date in a window of days days
+// ending today.
+func leaderboardCutoff(days int) time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, time.UTC)
+}
+
+// leaderboardHandler serves GET /leaderboard?by=users|retailers&days=30&limit=10.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "users"
+	}
+	if by != "users" && by != "retailers" {
+		writeProblem(w, r, http.StatusBadRequest, "by must be users or retailers.")
+		return
+	}
+	days, err := queryInt(r, "days", defaultLeaderboardDays)
+	if err != nil || days < 1 || days > maxLeaderboardDays {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d.", maxLeaderboardDays))
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultLeaderboardSize)
+	if err != nil || limit < 1 || limit > maxLeaderboardSize {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", maxLeaderboardSize))
+		return
+	}
+	tenant, _ := tenantFrom(r.Context())
+
+	board := leaderboard
+	if sharedStore {
+		board = newLeaderboardIndex()
+		if err := board.load(r.Context(), ListOptions{From: leaderboardCutoff(days).Format(points.DateLayout)}); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to load the leaderboard.")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		By      string             `json:"by"`
+		Days    int                `json:"days"`
+		Entries []leaderboardEntry `json:"entries"`
+	}{by, days, board.top(tenant, by == "retailers", days, limit)})
+}
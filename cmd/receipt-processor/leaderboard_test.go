@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"receipt-processor/points"
+)
+
+// TestLeaderboardSharedStore checks that with a shared store the
+// leaderboard counts receipts another instance stored, and stops counting
+// those it deleted, though this instance's index saw neither.
+func TestLeaderboardSharedStore(t *testing.T) {
+	oldStore, oldShared := store, sharedStore
+	t.Cleanup(func() { store, sharedStore = oldStore, oldShared })
+	store, sharedStore = newMemoryStore(0), true
+
+	ctx := withTenantContext(context.Background(), "acme")
+	today := time.Now().UTC().Format(points.DateLayout)
+	recs := []Record{
+		{ID: "r1", UserID: "alice", Points: 30, Receipt: points.Receipt{Retailer: "Target", PurchaseDate: today}},
+		{ID: "r2", UserID: "bob", Points: 20, Receipt: points.Receipt{Retailer: "Target", PurchaseDate: today}},
+		{ID: "r3", UserID: "bob", Points: 50, Receipt: points.Receipt{Retailer: "Walgreens", PurchaseDate: "2000-01-01"}},
+	}
+	for _, rec := range recs {
+		rec.Tenant = "acme"
+		if err := store.Save(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	top := func() []leaderboardEntry {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/leaderboard", nil)
+		leaderboardHandler(w, r.WithContext(withTenantContext(r.Context(), "acme")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var resp struct{ Entries []leaderboardEntry }
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Entries
+	}
+	if got, want := top(), []leaderboardEntry{{"alice", 30}, {"bob", 20}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("leaderboard = %v, want %v", got, want)
+	}
+	if err := store.Delete(ctx, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := top(), []leaderboardEntry{{"bob", 20}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("leaderboard after a delete = %v, want %v", got, want)
+	}
+}
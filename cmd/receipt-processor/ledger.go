@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9_\-.@]{1,128}$`)
+
+const maxReferenceLength = 256
+
+// Kinds of ledger transaction.
+const (
+	// txCredit awards the points of a newly processed receipt.
+	txCredit = "credit"
+	// txAdjustment corrects a user's balance after a receipt is rescored
+	// or deleted.
+	txAdjustment = "adjustment"
+	// txRedemption spends points from the balance.
+	txRedemption = "redemption"
+	// txExpiration removes points that have passed their expiry.
+	txExpiration = "expiration"
+	// txRefund takes back points of a refunded receipt.
+	txRefund = "refund"
+)
+
+var errInsufficientPoints = errors.New("insufficient points")
+
+// Transaction is one entry in a user's points ledger. Points is negative for
+// entries that reduce the balance. ExpiresAt is set on entries adding points
+// that will expire.
+type Transaction struct {
+	ID        string     `json:"id"`
+	Tenant    string     `json:"-"`
+	UserID    string     `json:"userId"`
+	Kind      string     `json:"kind"`
+	Points    int        `json:"points"`
+	ReceiptID string     `json:"receiptId,omitempty"`
+	Reference string     `json:"reference,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Account identifies a user's ledger within a tenant.
+type Account struct {
+	Tenant string `json:"tenant"`
+	UserID string `json:"userId"`
+}
+
+// Ledger records points transactions per tenant and user. A user with no
+// transactions has a zero balance.
+type Ledger interface {
+	Append(ctx context.Context, tx Transaction) error
+	Balance(ctx context.Context, tenant, userID string) (int, error)
+	// Transactions lists a user's transactions, newest first.
+	Transactions(ctx context.Context, tenant, userID string, opts ListOptions) ([]Transaction, int, error)
+	// Redeem appends tx, whose Points are negative, and returns the new
+	// balance, unless that would leave the balance below zero, in which
+	// case it returns errInsufficientPoints. The check and the append are
+	// atomic.
+	Redeem(ctx context.Context, tx Transaction) (int, error)
+	// Accounts lists every user with at least one transaction.
+	Accounts(ctx context.Context) ([]Account, error)
+	// DeleteAccount deletes all of a user's transactions and returns how
+	// many there were.
+	DeleteAccount(ctx context.Context, tenant, userID string) (int, error)
+}
+
+var ledger Ledger = newMemoryStore(0)
+
+// recordTransaction appends a transaction for the user a receipt was
+// submitted for. Receipts without a user, and zero-point changes, are not
+// recorded.
+func recordTransaction(ctx context.Context, rec Record, kind string, points int) error {
+	if rec.UserID == "" || (points == 0 && kind != txCredit) {
+		return nil
+	}
+	tx := Transaction{
+		ID:        generateID(),
+		Tenant:    rec.Tenant,
+		UserID:    rec.UserID,
+		Kind:      kind,
+		Points:    points,
+		ReceiptID: rec.ID,
+		CreatedAt: time.Now().UTC(),
+	}
+	if points > 0 {
+		tx.ExpiresAt = pointsExpiry.expiresAt(rec.Receipt)
+	}
+	return ledger.Append(ctx, tx)
+}
+
+// userFrom returns the caller's tenant and the {userId} of a user route, or
+// reports that the user ID is invalid.
+func userFrom(w http.ResponseWriter, r *http.Request) (tenant, userID string, ok bool) {
+	userID = r.PathValue("userId")
+	if !userIDPattern.MatchString(userID) {
+		writeProblem(w, r, http.StatusBadRequest, "The user ID is invalid.")
+		return "", "", false
+	}
+	tenant, _ = tenantFrom(r.Context())
+	return tenant, userID, true
+}
+
+// userPointsHandler serves GET /users/{userId}/points.
+func userPointsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, userID, ok := userFrom(w, r)
+	if !ok {
+		return
+	}
+	balance, err := ledger.Balance(r.Context(), tenant, userID)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load the balance.")
+		return
+	}
+	resp := map[string]any{"userId": userID, "points": balance}
+	if pointsExpiry.enabled() {
+		txs, _, err := ledger.Transactions(r.Context(), tenant, userID, ListOptions{})
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to load the balance.")
+			return
+		}
+		by := time.Now().UTC().Add(pointsExpiry.soon)
+		resp["expiringSoon"] = expiringPoints(txs, by)
+		resp["expiringBy"] = by
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// userTransactionsHandler serves GET /users/{userId}/transactions.
+func userTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, userID, ok := userFrom(w, r)
+	if !ok {
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", maxPageSize))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "offset must be a non-negative integer.")
+		return
+	}
+	txs, total, err := ledger.Transactions(r.Context(), tenant, userID, ListOptions{Limit: limit, Offset: offset})
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list transactions.")
+		return
+	}
+	if txs == nil {
+		txs = []Transaction{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Transactions []Transaction `json:"transactions"`
+		Total        int           `json:"total"`
+		Limit        int           `json:"limit"`
+		Offset       int           `json:"offset"`
+	}{txs, total, limit, offset})
+}
+
+type redemptionRequest struct {
+	Points    int    `json:"points"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// redeemHandler serves POST /users/{userId}/redeem.
+func redeemHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, userID, ok := userFrom(w, r)
+	if !ok {
+		return
+	}
+	var req redemptionRequest
+	if err := decodeJSON(r.Body, &req, strict); err != nil {
+		writeDecodeError(w, r, err, "The redemption is invalid. Please verify input.")
+		return
+	}
+	if req.Points < 1 {
+		writeProblem(w, r, http.StatusBadRequest, "points must be a positive integer.")
+		return
+	}
+	if len(req.Reference) > maxReferenceLength {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("reference must be at most %d characters.", maxReferenceLength))
+		return
+	}
+
+	tx := Transaction{
+		ID:        generateID(),
+		Tenant:    tenant,
+		UserID:    userID,
+		Kind:      txRedemption,
+		Points:    -req.Points,
+		Reference: req.Reference,
+		CreatedAt: time.Now().UTC(),
+	}
+	balance, err := ledger.Redeem(r.Context(), tx)
+	if errors.Is(err, errInsufficientPoints) {
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Insufficient points: the balance is %d.", balance))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "redeem failed", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to redeem points.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Transaction Transaction `json:"transaction"`
+		Balance     int         `json:"balance"`
+	}{tx, balance})
+}
+
+func ledgerKey(tenant, userID string) string {
+	return tenant + "\x00" + userID
+}
+
+func (s *memoryStore) Append(ctx context.Context, tx Transaction) error {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	key := ledgerKey(tx.Tenant, tx.UserID)
+	s.ledger[key] = append(s.ledger[key], tx)
+	return nil
+}
+
+func (s *memoryStore) Balance(ctx context.Context, tenant, userID string) (int, error) {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	balance := 0
+	for _, tx := range s.ledger[ledgerKey(tenant, userID)] {
+		balance += tx.Points
+	}
+	return balance, nil
+}
+
+func (s *memoryStore) Redeem(ctx context.Context, tx Transaction) (int, error) {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	key := ledgerKey(tx.Tenant, tx.UserID)
+	balance := 0
+	for _, t := range s.ledger[key] {
+		balance += t.Points
+	}
+	if balance+tx.Points < 0 {
+		return balance, errInsufficientPoints
+	}
+	s.ledger[key] = append(s.ledger[key], tx)
+	return balance + tx.Points, nil
+}
+
+func (s *memoryStore) Accounts(ctx context.Context) ([]Account, error) {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	accounts := make([]Account, 0, len(s.ledger))
+	for key := range s.ledger {
+		tenant, userID, _ := strings.Cut(key, "\x00")
+		accounts = append(accounts, Account{tenant, userID})
+	}
+	return accounts, nil
+}
+
+func (s *memoryStore) DeleteAccount(ctx context.Context, tenant, userID string) (int, error) {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	key := ledgerKey(tenant, userID)
+	n := len(s.ledger[key])
+	delete(s.ledger, key)
+	return n, nil
+}
+
+func (s *memoryStore) Transactions(ctx context.Context, tenant, userID string, opts ListOptions) ([]Transaction, int, error) {
+	s.ledgerMu.Lock()
+	txs := append([]Transaction(nil), s.ledger[ledgerKey(tenant, userID)]...)
+	s.ledgerMu.Unlock()
+	slices.Reverse(txs)
+	start, end := opts.page(len(txs))
+	return txs[start:end], len(txs), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRedeemConcurrent redeems more points than a user has from many
+// goroutines at once and checks that exactly the redemptions the balance
+// covers succeed, leaving it at zero rather than below.
+func TestRedeemConcurrent(t *testing.T) {
+	ledgers := map[string]func(t *testing.T) Ledger{
+		"memory": func(t *testing.T) Ledger {
+			return newMemoryStore(0)
+		},
+		"wal": func(t *testing.T) Ledger {
+			s, err := openWALStore(t.TempDir(), time.Hour, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+		"sqlite": func(t *testing.T) Ledger {
+			s, err := newSQLiteStore(filepath.Join(t.TempDir(), "receipts.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+	for name, open := range ledgers {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			l := open(t)
+			const balance, cost, attempts = 100, 10, 50
+			credit := Transaction{ID: generateID(), Tenant: "acme", UserID: "alice", Kind: txCredit, Points: balance, CreatedAt: time.Now()}
+			if err := l.Append(ctx, credit); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				wg        sync.WaitGroup
+				succeeded atomic.Int32
+			)
+			for range attempts {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					tx := Transaction{ID: generateID(), Tenant: "acme", UserID: "alice", Kind: txRedemption, Points: -cost, CreatedAt: time.Now()}
+					left, err := l.Redeem(ctx, tx)
+					switch {
+					case errors.Is(err, errInsufficientPoints):
+					case err != nil:
+						t.Error(err)
+					case left < 0:
+						t.Errorf("redemption left a balance of %d", left)
+					default:
+						succeeded.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got, want := int(succeeded.Load()), balance/cost; got != want {
+				t.Errorf("%d redemptions succeeded, want %d", got, want)
+			}
+			if got, err := l.Balance(ctx, "acme", "alice"); err != nil || got != 0 {
+				t.Errorf("Balance = %d, %v; want 0", got, err)
+			}
+		})
+	}
+}
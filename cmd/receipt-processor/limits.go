@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// windowCounter counts events per key over a sliding window. Counts are
+// kept in memory, so each instance has its own.
+type windowCounter struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newWindowCounter(window time.Duration) *windowCounter {
+	return &windowCounter{window: window, seen: make(map[string][]time.Time)}
+}
+
+// recent returns key's events within the window before now, oldest first,
+// forgetting older ones. The caller must hold c.mu.
+func (c *windowCounter) recent(key string, now time.Time) []time.Time {
+	cutoff := now.Add(-c.window)
+	if now.Sub(c.lastSweep) > c.window {
+		// Forget keys with no events since the window began.
+		for k, times := range c.seen {
+			if !times[len(times)-1].After(cutoff) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	times := c.seen[key]
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	if i == len(times) {
+		delete(c.seen, key)
+		return nil
+	}
+	times = times[i:]
+	c.seen[key] = times
+	return times
+}
+
+// add records an event for key at now and returns how many key has had
+// within the window, this one included.
+func (c *windowCounter) add(key string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	times := append(c.recent(key, now), now)
+	c.seen[key] = times
+	return len(times)
+}
+
+// addUnder records an event for key at now if key has had fewer than max
+// within the window. Otherwise it records nothing and returns how long until
+// the oldest of them leaves the window.
+func (c *windowCounter) addUnder(key string, max int, now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	times := c.recent(key, now)
+	if len(times) >= max {
+		return times[len(times)-max].Add(c.window).Sub(now), false
+	}
+	c.seen[key] = append(times, now)
+	return 0, true
+}
+
+// removeLast forgets key's latest event.
+func (c *windowCounter) removeLast(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if times := c.seen[key]; len(times) > 1 {
+		c.seen[key] = times[:len(times)-1]
+	} else {
+		delete(c.seen, key)
+	}
+}
+
+// Velocity limit scopes.
+const (
+	// limitUser counts a user's receipts.
+	limitUser = "user"
+	// limitUserRetailer counts a user's receipts from each retailer.
+	limitUserRetailer = "user-retailer"
+)
+
+// errVelocityLimit is returned, wrapped in a *velocityError, for a receipt
+// over one of the --velocity-limits.
+var errVelocityLimit = errors.New("velocity limit exceeded")
+
+// velocityLimit caps how many receipts a user may submit within a window,
+// altogether or from each retailer, as written in --velocity-limits, e.g.
+// user:5/1h or user-retailer:1/24h.
+type velocityLimit struct {
+	spec   string
+	scope  string
+	max    int
+	window string
+	events *windowCounter
+}
+
+// parseVelocityLimits parses a comma-separated list of limits, each a scope,
+// a colon, a count, a slash and a duration.
+func parseVelocityLimits(s string) ([]*velocityLimit, error) {
+	var limits []*velocityLimit
+	for _, spec := range strings.Split(s, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		scope, rest, ok1 := strings.Cut(spec, ":")
+		count, window, ok2 := strings.Cut(rest, "/")
+		max, err := strconv.Atoi(count)
+		if !ok1 || !ok2 || err != nil || max < 1 {
+			return nil, fmt.Errorf("velocity limit %q must look like user:5/1h", spec)
+		}
+		if scope != limitUser && scope != limitUserRetailer {
+			return nil, fmt.Errorf("velocity limit %q: scope must be %s or %s", spec, limitUser, limitUserRetailer)
+		}
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("velocity limit %q: %q is not a positive duration", spec, window)
+		}
+		limits = append(limits, &velocityLimit{spec: spec, scope: scope, max: max, window: window, events: newWindowCounter(d)})
+	}
+	return limits, nil
+}
+
+func (l *velocityLimit) key(rec Record) string {
+	key := ledgerKey(rec.Tenant, rec.UserID)
+	if l.scope == limitUserRetailer {
+		key += "\x00" + retailerKey(rec.Receipt.Retailer)
+	}
+	return key
+}
+
+type velocityError struct {
+	limit      *velocityLimit
+	retryAfter time.Duration
+}
+
+func (e *velocityError) Error() string {
+	return "velocity limit " + e.limit.spec + " exceeded"
+}
+
+func (e *velocityError) Unwrap() error {
+	return errVelocityLimit
+}
+
+// message tells the client which limit the receipt is over.
+func (e *velocityError) message() string {
+	per := "per user"
+	if e.limit.scope == limitUserRetailer {
+		per = "per user and retailer"
+	}
+	return fmt.Sprintf("At most %d receipts %s are accepted every %s.", e.limit.max, per, e.limit.window)
+}
+
+// velocityLimits are checked for every receipt with a user, in the order
+// configured.
+var velocityLimits []*velocityLimit
+
+// velocityMu makes checking every limit and counting the receipt against
+// them one step.
+var velocityMu sync.Mutex
+
+// checkVelocity counts rec against every velocity limit, or, if it is over
+// one, counts it against none and returns a *velocityError. Receipts without
+// a user are not limited.
+func checkVelocity(rec Record) error {
+	if rec.UserID == "" || len(velocityLimits) == 0 {
+		return nil
+	}
+	velocityMu.Lock()
+	defer velocityMu.Unlock()
+	now := time.Now()
+	for i, l := range velocityLimits {
+		if retryAfter, ok := l.events.addUnder(l.key(rec), l.max, now); !ok {
+			// Take the receipt back out of the limits it was counted
+			// against.
+			for _, counted := range velocityLimits[:i] {
+				counted.events.removeLast(counted.key(rec))
+			}
+			velocityLimitHits.WithLabelValues(l.spec).Inc()
+			return &velocityError{l, retryAfter}
+		}
+	}
+	return nil
+}
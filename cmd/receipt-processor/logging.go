@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo carries per-request values that handlers fill in for the
+// access log line.
+type requestInfo struct {
+	ID         string
+	ReceiptID  string
+	RemoteAddr string
+	Received   time.Time
+}
+
+func setupLogging() {
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, nil)}))
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID, when there is one, to every record
+// logged with a request context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		r.AddAttrs(slog.String("request_id", info.ID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+func setReceiptID(ctx context.Context, id string) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.ReceiptID = id
+	}
+}
+
+// withRequestID gives each request an ID, the one in its X-Request-ID header
+// if the client sent one, returns it in the response and adds it to every
+// record logged for the request.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{ID: r.Header.Get("X-Request-ID"), RemoteAddr: clientIP(r), Received: time.Now()}
+		if info.ID == "" {
+			info.ID = generateID()
+		}
+		w.Header().Set("X-Request-ID", info.ID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	})
+}
+
+// logRequests writes an access log line for each request once it has been
+// served, in --access-log-format to --access-log.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		requestLog.log(r, rec, start)
+	})
+}
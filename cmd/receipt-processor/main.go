@@ -0,0 +1,997 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	// The runtime image has no zone database for receipt time zones.
+	_ "time/tzdata"
+
+	"google.golang.org/grpc"
+
+	"receipt-processor/points"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+var store Store = newMemoryStore(0)
+
+var dedup bool
+
+// sharedStore is set when the store is shared; see storeConfig.shared.
+var sharedStore bool
+
+var strict bool
+
+var validator points.Validator
+
+// pointsMaxAge is how long clients and caches may reuse a receipt's points
+// before revalidating them.
+var pointsMaxAge time.Duration
+
+var errRuleSetMissing = errors.New("rule set version is not configured")
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "score" {
+		if err := runScore(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "receipt-processor score:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	setupLogging()
+
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("parsing configuration", err)
+	}
+	dedup = cfg.Dedup
+	strict = cfg.Strict
+	pointsMaxAge = cfg.PointsMaxAge
+	maxLineBytes = cfg.MaxBodyBytes
+	validator = points.Validator{
+		CheckTotal:     cfg.CheckTotal,
+		TotalTolerance: points.DollarsToMoney(cfg.TotalTolerance),
+		RejectFuture:   cfg.RejectFuture,
+		MaxAgeDays:     cfg.MaxAgeDays,
+		Lenient:        cfg.Lenient,
+		AllowNegative:  cfg.Refunds != refundsReject,
+	}
+	refunds = cfg.Refunds
+	if cfg.IngestWorkers > 0 {
+		ingest = newIngestQueue(cfg.IngestWorkers, cfg.IngestQueue)
+	}
+	jobs = newJobQueue(cfg.AsyncWorkers, cfg.AsyncQueue, cfg.JobTTL)
+	ocr, err = newOCRProvider(cfg.OCR, cfg.OCRCommand, cfg.OCRURL)
+	if err != nil {
+		fatal("setting up OCR", err)
+	}
+	baseCurrency = cfg.BaseCurrency
+	fx, err = newFXProvider(cfg.FX, cfg.BaseCurrency, cfg.FXRates, cfg.FXURL)
+	if err != nil {
+		fatal("setting up FX", err)
+	}
+	receiptIDs, err = newIDGenerator(cfg.IDScheme, cfg.IDSeed)
+	if err != nil {
+		fatal("setting up receipt IDs", err)
+	}
+	if cfg.IDScheme == "sequence" {
+		slog.Warn("receipt IDs are predictable; --id-scheme=sequence is meant for testing")
+	}
+	fraud = newFraudPolicy(cfg.Fraud)
+	velocityLimits = cfg.VelocityLimits
+	pointsExpiry = expiryPolicy{months: cfg.ExpireMonths, soon: cfg.ExpiringSoon}
+	tenancy.header = cfg.TenantHeader
+	if cfg.APIKeysPath != "" {
+		keys, err := loadAPIKeys(cfg.APIKeysPath)
+		if err != nil {
+			fatal("loading API keys", err)
+		}
+		tenancy.apiKeys = keys
+	}
+
+	if cfg.AuditLogPath != "" {
+		if audit, err = openAuditLog(cfg.AuditLogPath); err != nil {
+			fatal("opening audit log", err)
+		}
+	}
+
+	// Checked by loadConfig.
+	trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies)
+	if requestLog, err = openAccessLog(cfg.AccessLog, cfg.AccessLogFormat, int64(cfg.AccessLogMaxMB)<<20, cfg.AccessLogMaxBackups); err != nil {
+		fatal("opening access log", err)
+	}
+
+	if cfg.AliasesPath != "" {
+		if retailerAliases, err = loadRetailerAliases(cfg.AliasesPath); err != nil {
+			fatal("loading retailer aliases", err)
+		}
+	}
+
+	reloader = &configReloader{rulesPath: cfg.RulesPath, campaignsPath: cfg.CampaignsPath}
+	if _, err := reloader.reload(); err != nil {
+		fatal("loading rules and campaigns", err)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("setting up tracing", err)
+	}
+
+	s, err := newStore(cfg.Store)
+	if err != nil {
+		fatal("opening store", err)
+	}
+	store = tenantStore{tracedStore{s}}
+	ledger = tracedLedger{s}
+	sharedStore = cfg.Store.shared()
+	if !sharedStore {
+		if err := leaderboard.load(context.Background(), ListOptions{}); err != nil {
+			fatal("loading leaderboard", err)
+		}
+		if err := stats.load(context.Background()); err != nil {
+			fatal("loading stats", err)
+		}
+	}
+	// Receipts evicted while the store was restored were never counted.
+	if m, ok := s.(interface{ evictWith(func(Record)) }); ok {
+		m.evictWith(forgetReceipt)
+	}
+
+	mux := newProblemMux()
+	mux.Handle("POST /receipts/process", withTenant(processReceiptHandler))
+	mux.Handle("POST /receipts/process/batch", withTenant(processBatchHandler))
+	mux.Handle("POST /receipts/process/stream", withTenant(processStreamHandler))
+	mux.Handle("POST /receipts/score", withTenant(scoreReceiptHandler))
+	mux.Handle("POST /receipts/points/batch", withTenant(batchPointsHandler))
+	mux.Handle("GET /receipts", withTenant(listReceiptsHandler))
+	mux.Handle("POST /receipts/upload", withTenant(uploadReceiptHandler))
+	mux.Handle("POST /receipts/email", withTenant(emailReceiptHandler))
+	mux.Handle("POST /receipts/qr", withTenant(qrReceiptHandler))
+	mux.Handle("GET /receipts/stream", withTenant(streamReceiptsHandler))
+	mux.Handle("GET /receipts/live", withTenant(liveReceiptsHandler))
+	mux.Handle("GET /receipts/{id}", withTenant(getReceiptHandler))
+	mux.Handle("PUT /receipts/{id}", withTenant(updateReceiptHandler))
+	mux.Handle("DELETE /receipts/{id}", withTenant(deleteReceiptHandler))
+	mux.Handle("GET /receipts/{id}/points", withTenant(getPointsHandler))
+	mux.Handle("GET /receipts/{id}/breakdown", withTenant(getBreakdownHandler))
+	mux.Handle("GET /receipts/{id}/history", withTenant(receiptHistoryHandler))
+	mux.Handle("GET /users/{userId}/points", withTenant(userPointsHandler))
+	mux.Handle("GET /users/{userId}/transactions", withTenant(userTransactionsHandler))
+	mux.Handle("POST /users/{userId}/redeem", withTenant(redeemHandler))
+	mux.Handle("GET /leaderboard", withTenant(leaderboardHandler))
+	mux.Handle("GET /stats", withTenant(statsHandler))
+	mux.Handle("GET /reports", withTenant(reportsHandler))
+	mux.Handle("POST /graphql", withTenant(graphQLHandler))
+	mux.Handle("GET /jobs/{id}", withTenant(jobHandler))
+	// The admin routes are only served behind credentials; without any
+	// they are left out, and --admin-addr is refused by loadConfig.
+	adminCreds := adminCredentials{user: cfg.AdminUser, password: cfg.AdminPassword, key: cfg.AdminKey}
+	admin := adminHandler(adminCreds)
+	if cfg.AdminAddr == "" && adminCreds.configured() {
+		mux.Handle("/admin/", admin)
+	}
+	mux.Handle("GET /metrics", metricsHandler())
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.HandleFunc("GET /openapi.json", openAPIHandler)
+	mux.Handle("GET /docs/", docsHandler())
+
+	// Both listeners share the outer layers of the stack; the API adds
+	// CORS, rate limiting and a deadline, and version negotiation for its
+	// routes.
+	base := []middleware{withRequestID, traceHTTP, logRequests, instrument, recoverPanics}
+	if encodings := cfg.compressionEncodings(); len(encodings) > 0 {
+		base = append(base, compressResponses(encodings, cfg.CompressMinBytes))
+	}
+	api := slices.Clone(base)
+	if cfg.CORSOrigins != "" {
+		api = append(api, newCORSPolicy(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSMaxAge).middleware)
+	}
+	if cfg.RateLimit > 0 {
+		api = append(api, newRateLimiter(cfg.RateLimit, cfg.RateBurst).middleware)
+	}
+	if cfg.RequestTimeout > 0 {
+		api = append(api, withDeadline(cfg.RequestTimeout))
+	}
+	api = append(api, limitBody(cfg.MaxBodyBytes), decompressBody(cfg.MaxBodyBytes),
+		apiVersioning{legacy: cfg.LegacyRoutes, sunset: cfg.LegacySunset}.middleware, validateRequests)
+
+	srv := &http.Server{
+		Addr:           cfg.Addr,
+		Handler:        chain(mux, api...),
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	srv.RegisterOnShutdown(live.close)
+
+	var redirectSrv *http.Server
+	if cfg.TLS.enabled() {
+		tlsCfg, redirect, err := newTLS(cfg.TLS, cfg.Addr)
+		if err != nil {
+			fatal("setting up TLS", err)
+		}
+		srv.TLSConfig = tlsCfg
+		if cfg.TLS.RedirectAddr != "" {
+			redirectSrv = &http.Server{
+				Addr:           cfg.TLS.RedirectAddr,
+				Handler:        redirect,
+				ReadTimeout:    cfg.ReadTimeout,
+				WriteTimeout:   cfg.WriteTimeout,
+				IdleTimeout:    cfg.IdleTimeout,
+				MaxHeaderBytes: cfg.MaxHeaderBytes,
+			}
+		}
+	}
+
+	var adminSrv *http.Server
+	if cfg.AdminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/", admin)
+		// Exports and purges can outlast --write-timeout, so the admin
+		// listener has none.
+		adminSrv = &http.Server{
+			Addr:           cfg.AdminAddr,
+			Handler:        chain(adminMux, append(base, limitBody(cfg.MaxBodyBytes), decompressBody(cfg.MaxBodyBytes), validateRequests)...),
+			ReadTimeout:    cfg.ReadTimeout,
+			IdleTimeout:    cfg.IdleTimeout,
+			MaxHeaderBytes: cfg.MaxHeaderBytes,
+		}
+	}
+	if !adminCreds.configured() {
+		slog.Warn("admin routes are disabled; set --admin-user and --admin-password or --admin-key to serve them")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 4)
+	go func() {
+		slog.Info("Starting server", "addr", cfg.Addr, "tls", cfg.TLS.enabled())
+		if cfg.TLS.enabled() {
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+	if redirectSrv != nil {
+		go func() {
+			slog.Info("Starting HTTPS redirect server", "addr", cfg.TLS.RedirectAddr)
+			errc <- redirectSrv.ListenAndServe()
+		}()
+	}
+	if adminSrv != nil {
+		go func() {
+			slog.Info("Starting admin server", "addr", cfg.AdminAddr)
+			errc <- adminSrv.ListenAndServe()
+		}()
+	}
+
+	go reloader.watch(ctx)
+	if pointsExpiry.enabled() {
+		go runExpiry(ctx, cfg.ExpireInterval)
+	}
+	if m, ok := s.(retainingStore); ok && cfg.Store.Retention > 0 {
+		go runRetention(ctx, m, cfg.Store.Retention, cfg.Store.RetentionInterval)
+	}
+	var natsConsumer *natsConsumer
+	if cfg.NATS.URL != "" {
+		natsConsumer, err = startNATSConsumer(ctx, cfg.NATS)
+		if err != nil {
+			fatal("starting NATS consumer", err)
+		}
+	}
+	if cfg.KafkaBrokers != "" {
+		events = newOutbox(strings.Split(cfg.KafkaBrokers, ","), cfg.KafkaTopic, cfg.KafkaOutboxSize)
+		go events.run(ctx)
+	}
+
+	var grpcSrv *grpc.Server
+	if cfg.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			fatal("listening for gRPC", err)
+		}
+		grpcSrv = newGRPCServer(cfg.RequestTimeout, srv.TLSConfig)
+		go func() {
+			slog.Info("Starting gRPC server", "addr", cfg.GRPCAddr)
+			errc <- grpcSrv.Serve(lis)
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		fatal("server stopped", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "drain_timeout", cfg.DrainTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("draining requests", "error", err)
+	}
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(shutdownCtx)
+	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("draining admin requests", "error", err)
+		}
+	}
+	if grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcSrv.Stop()
+		}
+	}
+	if natsConsumer != nil {
+		if err := natsConsumer.close(); err != nil {
+			slog.Error("closing NATS consumer", "error", err)
+		}
+	}
+	if events != nil {
+		if err := events.close(shutdownCtx); err != nil {
+			slog.Error("closing Kafka writer", "error", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("closing store", "error", err)
+	}
+	if err := audit.close(); err != nil {
+		slog.Error("closing audit log", "error", err)
+	}
+	if err := requestLog.close(); err != nil {
+		slog.Error("closing access log", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("flushing traces", "error", err)
+	}
+}
+
+func processReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var sub submission
+	if err := decodeJSON(r.Body, &sub, strict); err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeDecodeError(w, r, err, "")
+			return
+		}
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+	withBreakdown := false
+	for _, include := range strings.Split(r.URL.Query().Get("include"), ",") {
+		switch strings.TrimSpace(include) {
+		case "":
+		case "breakdown":
+			withBreakdown = true
+		default:
+			writeProblem(w, r, http.StatusBadRequest, "include must be breakdown.")
+			return
+		}
+	}
+	if async, err := queryBool(r, "async"); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "async must be true or false.")
+		return
+	} else if async && withBreakdown {
+		writeProblem(w, r, http.StatusBadRequest, "include=breakdown cannot be combined with async.")
+		return
+	} else if async {
+		submitJob(w, r, []submission{sub})
+		return
+	}
+
+	var (
+		rec       Record
+		duplicate bool
+		err       error
+	)
+	if qerr := ingest.do(r.Context(), func(ctx context.Context) {
+		rec, duplicate, err = processReceipt(ctx, sub.Receipt, sub.UserID)
+	}); qerr != nil {
+		writeIngestError(w, r, qerr)
+		return
+	}
+	if errors.Is(err, points.ErrInvalidReceipt) {
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+	if errors.Is(err, errReceiptRejected) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, rejectedMessage(err))
+		return
+	}
+	if errors.Is(err, errVelocityLimit) {
+		writeVelocityError(w, r, err)
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to store receipt.")
+		return
+	}
+
+	setReceiptID(r.Context(), rec.ID)
+	resp := processResponse{ID: rec.ID}
+	if withBreakdown {
+		resp.Points, resp.RuleVersion = &rec.Points, rec.RuleVersion
+		// The receipt is stored by now, so a breakdown that cannot be
+		// worked out is left out rather than failing the request.
+		if resp.Breakdown, err = evaluateRecord(rec); err != nil {
+			slog.WarnContext(r.Context(), "breakdown of processed receipt failed", "error", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if dedup && !duplicate {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// processResponse is the body of a processed receipt's response. The points
+// and breakdown are only sent with ?include=breakdown.
+type processResponse struct {
+	ID          string          `json:"id"`
+	Points      *int            `json:"points,omitempty"`
+	RuleVersion string          `json:"ruleVersion,omitempty"`
+	Breakdown   []points.Result `json:"breakdown,omitempty"`
+}
+
+// limitBody caps request bodies at limit bytes, except on routes that read
+// their bodies a line at a time; see unlimitedBody.
+func limitBody(limit int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !unlimitedBody(r) {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var errTrailingData = errors.New("unexpected data after the JSON document")
+
+// decodeJSON decodes a single JSON document from r into v. In strict mode
+// unknown fields are reported as a *points.ValidationError and anything but
+// whitespace after the document is rejected.
+func decodeJSON(r io.Reader, v any, strict bool) error {
+	dec := json.NewDecoder(r)
+	if !strict {
+		return dec.Decode(v)
+	}
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if field, uerr := strconv.Unquote(name); uerr == nil {
+				return &points.ValidationError{Fields: []points.FieldError{{Field: field, Message: "is not a known field"}}}
+			}
+		}
+		return err
+	}
+	_, err := dec.Token()
+	switch {
+	case err == io.EOF:
+		return nil
+	case errors.As(err, new(*http.MaxBytesError)):
+		return err
+	}
+	return errTrailingData
+}
+
+// submission is a receipt as posted, optionally naming the user to credit
+// with its points.
+type submission struct {
+	points.Receipt
+	UserID string `json:"userId,omitempty"`
+}
+
+// processReceipt validates, scores, and stores a receipt, crediting its
+// points to userID unless that is empty. In dedup mode a receipt that was
+// already submitted is not stored or credited again; the existing record is
+// returned with duplicate set. A receipt the fraud checks find suspicious is
+// flagged for review, or refused with a *fraudError under --fraud-action=reject.
+// A receipt over one of the --velocity-limits is refused with a *velocityError.
+func processReceipt(ctx context.Context, receipt points.Receipt, userID string) (rec Record, duplicate bool, err error) {
+	if ctx.Err() != nil {
+		return Record{}, false, context.Cause(ctx)
+	}
+	start := time.Now()
+	receipt, err = validateSubmission(receipt, userID)
+	if err != nil {
+		return Record{}, false, err
+	}
+
+	tenant, _ := tenantFrom(ctx)
+	rec = Record{Receipt: receipt, Tenant: tenant, UserID: userID, StoredAt: start.UTC(), Metadata: submissionMetadata(ctx, start)}
+	if at, err := receipt.PurchasedAt(); err == nil {
+		rec.PurchasedAt = at.UTC()
+	}
+	if dedup {
+		rec.Hash = receiptHash(tenant, receipt)
+		mu := &hashLocks[shardOf(rec.Hash)]
+		mu.Lock()
+		defer mu.Unlock()
+		id, err := store.FindByHash(ctx, rec.Hash)
+		if errors.Is(err, errNotFound) {
+			id, err = store.FindByHash(ctx, legacyReceiptHash(tenant, receipt))
+		}
+		if err == nil {
+			// A receipt corrected since it was stored may have left its
+			// old hash behind, which no longer finds it.
+			existing, err := store.Get(ctx, id)
+			if err == nil && (existing.Hash == rec.Hash || existing.Hash == legacyReceiptHash(tenant, receipt)) {
+				return existing, true, nil
+			}
+			if err != nil && !errors.Is(err, errNotFound) {
+				return Record{}, false, err
+			}
+		} else if !errors.Is(err, errNotFound) {
+			return Record{}, false, err
+		}
+	}
+
+	rec.ID = receiptIDs.NewID(rec)
+	if existing, duplicate, err := claimID(ctx, &rec); duplicate || err != nil {
+		return existing, duplicate, err
+	}
+	if receipt.IsRefund() {
+		err = scoreRefund(ctx, &rec)
+	} else {
+		err = scoreRecord(&rec)
+	}
+	if err != nil {
+		if errors.Is(err, points.ErrInvalidReceipt) {
+			validationFailures.Inc()
+		}
+		return Record{}, false, err
+	}
+	// Nothing has been written yet, so a request that was abandoned while
+	// it was scored can stop here.
+	if ctx.Err() != nil {
+		return Record{}, false, context.Cause(ctx)
+	}
+	reasons := fraud.inspect(ctx, rec)
+	if len(reasons) > 0 && fraud.action == fraudReject {
+		audit.record(ctx, auditEntry{Action: auditReceiptRejected, Tenant: rec.Tenant, Details: map[string]any{"reasons": reasons}})
+		return Record{}, false, &fraudError{reasons}
+	}
+	if err := checkVelocity(rec); err != nil {
+		return Record{}, false, err
+	}
+	rec.Metadata.ProcessingMs = float64(time.Since(start).Microseconds()) / 1000
+	ctx, cancel := commitContext(ctx)
+	defer cancel()
+	if err := store.Save(ctx, rec); err != nil {
+		return Record{}, false, err
+	}
+	kind := txCredit
+	if receipt.IsRefund() {
+		kind = txRefund
+	}
+	if err := recordTransaction(ctx, rec, kind, rec.Points); err != nil {
+		return Record{}, false, err
+	}
+	leaderboard.record(rec, rec.Points)
+	stats.add(rec)
+	audit.record(ctx, auditEntry{Action: auditReceiptSubmitted, Tenant: rec.Tenant, Target: rec.ID,
+		Details: map[string]any{"points": rec.Points, "ruleVersion": rec.RuleVersion}})
+	if len(reasons) > 0 {
+		flagged.add(rec, reasons)
+		audit.record(ctx, auditEntry{Action: auditReceiptFlagged, Tenant: rec.Tenant, Target: rec.ID, Details: map[string]any{"reasons": reasons}})
+	}
+	publishProcessed(rec)
+	pointsAwarded.Observe(float64(rec.Points))
+	return rec, false, nil
+}
+
+// validateSubmission normalizes and validates a submitted receipt and the
+// user it names, if any, and returns the normalized receipt.
+func validateSubmission(receipt points.Receipt, userID string) (points.Receipt, error) {
+	receipt = validator.Normalize(receipt)
+	err := validator.Validate(receipt)
+	if userID != "" && !userIDPattern.MatchString(userID) {
+		userErr := points.FieldError{Field: "userId", Message: "must match " + userIDPattern.String()}
+		var v *points.ValidationError
+		if !errors.As(err, &v) {
+			v = &points.ValidationError{}
+		}
+		v.Fields = append(v.Fields, userErr)
+		err = v
+	}
+	if err != nil {
+		validationFailures.Inc()
+		return points.Receipt{}, err
+	}
+	return receipt, nil
+}
+
+// scoreReceipt scores a receipt with the rule set in effect on its purchase
+// date, followed by any matching campaigns.
+func scoreReceipt(receipt points.Receipt) (string, []points.Result, error) {
+	return scoreWith(ruleSets.get(), receipt)
+}
+
+// scoreRecord scores rec's receipt as scoreReceipt does, setting its points
+// and rule version and keeping the campaign results for its breakdown.
+func scoreRecord(rec *Record) error {
+	version, results, err := ruleSets.get().Score(rec.Receipt)
+	if err != nil {
+		return err
+	}
+	rec.RuleVersion = version
+	rec.Campaigns = campaigns.apply(rec.Receipt, results)
+	rec.Points = points.Total(results) + points.Total(rec.Campaigns)
+	return nil
+}
+
+// scoreWith scores a receipt as scoreReceipt does, with the rule sets in reg
+// in place of the configured ones.
+func scoreWith(reg points.Registry, receipt points.Receipt) (string, []points.Result, error) {
+	version, results, err := reg.Score(receipt)
+	if err != nil {
+		return "", nil, err
+	}
+	return version, append(results, campaigns.apply(receipt, results)...), nil
+}
+
+type receiptSummary struct {
+	ID           string           `json:"id"`
+	Retailer     string           `json:"retailer"`
+	PurchaseDate string           `json:"purchaseDate"`
+	Points       int              `json:"points"`
+	Metadata     *ReceiptMetadata `json:"metadata,omitempty"`
+}
+
+func listReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	asCSV, ok := wantsCSV(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, formatProblem)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	switch {
+	case asCSV:
+		// A CSV download has every matching receipt unless limit says
+		// otherwise.
+		if limit, err = queryInt(r, "limit", 0); err != nil || limit < 0 {
+			writeProblem(w, r, http.StatusBadRequest, "limit must be a non-negative integer.")
+			return
+		}
+	case err != nil || limit < 1 || limit > maxPageSize:
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", maxPageSize))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "offset must be a non-negative integer.")
+		return
+	}
+
+	withMetadata, ok := includeMetadata(r)
+	switch {
+	case !ok:
+		writeProblem(w, r, http.StatusBadRequest, "include must be metadata.")
+		return
+	case withMetadata && asCSV:
+		writeProblem(w, r, http.StatusBadRequest, "include=metadata cannot be combined with CSV.")
+		return
+	}
+
+	opts := ListOptions{Limit: limit, Offset: offset}
+	if msg := parseListFilter(r, &opts); msg != "" {
+		writeProblem(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	if asCSV {
+		writeReceiptsCSV(w, r, opts)
+		return
+	}
+
+	recs, total, err := store.List(r.Context(), opts)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list receipts.")
+		return
+	}
+
+	summaries := make([]receiptSummary, len(recs))
+	for i, rec := range recs {
+		summaries[i] = receiptSummary{ID: rec.ID, Retailer: rec.Receipt.Retailer, PurchaseDate: rec.Receipt.PurchaseDate, Points: rec.Points}
+		if withMetadata {
+			m := rec.metadata()
+			summaries[i].Metadata = &m
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Receipts []receiptSummary `json:"receipts"`
+		Total    int              `json:"total"`
+		Limit    int              `json:"limit"`
+		Offset   int              `json:"offset"`
+	}{summaries, total, limit, offset})
+}
+
+// parseListFilter reads the list endpoint's filter and sort parameters into
+// opts. It returns a message for the client if one is invalid.
+func parseListFilter(r *http.Request, opts *ListOptions) string {
+	q := r.URL.Query()
+	opts.Retailer = q.Get("retailer")
+	opts.From, opts.To = q.Get("from"), q.Get("to")
+	if !validDate(opts.From) || !validDate(opts.To) {
+		return "from and to must be dates in YYYY-MM-DD format."
+	}
+	for _, f := range []struct {
+		key string
+		p   **int
+	}{{"minPoints", &opts.MinPoints}, {"maxPoints", &opts.MaxPoints}} {
+		if v := q.Get(f.key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return f.key + " must be an integer."
+			}
+			*f.p = &n
+		}
+	}
+	var ok bool
+	if opts.Sort, opts.Desc, ok = parseSort(q.Get("sort")); !ok {
+		return "sort must be id, points, purchaseDate or retailer, optionally prefixed with - for descending order."
+	}
+	return ""
+}
+
+// parseSort reads a sort order such as "points" or "-purchaseDate".
+func parseSort(v string) (field string, desc bool, ok bool) {
+	field, desc = strings.CutPrefix(v, "-")
+	switch field {
+	case "":
+		return sortID, desc, true
+	case sortID, sortPoints, sortPurchaseDate, sortRetailer:
+		return field, desc, true
+	}
+	return "", false, false
+}
+
+// validDate reports whether v is empty or a YYYY-MM-DD date.
+func validDate(v string) bool {
+	if v == "" {
+		return true
+	}
+	_, err := time.Parse(points.DateLayout, v)
+	return err == nil
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func queryBool(r *http.Request, key string) (bool, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// receiptID returns the {id} path value of a receipt route, noting it for
+// the access log.
+func receiptID(r *http.Request) string {
+	id := r.PathValue("id")
+	setReceiptID(r.Context(), id)
+	return id
+}
+
+// getReceiptHandler serves GET /receipts/{id}, the receipt as submitted,
+// with ?include=metadata also how it was submitted.
+func getReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	withMetadata, ok := includeMetadata(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "include must be metadata.")
+		return
+	}
+	var (
+		resp any
+		err  error
+	)
+	if withMetadata {
+		var rec Record
+		rec, err = store.Get(r.Context(), receiptID(r))
+		resp = struct {
+			points.Receipt
+			Metadata ReceiptMetadata `json:"metadata"`
+		}{rec.Receipt, rec.metadata()}
+	} else {
+		resp, err = store.GetReceipt(r.Context(), receiptID(r))
+	}
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func deleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := store.Get(r.Context(), receiptID(r))
+	if err == nil {
+		err = deleteRecord(r.Context(), rec)
+	}
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to delete receipt.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteRecord deletes a stored receipt and takes its points back out of
+// the leaderboard, the stats and its user's balance.
+func deleteRecord(ctx context.Context, rec Record) error {
+	ctx, cancel := commitContext(ctx)
+	defer cancel()
+	if err := store.Delete(ctx, rec.ID); err != nil {
+		return err
+	}
+	audit.record(ctx, auditEntry{Action: auditReceiptDeleted, Tenant: rec.Tenant, Target: rec.ID,
+		Details: map[string]any{"points": rec.Points}})
+	flagged.remove(rec.ID)
+	leaderboard.record(rec, -rec.Points)
+	stats.remove(rec)
+	return recordTransaction(ctx, rec, txAdjustment, -rec.Points)
+}
+
+func getPointsHandler(w http.ResponseWriter, r *http.Request) {
+	id := receiptID(r)
+	version, err := queryInt(r, "version", 0)
+	if err != nil || (r.URL.Query().Has("version") && version < 1) {
+		writeProblem(w, r, http.StatusBadRequest, "version must be a positive integer.")
+		return
+	}
+	var points int
+	if version == 0 {
+		points, err = store.GetPoints(r.Context(), id)
+	} else {
+		points, err = versionPoints(r.Context(), id, version)
+	}
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+		return
+	}
+	if errors.Is(err, errVersionNotFound) {
+		writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("The receipt has no version %d.", version))
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt.")
+		return
+	}
+
+	// The points only change if the receipt is recalculated, corrected or
+	// deleted, so caches may keep them for --points-max-age and then
+	// revalidate.
+	etag := fmt.Sprintf(`W/"%d"`, points)
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(pointsMaxAge.Seconds())))
+	h.Add("Vary", "X-API-Key, "+tenancy.header)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"points": points})
+}
+
+// etagMatches reports whether an If-None-Match header lists etag or is "*".
+// Tags are compared weakly, ignoring any W/ prefix, as GET requests allow.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func getBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	rec, results, err := receiptBreakdown(r.Context(), receiptID(r))
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+		return
+	}
+	if errors.Is(err, errRuleSetMissing) {
+		writeProblem(w, r, http.StatusInternalServerError, fmt.Sprintf("Rule set %q is no longer configured.", rec.RuleVersion))
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakdownResponse{rec.Points, rec.RuleVersion, results})
+}
+
+// breakdownResponse explains a receipt's points rule by rule.
+type breakdownResponse struct {
+	Points      int             `json:"points"`
+	RuleVersion string          `json:"ruleVersion"`
+	Breakdown   []points.Result `json:"breakdown"`
+}
+
+// receiptBreakdown re-evaluates a stored receipt with the rule set it was
+// scored by, and adds the campaign results stored with it.
+func receiptBreakdown(ctx context.Context, id string) (Record, []points.Result, error) {
+	rec, err := store.Get(ctx, id)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	results, err := evaluateRecord(rec)
+	return rec, results, err
+}
+
+// evaluateRecord scores rec again as receiptBreakdown does.
+func evaluateRecord(rec Record) ([]points.Result, error) {
+	if rec.RuleVersion == refundRuleVersion {
+		return refundBreakdown(rec), nil
+	}
+	rs, ok := ruleSets.get().Version(rec.RuleVersion)
+	if !ok {
+		return nil, errRuleSetMissing
+	}
+	results := append(rs.Evaluate(rec.Receipt), rec.Campaigns...)
+	if drift := rec.Points - points.Total(results); drift != 0 {
+		// Receipts stored before campaign results were kept, or imported
+		// without them, may have points the breakdown cannot explain.
+		results = append(results, points.Result{
+			Rule:        unaccountedRule,
+			Description: "Points awarded that the rules and stored campaign results do not account for",
+			Points:      drift,
+		})
+	}
+	return results, nil
+}
+
+// unaccountedRule names the breakdown entry that makes up the difference
+// between a receipt's points and what its breakdown adds up to.
+const unaccountedRule = "unaccounted"
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// ReceiptMetadata is what the server recorded of a receipt's submission,
+// for tracing where a receipt came from and how it was handled. Receipts
+// stored before it was kept have none.
+type ReceiptMetadata struct {
+	// ReceivedAt is when the request submitting the receipt arrived, which
+	// for an async job is before it was processed.
+	ReceivedAt time.Time `json:"receivedAt,omitzero"`
+	// SourceIP is the address of the client that submitted it; see
+	// clientIP.
+	SourceIP string `json:"sourceIp,omitempty"`
+	// APIKey is a fingerprint of the API key it was submitted with.
+	APIKey string `json:"apiKey,omitempty"`
+	// ProcessingMs is how long the receipt took to validate, check and
+	// score, up to being stored.
+	ProcessingMs float64 `json:"processingMs,omitempty"`
+	// RuleVersion is the version of the rules the receipt is scored with.
+	// It is not stored, but filled in from the record when shown.
+	RuleVersion string `json:"ruleVersion,omitempty"`
+}
+
+// submissionMetadata starts the metadata of a receipt whose processing
+// began at start, from the request in ctx.
+func submissionMetadata(ctx context.Context, start time.Time) *ReceiptMetadata {
+	m := &ReceiptMetadata{ReceivedAt: start.UTC()}
+	if info := requestInfoFrom(ctx); info != nil {
+		if !info.Received.IsZero() {
+			m.ReceivedAt = info.Received.UTC()
+		}
+		m.SourceIP = info.RemoteAddr
+	} else if p, ok := peer.FromContext(ctx); ok {
+		m.SourceIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(m.SourceIP); err == nil {
+			m.SourceIP = host
+		}
+	}
+	if actor := actorFrom(ctx); strings.HasPrefix(actor, "api-key:") {
+		m.APIKey = actor
+	}
+	return m
+}
+
+// metadata returns rec's metadata as shown to clients.
+func (rec Record) metadata() ReceiptMetadata {
+	var m ReceiptMetadata
+	if rec.Metadata != nil {
+		m = *rec.Metadata
+	}
+	m.RuleVersion = rec.RuleVersion
+	return m
+}
+
+// includeMetadata reports whether ?include=metadata asks for receipts'
+// metadata. ok is false if include names anything else.
+func includeMetadata(r *http.Request) (include, ok bool) {
+	for _, v := range strings.Split(r.URL.Query().Get("include"), ",") {
+		switch strings.TrimSpace(v) {
+		case "":
+		case "metadata":
+			include = true
+		default:
+			return false, false
+		}
+	}
+	return include, true
+}
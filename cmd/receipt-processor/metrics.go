@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_http_requests_total",
+		Help: "HTTP requests by route, method, and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "receipt_processor_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	handlerPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_handler_panics_total",
+		Help: "Handlers that panicked and were answered with an internal error, by server (http or grpc).",
+	}, []string{"server"})
+
+	validationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipt_processor_validation_failures_total",
+		Help: "Receipts rejected by validation.",
+	})
+
+	pointsAwarded = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "receipt_processor_points_awarded",
+		Help:    "Points awarded per processed receipt.",
+		Buckets: []float64{10, 25, 50, 75, 100, 150, 200, 300, 500},
+	})
+
+	ingestRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipt_processor_ingest_rejected_total",
+		Help: "Submissions turned away because the ingestion queue was full.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipt_processor_ingest_queue_depth",
+		Help: "Submissions waiting for an ingest worker.",
+	}, func() float64 {
+		return float64(ingest.depth())
+	})
+
+	eventsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipt_processor_events_published_total",
+		Help: "Receipt events acknowledged by Kafka.",
+	})
+
+	eventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipt_processor_events_dropped_total",
+		Help: "Receipt events dropped because the outbox was full.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipt_processor_events_pending",
+		Help: "Receipt events waiting in the outbox for Kafka.",
+	}, func() float64 {
+		return float64(events.depth())
+	})
+
+	clientRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_client_requests_total",
+		Help: "HTTP requests and gRPC calls by the common name of their client certificate, under --tls-client-ca. gRPC calls are labeled with their status code name.",
+	}, []string{"client", "status"})
+
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_config_reloads_total",
+		Help: "Reloads of the rules and campaigns files, by result.",
+	}, []string{"result"})
+
+	pointsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "receipt_processor_points_expired_total",
+		Help: "Ledger points removed by the expiration job.",
+	})
+
+	fraudDetections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_fraud_detections_total",
+		Help: "Receipts a fraud check found suspicious, by check and by the action taken: flag or reject.",
+	}, []string{"check", "action"})
+
+	velocityLimitHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_velocity_limit_hits_total",
+		Help: "Receipts refused for exceeding a velocity limit, by limit as configured.",
+	}, []string{"limit"})
+
+	receiptsEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_processor_receipts_evicted_total",
+		Help: "Receipts evicted from the memory store, by reason: retention, or capacity once --max-receipts is reached.",
+	}, []string{"reason"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipt_processor_stored_receipts",
+		Help: "Receipts currently held by the store.",
+	}, func() float64 {
+		_, total, err := store.List(context.Background(), ListOptions{Limit: 1})
+		if err != nil {
+			return -1
+		}
+		return float64(total)
+	})
+)
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// routeLabel collapses receipt IDs and the API version out of the path so
+// each endpoint is a single series.
+func routeLabel(path string) string {
+	if _, rest, ok := splitVersion(path); ok {
+		path = rest
+	}
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "/receipts" || path == "/receipts/stream" || path == "/receipts/upload" || path == "/receipts/email" || path == "/receipts/qr" || path == "/receipts/score" || path == "/receipts/live" || path == "/metrics" || path == "/healthz" || path == "/readyz" || path == "/openapi.json" || strings.HasPrefix(path, "/receipts/process") || path == "/admin/recalculate" || path == "/admin/export" || path == "/admin/import" || path == "/admin/purge" || path == "/admin/reload" || path == "/admin/campaigns" || path == "/admin/simulate" || path == "/admin/audit" || path == "/leaderboard" || path == "/stats" || path == "/reports" || path == "/graphql":
+		return path
+	case strings.HasPrefix(path, "/docs"):
+		return "/docs"
+	case strings.HasPrefix(path, "/admin/debug/"):
+		return "/admin/debug"
+	case path == "/admin/flagged" || path == "/admin/retailer-aliases":
+		return path
+	case len(parts) == 5 && parts[1] == "admin" && parts[2] == "flagged":
+		return "/admin/flagged/{id}/" + parts[4]
+	case len(parts) == 4 && parts[1] == "admin" && parts[2] == "campaigns":
+		return "/admin/campaigns/{id}"
+	case len(parts) == 4 && parts[1] == "admin" && parts[2] == "retailer-aliases":
+		return "/admin/retailer-aliases/{alias}"
+	case len(parts) == 5 && parts[1] == "admin" && parts[2] == "users" && parts[4] == "data":
+		return "/admin/users/{id}/data"
+	case len(parts) == 4 && parts[1] == "users":
+		return "/users/{id}/" + parts[3]
+	case len(parts) == 3 && parts[1] == "jobs":
+		return "/jobs/{id}"
+	case len(parts) == 3 && parts[1] == "receipts":
+		return "/receipts/{id}"
+	case len(parts) == 4 && parts[1] == "receipts":
+		return "/receipts/{id}/" + parts[3]
+	default:
+		return "other"
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush a streamed response.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets a WebSocket upgrade take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeLabel(r.URL.Path)
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		if cn := clientCN(r); cn != "" {
+			clientRequests.WithLabelValues(cn, strconv.Itoa(rec.status)).Inc()
+		}
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
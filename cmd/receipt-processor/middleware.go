@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// errRequestTimeout is the cause of a request context cancelled by
+// withDeadline.
+var errRequestTimeout = errors.New("request timed out")
+
+// middleware wraps a handler in behavior shared by many routes, such as
+// logging, authentication or rate limiting.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws, the first outermost, so that requests pass through
+// them in the order listed.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// recoverPanics answers a request whose handler panics with a 500 problem,
+// logging the panic and its stack, where net/http would drop the connection.
+// http.ErrAbortHandler is passed on, since handlers panic with it on purpose.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			logPanic(r.Context(), "http", v, "method", r.Method, "path", r.URL.Path)
+			writeProblem(w, r, http.StatusInternalServerError, "The server failed to handle the request.")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+type deadlineKey struct{}
+
+// withDeadline cancels a request's context, with errRequestTimeout as the
+// cause, once it has run for timeout, so that the store calls and other work
+// of a request the client has given up on are abandoned. Handlers that
+// stream for as long as the client listens call liftDeadline.
+func withDeadline(timeout time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+			timer := time.AfterFunc(timeout, func() { cancel(errRequestTimeout) })
+			defer timer.Stop()
+			ctx = context.WithValue(ctx, deadlineKey{}, timer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// liftDeadline stops withDeadline from cancelling the request ctx belongs to.
+func liftDeadline(ctx context.Context) {
+	if timer, ok := ctx.Value(deadlineKey{}).(*time.Timer); ok {
+		timer.Stop()
+	}
+}
+
+// timedOut reports whether ctx was cancelled by withDeadline.
+func timedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRequestTimeout)
+}
+
+// workerPanic carries a panic from an ingest worker to the goroutine waiting
+// on it, along with the stack where it happened.
+type workerPanic struct {
+	value any
+	stack []byte
+}
+
+// logPanic logs a recovered panic with its stack and counts it against
+// server, with args added to the log entry. It must be called from the
+// deferred function that recovered v.
+func logPanic(ctx context.Context, server string, v any, args ...any) {
+	stack := debug.Stack()
+	if p, ok := v.(workerPanic); ok {
+		v, stack = p.value, p.stack
+	}
+	handlerPanics.WithLabelValues(server).Inc()
+	args = append(args, "server", server, "panic", v, "stack", string(stack))
+	slog.ErrorContext(ctx, "handler panicked", args...)
+}
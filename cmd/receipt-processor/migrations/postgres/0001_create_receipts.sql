@@ -0,0 +1,5 @@
+CREATE TABLE receipts (
+    id      TEXT PRIMARY KEY,
+    receipt JSONB NOT NULL,
+    points  INTEGER NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE receipts ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX receipts_tenant_idx ON receipts (tenant, id);
@@ -0,0 +1,11 @@
+ALTER TABLE receipts ADD COLUMN user_id TEXT NOT NULL DEFAULT '';
+CREATE TABLE ledger (
+    id         TEXT PRIMARY KEY,
+    tenant     TEXT NOT NULL,
+    user_id    TEXT NOT NULL,
+    kind       TEXT NOT NULL,
+    points     INTEGER NOT NULL,
+    receipt_id TEXT,
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX ledger_user_idx ON ledger (tenant, user_id, created_at);
@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN purchased_at TIMESTAMPTZ;
@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN campaigns JSONB;
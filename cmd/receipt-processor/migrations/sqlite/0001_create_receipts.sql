@@ -0,0 +1,5 @@
+CREATE TABLE receipts (
+    id      TEXT PRIMARY KEY,
+    receipt TEXT NOT NULL,
+    points  INTEGER NOT NULL
+);
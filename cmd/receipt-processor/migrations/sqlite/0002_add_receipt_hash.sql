@@ -0,0 +1,2 @@
+ALTER TABLE receipts ADD COLUMN hash TEXT;
+CREATE INDEX receipts_hash_idx ON receipts (hash);
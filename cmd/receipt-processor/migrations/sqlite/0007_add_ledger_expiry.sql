@@ -0,0 +1 @@
+ALTER TABLE ledger ADD COLUMN expires_at TIMESTAMP;
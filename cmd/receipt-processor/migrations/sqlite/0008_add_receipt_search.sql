@@ -0,0 +1,6 @@
+ALTER TABLE receipts ADD COLUMN retailer TEXT NOT NULL DEFAULT '';
+ALTER TABLE receipts ADD COLUMN purchase_date TEXT NOT NULL DEFAULT '';
+UPDATE receipts SET retailer = json_extract(receipt, '$.retailer'), purchase_date = json_extract(receipt, '$.purchaseDate');
+CREATE INDEX receipts_purchase_date_idx ON receipts (tenant, purchase_date);
+CREATE INDEX receipts_points_idx ON receipts (tenant, points);
+CREATE INDEX receipts_retailer_idx ON receipts (tenant, retailer);
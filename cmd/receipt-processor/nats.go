@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"receipt-processor/points"
+)
+
+const natsRetryDelay = 5 * time.Second
+
+type natsConfig struct {
+	URL        string
+	Stream     string
+	Subject    string
+	Consumer   string
+	DeadLetter string
+}
+
+// natsConsumer processes receipts published to a JetStream subject, in the
+// same JSON as POST /receipts/process. The tenant comes from X-API-Key and
+// tenant headers, as for HTTP. A message is acknowledged only once its
+// receipt is stored; one that can never be stored is republished to the
+// dead-letter subject with a Receipt-Error header saying why.
+type natsConsumer struct {
+	nc         *nats.Conn
+	consume    jetstream.ConsumeContext
+	deadLetter string
+}
+
+// startNATSConsumer attaches a durable consumer to the stream, creating the
+// stream for the subject if it does not exist.
+func startNATSConsumer(ctx context.Context, cfg natsConfig) (*natsConsumer, error) {
+	nc, err := nats.Connect(cfg.URL, nats.Name("receipt-processor"))
+	if err != nil {
+		return nil, err
+	}
+	c, err := func() (*natsConsumer, error) {
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := js.Stream(ctx, cfg.Stream)
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			stream, err = js.CreateStream(ctx, jetstream.StreamConfig{Name: cfg.Stream, Subjects: []string{cfg.Subject}})
+		}
+		if err != nil {
+			return nil, err
+		}
+		cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       cfg.Consumer,
+			FilterSubject: cfg.Subject,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c := &natsConsumer{nc: nc, deadLetter: cfg.DeadLetter}
+		c.consume, err = cons.Consume(c.handle)
+		return c, err
+	}()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	slog.Info("Consuming receipts from NATS", "stream", cfg.Stream, "subject", cfg.Subject)
+	return c, nil
+}
+
+func (c *natsConsumer) handle(msg jetstream.Msg) {
+	hdr := msg.Headers()
+	tenant, err := tenancy.resolve(hdr.Get("X-API-Key"), hdr.Get(tenancy.header))
+	if err != nil {
+		c.reject(msg, "a valid API key or tenant ID is required")
+		return
+	}
+	ctx := withActor(withTenantContext(context.Background(), tenant), keyActor(hdr.Get("X-API-Key")))
+
+	var sub submission
+	if err := decodeJSON(bytes.NewReader(msg.Data()), &sub, strict); err != nil {
+		c.reject(msg, err.Error())
+		return
+	}
+	if qerr := ingest.do(ctx, func(ctx context.Context) {
+		_, _, err = processReceipt(ctx, sub.Receipt, sub.UserID)
+	}); qerr != nil {
+		msg.NakWithDelay(natsRetryDelay)
+		return
+	}
+	switch {
+	case errors.Is(err, points.ErrInvalidReceipt), errors.Is(err, errReceiptRejected), errors.Is(err, errVelocityLimit):
+		c.reject(msg, err.Error())
+	case err != nil:
+		slog.Error("processing NATS message", "error", err)
+		msg.NakWithDelay(natsRetryDelay)
+	default:
+		msg.Ack()
+	}
+}
+
+// reject moves msg to the dead-letter subject. If that fails, msg is left
+// to be redelivered.
+func (c *natsConsumer) reject(msg jetstream.Msg, reason string) {
+	dl := nats.NewMsg(c.deadLetter)
+	dl.Data = msg.Data()
+	for k, v := range msg.Headers() {
+		dl.Header[k] = v
+	}
+	dl.Header.Set("Receipt-Error", reason)
+	dl.Header.Set("Original-Subject", msg.Subject())
+	if err := c.nc.PublishMsg(dl); err != nil {
+		slog.Error("publishing to dead-letter subject", "error", err)
+		msg.NakWithDelay(natsRetryDelay)
+		return
+	}
+	msg.Ack()
+}
+
+// close stops fetching messages and waits for those in hand to finish.
+func (c *natsConsumer) close() error {
+	c.consume.Stop()
+	return c.nc.Drain()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ocrProvider turns an image of a receipt into its text. contentType is
+// image/jpeg, image/png or application/pdf.
+type ocrProvider interface {
+	Recognize(ctx context.Context, image []byte, contentType string) (string, error)
+}
+
+// ocr is nil, and uploads are refused, unless --ocr is set.
+var ocr ocrProvider
+
+var errUnsupportedImage = errors.New("unsupported image type")
+
+func newOCRProvider(kind, command, url string) (ocrProvider, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "tesseract":
+		if _, err := exec.LookPath(command); err != nil {
+			return nil, err
+		}
+		return tesseractOCR{command: command}, nil
+	case "http":
+		if url == "" {
+			return nil, errors.New("--ocr=http needs --ocr-url")
+		}
+		return httpOCR{url: url, client: &http.Client{Timeout: time.Minute}}, nil
+	}
+	return nil, fmt.Errorf("unknown OCR provider %q", kind)
+}
+
+// tesseractOCR runs the Tesseract command line tool. PDF pages are first
+// rendered to images with pdftoppm, from poppler-utils.
+type tesseractOCR struct {
+	command string
+}
+
+func (t tesseractOCR) Recognize(ctx context.Context, image []byte, contentType string) (string, error) {
+	switch contentType {
+	case "image/jpeg", "image/png":
+		return t.run(ctx, bytes.NewReader(image), "stdin")
+	case "application/pdf":
+	default:
+		return "", errUnsupportedImage
+	}
+
+	dir, err := os.MkdirTemp("", "receipt-ocr")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-r", "300", "-png", "-", filepath.Join(dir, "page"))
+	cmd.Stdin = bytes.NewReader(image)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("pdftoppm: %w: %s", err, bytes.TrimSpace(out))
+	}
+	pages, err := filepath.Glob(filepath.Join(dir, "page*.png"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(pages)
+	var text strings.Builder
+	for _, page := range pages {
+		s, err := t.run(ctx, nil, page)
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(s)
+		text.WriteString("\n")
+	}
+	return text.String(), nil
+}
+
+// run recognizes the image at path, or stdin if path is "stdin". Page
+// segmentation mode 4 reads the text as a single column of lines, which
+// keeps each item on one line with its price.
+func (t tesseractOCR) run(ctx context.Context, stdin io.Reader, path string) (string, error) {
+	cmd := exec.CommandContext(ctx, t.command, path, "stdout", "--psm", "4")
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return string(out), nil
+}
+
+// httpOCR posts the image to a service, such as an adapter in front of a
+// cloud OCR API, that responds with the text either as text/plain or as
+// JSON {"text": "..."}.
+type httpOCR struct {
+	url    string
+	client *http.Client
+}
+
+func (h httpOCR) Recognize(ctx context.Context, image []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(image))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OCR service returned %s", resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "application/json" {
+		var v struct {
+			Text string `json:"text"`
+		}
+		err := json.Unmarshal(body, &v)
+		return v.Text, err
+	}
+	return string(body), nil
+}
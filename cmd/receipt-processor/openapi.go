@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+
+	receiptprocessor "receipt-processor"
+	"receipt-processor/points"
+)
+
+//go:embed swaggerui/index.html swaggerui/*.js swaggerui/*.css swaggerui/*.png
+var swaggerUI embed.FS
+
+var (
+	apiDoc    *openapi3.T
+	apiRouter routers.Router
+	apiJSON   []byte
+)
+
+func init() {
+	var err error
+	apiDoc, err = openapi3.NewLoader().LoadFromData(receiptprocessor.OpenAPISpec)
+	if err == nil {
+		err = apiDoc.Validate(context.Background())
+	}
+	if err == nil {
+		apiRouter, err = legacy.NewRouter(apiDoc)
+	}
+	if err == nil {
+		apiJSON, err = json.Marshal(apiDoc)
+	}
+	if err != nil {
+		panic("api.yml: " + err.Error())
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
+
+// docsHandler serves Swagger UI pointed at /openapi.json.
+func docsHandler() http.Handler {
+	sub, _ := fs.Sub(swaggerUI, "swaggerui")
+	return http.StripPrefix("/docs/", http.FileServerFS(sub))
+}
+
+// validateRequests checks request bodies against api.yml. Requests the spec
+// does not describe, and operations marked x-validate-body: false, are left
+// to the handlers.
+func validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, params, err := apiRouter.FindRoute(r)
+		if err != nil || route.Operation.RequestBody == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if v, ok := route.Operation.Extensions["x-validate-body"].(bool); ok && !v {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The handlers decode any body as JSON whatever its Content-Type, so
+		// validate it the same way.
+		vr := r.Clone(r.Context())
+		vr.Header.Set("Content-Type", "application/json")
+		input := &openapi3filter.RequestValidationInput{
+			Request:    vr,
+			PathParams: params,
+			Route:      route,
+			Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc, MultiError: true},
+		}
+		err = openapi3filter.ValidateRequestBody(r.Context(), input, route.Operation.RequestBody.Value)
+		r.Body = vr.Body
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeDecodeError(w, r, err, "")
+			return
+		}
+		if err != nil {
+			err = schemaFieldErrors(err)
+		}
+		if err != nil {
+			validationFailures.Inc()
+			writeInvalidReceipt(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lenientFields are the fields --lenient accepts in other formats, whose
+// pattern and format are checked once the receipt is normalized instead.
+var lenientFields = map[string]bool{"purchaseDate": true, "purchaseTime": true, "total": true, "price": true, "unitPrice": true, "tax": true, "amount": true}
+
+// schemaFieldErrors converts the schema errors in err to a
+// *points.ValidationError, or returns err unchanged if it holds none. It
+// returns nil if every one is excused by --lenient.
+func schemaFieldErrors(err error) error {
+	var v points.ValidationError
+	excused := false
+	var collect func(error)
+	collect = func(err error) {
+		var multi openapi3.MultiError
+		var se *openapi3.SchemaError
+		switch {
+		case errors.As(err, &multi):
+			for _, e := range multi {
+				collect(e)
+			}
+		case errors.As(err, &se):
+			if pointer := se.JSONPointer(); validator.Lenient && len(pointer) > 0 && lenientFields[pointer[len(pointer)-1]] &&
+				(se.SchemaField == "pattern" || se.SchemaField == "format") {
+				excused = true
+				return
+			}
+			v.Fields = append(v.Fields, points.FieldError{Field: fieldPath(se.JSONPointer()), Message: schemaMessage(se)})
+		}
+	}
+	collect(err)
+	if len(v.Fields) == 0 {
+		if excused {
+			return nil
+		}
+		return err
+	}
+	sort.SliceStable(v.Fields, func(i, j int) bool { return v.Fields[i].Field < v.Fields[j].Field })
+	return &v
+}
+
+// schemaMessage phrases the common schema failures the way points.Validate
+// does.
+func schemaMessage(se *openapi3.SchemaError) string {
+	switch se.SchemaField {
+	case "required":
+		return "is required"
+	case "pattern":
+		return "must match " + se.Schema.Pattern
+	case "format":
+		if se.Schema.Format == "date" {
+			return "not a valid date (YYYY-MM-DD)"
+		}
+	}
+	return se.Reason
+}
+
+// fieldPath renders a JSON pointer such as ["items", "2", "price"] as
+// items[2].price.
+func fieldPath(pointer []string) string {
+	var b strings.Builder
+	for _, p := range pointer {
+		if _, err := strconv.Atoi(p); err == nil {
+			fmt.Fprintf(&b, "[%s]", p)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"receipt-processor/points"
+)
+
+// problem is an RFC 7807 application/problem+json error body. Code is an
+// extension member naming errors clients may want to tell apart, Errors one
+// listing the fields of a rejected receipt, and Receipt one holding a
+// rejected receipt the client did not send as JSON.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Code    string              `json:"code,omitempty"`
+	Errors  []points.FieldError `json:"errors,omitempty"`
+	Receipt *points.Receipt     `json:"receipt,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, detail string) problem {
+	return problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: apiPath(r.Context(), r.URL.Path),
+	}
+}
+
+func (p problem) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem writes an error response; use it in place of http.Error. A
+// server error in a request that ran past --request-timeout is reported as
+// the timeout it most likely stems from.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if status >= http.StatusInternalServerError && timedOut(r.Context()) {
+		status, detail = http.StatusServiceUnavailable, "The request took too long to process."
+	}
+	newProblem(r, status, detail).write(w)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, "")
+}
+
+// problemMux is a ServeMux that answers requests matching none of its
+// patterns with problem responses instead of ServeMux's plain-text ones: 405
+// with an Allow header for a path served for other methods, 404 otherwise.
+type problemMux struct {
+	*http.ServeMux
+}
+
+func newProblemMux() problemMux {
+	return problemMux{http.NewServeMux()}
+}
+
+func (m problemMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, pattern := m.Handler(r)
+	if pattern != "" {
+		m.ServeMux.ServeHTTP(w, r)
+		return
+	}
+	// ServeMux's handler for an unmatched request sets the Allow header
+	// when the path is served for other methods; run it on a scratch
+	// writer to find out.
+	rec := &headerRecorder{header: http.Header{}}
+	h.ServeHTTP(rec, r)
+	if rec.status == http.StatusMethodNotAllowed {
+		methodNotAllowed(w, r, strings.Split(rec.header.Get("Allow"), ", ")...)
+		return
+	}
+	notFound(w, r)
+}
+
+// headerRecorder is a ResponseWriter that keeps the header and status and
+// discards the body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (h *headerRecorder) Header() http.Header         { return h.header }
+func (h *headerRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (h *headerRecorder) WriteHeader(status int)      { h.status = status }
+
+// methodNotAllowed answers a request to a known path with a method it does
+// not serve, listing the ones it does in the Allow header.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(w, r, http.StatusMethodNotAllowed, "")
+}
+
+// writeDecodeError reports a request body that could not be decoded,
+// distinguishing bodies over the size limit from malformed ones.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes.", tooLarge.Limit))
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, msg)
+}
+
+// writeInvalidReceipt reports a rejected receipt, listing the failing fields
+// when err is a *points.ValidationError.
+func writeInvalidReceipt(w http.ResponseWriter, r *http.Request, err error) {
+	p := newProblem(r, http.StatusBadRequest, "The receipt is invalid. Please verify input.")
+	var v *points.ValidationError
+	if errors.As(err, &v) {
+		p.Errors = v.Fields
+	}
+	p.write(w)
+}
+
+// rejectedMessage is the detail sent for a receipt refused by the fraud
+// checks, saying why.
+func rejectedMessage(err error) string {
+	msg := "The receipt was rejected"
+	var f *fraudError
+	if errors.As(err, &f) {
+		msg += ": " + strings.Join(f.Reasons, "; ")
+	}
+	return msg + "."
+}
+
+// velocityLimitCode is the problem code of a receipt over a velocity limit.
+const velocityLimitCode = "velocity_limit_exceeded"
+
+// writeVelocityError reports a receipt over a velocity limit, saying when
+// the user may submit again.
+func writeVelocityError(w http.ResponseWriter, r *http.Request, err error) {
+	p := newProblem(r, http.StatusTooManyRequests, "Too many receipts. Please retry later.")
+	p.Code = velocityLimitCode
+	var v *velocityError
+	if errors.As(err, &v) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(v.retryAfter.Seconds()))))
+		p.Detail = v.message()
+	}
+	p.write(w)
+}
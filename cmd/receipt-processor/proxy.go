@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the networks of proxies, such as a load balancer, whose
+// X-Forwarded-For and X-Real-IP headers are believed. Requests from anywhere
+// else are taken to come from their peer address, whatever they claim.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of CIDRs, e.g.
+// 10.0.0.0/8, and single addresses.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a CIDR or IP address", field)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR or IP address", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trustedProxy reports whether host is the address of a trusted proxy.
+func trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent r. When r came
+// through trusted proxies, that is the last address in X-Forwarded-For not
+// of a trusted proxy, as each proxy appends the address it was reached
+// from; addresses before it could have been made up by the client.
+// Without X-Forwarded-For, a trusted proxy's X-Real-IP is used.
+func clientIP(r *http.Request) string {
+	peer := remoteHost(r)
+	if !trustedProxy(peer) {
+		return peer
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Not set by a proxy we trust, so neither is anything before.
+			break
+		}
+		if !trustedProxy(hops[i]) {
+			return addr.Unmap().String()
+		}
+		peer = hops[i]
+	}
+	if len(hops) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+	return peer
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const limiterIdleTTL = 10 * time.Minute
+
+// rateLimiter hands out one token bucket per client, keyed by API key when
+// the request carries one of --api-keys and by client IP otherwise.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rps     rate.Limit
+	burst   int
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	rl := &rateLimiter{rps: rate.Limit(rps), burst: burst, clients: make(map[string]*clientLimiter)}
+	go rl.evictIdle()
+	return rl
+}
+
+func (rl *rateLimiter) limiter(key string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+func (rl *rateLimiter) evictIdle() {
+	for range time.Tick(limiterIdleTTL) {
+		rl.mu.Lock()
+		for key, c := range rl.clients {
+			if time.Since(c.lastSeen) > limiterIdleTTL {
+				delete(rl.clients, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// clientKey names the bucket of the client that sent r. The limiter runs
+// before the API key is checked, so only a key that is one of --api-keys
+// gets its own bucket; otherwise a client could get a fresh one by sending
+// a new key with every request.
+func clientKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" && tenancy.apiKeys != nil {
+		if _, ok := tenancy.apiKeys[key]; ok {
+			return "key:" + key
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res := rl.limiter(clientKey(r)).Reserve()
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeProblem(w, r, http.StatusTooManyRequests, "Too many requests. Please retry later.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
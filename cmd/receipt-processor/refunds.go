@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"receipt-processor/points"
+)
+
+// What happens to refunds: receipts with a negative total.
+const (
+	// refundsReject refuses negative prices and totals, as validation
+	// always did.
+	refundsReject = "reject"
+	// refundsZero stores refunds, and receipts with returned items, but
+	// awards refunds no points.
+	refundsZero = "zero"
+	// refundsDeduct takes the points of the refunded receipt back from its
+	// user in proportion to the amount refunded.
+	refundsDeduct = "deduct"
+)
+
+var refunds = refundsReject
+
+// refundRuleVersion is the rule version of stored refunds, which are not
+// scored by the rules and so are skipped by recalculation.
+const refundRuleVersion = "refund"
+
+// refundsUnscored answers requests to score a refund with proposed rules.
+const refundsUnscored = "Refunds are not scored by the rules."
+
+// refundError reports a refund that does not fit the receipt it refunds, as
+// a validation error on one field.
+func refundError(field, message string) error {
+	return &points.ValidationError{Fields: []points.FieldError{{Field: field, Message: message}}}
+}
+
+// scoreRefund sets the points of rec, a refund: none under --refunds=zero,
+// and under deduct, minus the share of the refunded receipt's points that
+// the amount refunded is of its total. Earlier refunds of the same receipt
+// count toward the share, so refunding its whole total takes back all of its
+// points and no more. A refund must be from the retailer and for the user
+// of the receipt it refunds, and is credited to that user if it names none.
+func scoreRefund(ctx context.Context, rec *Record) error {
+	rec.RuleVersion = refundRuleVersion
+	refundOf := rec.Receipt.RefundOf
+	if refundOf == "" {
+		if refunds == refundsDeduct {
+			return refundError("refundOf", "is required for refunds")
+		}
+		return nil
+	}
+	orig, err := store.Get(ctx, refundOf)
+	if errors.Is(err, errNotFound) {
+		return refundError("refundOf", "no receipt found for that ID")
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case orig.RuleVersion == refundRuleVersion:
+		return refundError("refundOf", "is itself a refund")
+	case retailerKey(orig.Receipt.Retailer) != retailerKey(rec.Receipt.Retailer):
+		return refundError("retailer", "must be the retailer of the refunded receipt")
+	case rec.Receipt.PurchaseDate < orig.Receipt.PurchaseDate:
+		return refundError("purchaseDate", "must not be before the refunded receipt's")
+	case receiptCurrency(orig.Receipt) != receiptCurrency(rec.Receipt):
+		return refundError("currency", "must be the currency of the refunded receipt")
+	case rec.UserID != "" && rec.UserID != orig.UserID:
+		return refundError("userId", "must be the user of the refunded receipt")
+	}
+	rec.UserID = orig.UserID
+	if refunds != refundsDeduct {
+		return nil
+	}
+
+	// Refunds are no earlier than what they refund and share its retailer
+	// and user, which narrows the search for earlier ones.
+	refund, _ := points.ParseAmount(rec.Receipt.Total, rec.Receipt.Currency)
+	refunded, deducted := -refund, 0
+	opts := ListOptions{Limit: recalculatePageSize, Retailer: orig.Receipt.Retailer, UserID: orig.UserID, From: orig.Receipt.PurchaseDate}
+	for ; ; opts.Offset += recalculatePageSize {
+		recs, _, err := store.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, other := range recs {
+			if other.Receipt.RefundOf == orig.ID && other.RuleVersion == refundRuleVersion {
+				amount, _ := points.ParseAmount(other.Receipt.Total, other.Receipt.Currency)
+				refunded -= amount
+				deducted -= other.Points
+			}
+		}
+		if len(recs) < recalculatePageSize {
+			break
+		}
+	}
+	total, _ := points.ParseAmount(orig.Receipt.Total, orig.Receipt.Currency)
+	if refunded > total {
+		return refundError("total", fmt.Sprintf("would bring the refunds of receipt %s to %s, more than its total of %s", orig.ID, refunded.Format(orig.Receipt.Currency), orig.Receipt.Total))
+	}
+	// The share of the points, rounded up, less what earlier refunds took.
+	share := new(big.Int).Mul(big.NewInt(int64(orig.Points)), big.NewInt(int64(refunded)))
+	share.Add(share, big.NewInt(int64(total-1))).Quo(share, big.NewInt(int64(total)))
+	rec.Points = -(int(share.Int64()) - deducted)
+	return nil
+}
+
+// refundBreakdown explains a stored refund's points, which no rule awarded.
+func refundBreakdown(rec Record) []points.Result {
+	description := "no points for a refund"
+	if rec.Points != 0 {
+		description = "points of receipt " + rec.Receipt.RefundOf + " taken back in proportion to the amount refunded"
+	}
+	return []points.Result{{Rule: "refund", Description: description, Points: rec.Points}}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"receipt-processor/points"
+)
+
+// ruleRegistry holds the rule sets in effect. A reload replaces them as a
+// whole, so a receipt is always scored against one version of the file.
+type ruleRegistry struct {
+	mu  sync.RWMutex
+	reg points.Registry
+}
+
+var ruleSets = &ruleRegistry{reg: points.Default()}
+
+func (r *ruleRegistry) get() points.Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.reg
+}
+
+func (r *ruleRegistry) set(reg points.Registry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reg = reg
+}
+
+// configReloader loads the --rules and --campaigns files, at startup and
+// again on SIGHUP or POST /admin/reload, along with the TLS certificate if
+// one is configured. Every file is read and validated before any takes
+// effect, so a broken file leaves the running configuration as it was.
+// Requests already being scored finish with the rules they started with.
+type configReloader struct {
+	mu            sync.Mutex
+	rulesPath     string
+	campaignsPath string
+	keyPair       *keyPair
+}
+
+var reloader = &configReloader{}
+
+type reloadReport struct {
+	RuleVersions []string `json:"ruleVersions"`
+	Campaigns    int      `json:"campaigns"`
+}
+
+func (c *configReloader) reload() (reloadReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reg := points.Default()
+	if c.rulesPath != "" {
+		r, err := points.LoadFile(c.rulesPath)
+		if err != nil {
+			return reloadReport{}, err
+		}
+		reg = r
+	}
+	var cs points.Campaigns
+	if c.campaignsPath != "" {
+		loaded, err := points.LoadCampaigns(c.campaignsPath)
+		if err != nil {
+			return reloadReport{}, err
+		}
+		cs = loaded
+	}
+	var cert *tls.Certificate
+	if c.keyPair != nil {
+		loaded, err := c.keyPair.read()
+		if err != nil {
+			return reloadReport{}, err
+		}
+		cert = loaded
+	}
+
+	ruleSets.set(reg)
+	if cert != nil {
+		c.keyPair.set(cert)
+	}
+	// Without a file, campaigns exist only as set through /admin/campaigns
+	// and are kept.
+	if c.campaignsPath != "" {
+		campaigns.set(cs)
+	}
+	report := reloadReport{Campaigns: len(campaigns.all())}
+	for _, rs := range reg {
+		report.RuleVersions = append(report.RuleVersions, rs.Version)
+	}
+	return report, nil
+}
+
+// watch reloads the configuration each time the process gets SIGHUP, until
+// ctx is done.
+func (c *configReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			report, err := c.reload()
+			if err != nil {
+				configReloads.WithLabelValues("error").Inc()
+				slog.Error("reloading configuration; keeping the previous one", "error", err)
+				continue
+			}
+			configReloads.WithLabelValues("ok").Inc()
+			slog.Info("configuration reloaded", "rule_versions", report.RuleVersions, "campaigns", report.Campaigns)
+			audit.record(withActor(ctx, "SIGHUP"), auditEntry{Action: auditRulesReloaded, Details: report})
+		}
+	}
+}
+
+// reloadHandler serves POST /admin/reload, which reloads the configuration
+// as SIGHUP does and reports what is now in effect.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := reloader.reload()
+	if err != nil {
+		configReloads.WithLabelValues("error").Inc()
+		slog.ErrorContext(r.Context(), "reloading configuration; keeping the previous one", "error", err)
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The configuration was not reloaded: "+err.Error())
+		return
+	}
+	configReloads.WithLabelValues("ok").Inc()
+	slog.InfoContext(r.Context(), "configuration reloaded", "rule_versions", report.RuleVersions, "campaigns", report.Campaigns)
+	audit.record(r.Context(), auditEntry{Action: auditRulesReloaded, Details: report})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
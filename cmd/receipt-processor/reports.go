@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"receipt-processor/points"
+)
+
+const (
+	defaultReportDays = 7
+	maxReportDays     = 366
+)
+
+type dayReport struct {
+	Date            string `json:"date"`
+	Receipts        int    `json:"receipts"`
+	Points          int    `json:"points"`
+	UniqueRetailers int    `json:"uniqueRetailers"`
+	Spend           string `json:"spend,omitempty"`
+}
+
+// reportsHandler serves GET /reports?from=&to=, a row per purchase date in
+// the range with the tenant's receipts, points, distinct retailers and spend
+// in the base currency that day. The range defaults to the last 7 days,
+// including today (UTC). Spend is left out of days with receipts in a
+// currency that cannot be converted.
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(points.DateLayout, v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "from and to must be dates in YYYY-MM-DD format.")
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, 1-defaultReportDays)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(points.DateLayout, v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "from and to must be dates in YYYY-MM-DD format.")
+			return
+		}
+		from = t
+	}
+	asCSV, ok := wantsCSV(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, formatProblem)
+		return
+	}
+	if from.After(to) || to.Sub(from) >= maxReportDays*24*time.Hour {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("from must not be after to, and the range must be at most %d days.", maxReportDays))
+		return
+	}
+
+	var days []dayReport
+	index := make(map[string]int)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format(points.DateLayout)
+		index[date] = len(days)
+		days = append(days, dayReport{Date: date})
+	}
+	retailers := make(map[string]map[string]bool)
+	spend := make([]currencyTotals, len(days))
+	opts := ListOptions{Limit: recalculatePageSize, From: days[0].Date, To: days[len(days)-1].Date}
+	for ; ; opts.Offset += recalculatePageSize {
+		recs, _, err := store.List(r.Context(), opts)
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to build the report.")
+			return
+		}
+		for _, rec := range recs {
+			i, ok := index[rec.Receipt.PurchaseDate]
+			if !ok {
+				continue
+			}
+			days[i].Receipts++
+			days[i].Points += rec.Points
+			if spend[i] == nil {
+				spend[i] = make(currencyTotals)
+			}
+			spend[i].add(rec.Receipt, 1)
+			seen := retailers[rec.Receipt.PurchaseDate]
+			if seen == nil {
+				seen = make(map[string]bool)
+				retailers[rec.Receipt.PurchaseDate] = seen
+			}
+			seen[retailerKey(rec.Receipt.Retailer)] = true
+		}
+		if len(recs) < recalculatePageSize {
+			break
+		}
+	}
+	for date, seen := range retailers {
+		days[index[date]].UniqueRetailers = len(seen)
+	}
+	var convertErr error
+	for i := range days {
+		if amount, err := spend[i].convert(r.Context()); err != nil {
+			convertErr = err
+		} else {
+			days[i].Spend = amount.String()
+		}
+	}
+	if convertErr != nil {
+		slog.WarnContext(r.Context(), "converting spend failed", "error", convertErr)
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if asCSV {
+		cw := newCSVResponse(w, "report.csv", "date", "receipts", "points", "uniqueRetailers", "spend")
+		for _, d := range days {
+			cw.Write([]string{d.Date, strconv.Itoa(d.Receipts), strconv.Itoa(d.Points), strconv.Itoa(d.UniqueRetailers), d.Spend})
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		From     string      `json:"from"`
+		To       string      `json:"to"`
+		Currency string      `json:"currency"`
+		Days     []dayReport `json:"days"`
+	}{days[0].Date, days[len(days)-1].Date, baseCurrency, days})
+}
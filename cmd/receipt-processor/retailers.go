@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"receipt-processor/points"
+)
+
+// retailerAlias says that receipts from Alias are from Retailer, e.g. that
+// "M and M Corner Market" is "M&M Corner Market".
+type retailerAlias struct {
+	Alias    string `json:"alias"`
+	Retailer string `json:"retailer"`
+}
+
+// retailerAliasTable holds the retailer aliases in effect, keyed by the
+// normalized alias, and the retailers they are aliases of, spelled as in
+// the aliases, keyed by the normalized retailer. They start from
+// --retailer-aliases and may be changed through /admin/retailer-aliases;
+// changes are not written back to the file.
+type retailerAliasTable struct {
+	mu      sync.RWMutex
+	m       map[string]retailerAlias
+	targets map[string]string
+}
+
+func newRetailerAliasTable() *retailerAliasTable {
+	return &retailerAliasTable{m: make(map[string]retailerAlias), targets: make(map[string]string)}
+}
+
+var retailerAliases = newRetailerAliasTable()
+
+// loadRetailerAliases reads a JSON file holding an array of aliases.
+func loadRetailerAliases(path string) (*retailerAliasTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var aliases []retailerAlias
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("retailer aliases file %s: %w", path, err)
+	}
+	t := newRetailerAliasTable()
+	for i, a := range aliases {
+		if _, _, err := t.put(a); err != nil {
+			return nil, fmt.Errorf("retailer aliases file %s: alias %d (%q): %w", path, i, a.Alias, err)
+		}
+	}
+	return t, nil
+}
+
+// canonical returns the name the retailer is known by: the one name is an
+// alias of, or name as the aliases of it spell it, or else name with its
+// whitespace collapsed.
+func (t *retailerAliasTable) canonical(name string) string {
+	key := points.NormalizeRetailer(name)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if a, ok := t.m[key]; ok {
+		return a.Retailer
+	}
+	if target, ok := t.targets[key]; ok {
+		return target
+	}
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// variants returns the normalized names of the retailer name is known by,
+// aliases included, or nil if it has no aliases.
+func (t *retailerAliasTable) variants(name string) []string {
+	key := retailerKey(name)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if _, ok := t.targets[key]; !ok {
+		return nil
+	}
+	var names []string
+	for alias, a := range t.m {
+		if points.NormalizeRetailer(a.Retailer) == key {
+			names = append(names, alias)
+		}
+	}
+	slices.Sort(names)
+	return append(names, key)
+}
+
+// index rebuilds t.targets. The caller must hold t.mu.
+func (t *retailerAliasTable) index() {
+	clear(t.targets)
+	for _, a := range t.m {
+		t.targets[points.NormalizeRetailer(a.Retailer)] = a.Retailer
+	}
+}
+
+// put adds a, with its whitespace collapsed, replacing any alias with the
+// same normalized name, and returns it and whether one was replaced.
+// Aliases do not chain: a's retailer must not be an alias itself, nor may a
+// be the retailer of another alias.
+func (t *retailerAliasTable) put(a retailerAlias) (retailerAlias, bool, error) {
+	a.Alias = strings.Join(strings.Fields(a.Alias), " ")
+	a.Retailer = strings.Join(strings.Fields(a.Retailer), " ")
+	key, target := points.NormalizeRetailer(a.Alias), points.NormalizeRetailer(a.Retailer)
+	if key == "" || target == "" {
+		return a, false, errors.New("alias and retailer must not be empty")
+	}
+	if key == target {
+		return a, false, errors.New("alias and retailer must differ by more than case and whitespace")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if other, ok := t.m[target]; ok {
+		return a, false, fmt.Errorf("%q is itself an alias of %q", a.Retailer, other.Retailer)
+	}
+	if _, ok := t.targets[key]; ok {
+		return a, false, fmt.Errorf("other aliases are aliases of %q", a.Alias)
+	}
+	_, replaced := t.m[key]
+	t.m[key] = a
+	t.index()
+	return a, replaced, nil
+}
+
+// remove deletes the alias with name's normalized name and reports whether
+// there was one.
+func (t *retailerAliasTable) remove(name string) bool {
+	key := points.NormalizeRetailer(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.m[key]
+	delete(t.m, key)
+	t.index()
+	return ok
+}
+
+// all returns the aliases ordered by alias.
+func (t *retailerAliasTable) all() []retailerAlias {
+	t.mu.RLock()
+	list := make([]retailerAlias, 0, len(t.m))
+	for _, a := range t.m {
+		list = append(list, a)
+	}
+	t.mu.RUnlock()
+	slices.SortFunc(list, func(a, b retailerAlias) int {
+		return strings.Compare(points.NormalizeRetailer(a.Alias), points.NormalizeRetailer(b.Alias))
+	})
+	return list
+}
+
+// retailerKey identifies the retailer name is known by, for grouping and
+// comparing receipts: names that normalize the same, or are aliases of the
+// same retailer, share a key.
+func retailerKey(name string) string {
+	return points.NormalizeRetailer(retailerAliases.canonical(name))
+}
+
+// retailerMatches reports whether a search for term finds receipts from
+// name: whether name contains term, both normalized, or is known by the
+// same name.
+func retailerMatches(name, term string) bool {
+	return strings.Contains(points.NormalizeRetailer(name), points.NormalizeRetailer(term)) ||
+		retailerKey(name) == retailerKey(term)
+}
+
+// retailerNames tracks how to show the retailers aggregated under each
+// normalized name: the first spelling counted.
+type retailerNames map[string]string
+
+// note records name's spelling for its normalized name, if it is the first,
+// and returns the normalized name.
+func (n retailerNames) note(name string) string {
+	key := points.NormalizeRetailer(name)
+	if _, ok := n[key]; !ok {
+		n[key] = strings.Join(strings.Fields(name), " ")
+	}
+	return key
+}
+
+// group sums counts kept by normalized name by the retailer each is known
+// by, named as it is known.
+func (n retailerNames) group(counts map[string]int) map[string]int {
+	grouped := make(map[string]int, len(counts))
+	for key, count := range counts {
+		grouped[retailerAliases.canonical(n[key])] += count
+	}
+	return grouped
+}
+
+// listRetailerAliasesHandler serves GET /admin/retailer-aliases.
+func listRetailerAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retailerAliases.all())
+}
+
+// putRetailerAliasHandler serves POST /admin/retailer-aliases, which adds an
+// alias or replaces the one with the same name. Aliases apply to receipts
+// as they are submitted, searched and reported on; stored receipts and
+// their points are not changed.
+func putRetailerAliasHandler(w http.ResponseWriter, r *http.Request) {
+	var a retailerAlias
+	if err := decodeJSON(r.Body, &a, true); err != nil {
+		writeDecodeError(w, r, err, "The alias is invalid. Please verify input.")
+		return
+	}
+	a, replaced, err := retailerAliases.put(a)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The alias is invalid: "+err.Error()+".")
+		return
+	}
+	audit.record(r.Context(), auditEntry{Action: auditAliasSaved, Target: a.Alias, Details: a})
+	w.Header().Set("Content-Type", "application/json")
+	if !replaced {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(a)
+}
+
+// deleteRetailerAliasHandler serves DELETE /admin/retailer-aliases/{alias}.
+func deleteRetailerAliasHandler(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	if !retailerAliases.remove(alias) {
+		writeProblem(w, r, http.StatusNotFound, "No alias found for that name.")
+		return
+	}
+	audit.record(r.Context(), auditEntry{Action: auditAliasDeleted, Target: alias})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// storedBefore returns the records stored before cutoff.
+func (s *memoryStore) storedBefore(cutoff time.Time) []Record {
+	var recs []Record
+	for i := range s.data {
+		sh := &s.data[i]
+		sh.RLock()
+		for _, rec := range sh.m {
+			if rec.StoredAt.Before(cutoff) {
+				recs = append(recs, rec)
+			}
+		}
+		sh.RUnlock()
+	}
+	return recs
+}
+
+// retainingStore is a store that keeps when each record was stored: the
+// memory store, with or without a write-ahead log or snapshots.
+type retainingStore interface {
+	Delete(ctx context.Context, id string) error
+	storedBefore(cutoff time.Time) []Record
+}
+
+// forgetReceipt drops a receipt removed from the store from the leaderboard
+// and stats, as rebuilding them from the store would, and from the flagged
+// receipts. Unlike deleteRecord, it leaves the receipt's points in its
+// user's balance.
+func forgetReceipt(rec Record) {
+	leaderboard.record(rec, -rec.Points)
+	stats.remove(rec)
+	flagged.remove(rec.ID)
+}
+
+// evictReceipts deletes the receipts stored before cutoff and returns how
+// many it deleted.
+func evictReceipts(ctx context.Context, s retainingStore, cutoff time.Time) (int, error) {
+	evicted := 0
+	defer func() { receiptsEvicted.WithLabelValues("retention").Add(float64(evicted)) }()
+	for _, rec := range s.storedBefore(cutoff) {
+		err := s.Delete(ctx, rec.ID)
+		if errors.Is(err, errNotFound) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return evicted, err
+		}
+		forgetReceipt(rec)
+		evicted++
+	}
+	return evicted, nil
+}
+
+// runRetention evicts receipts stored in s longer than retention every
+// interval until ctx is done.
+func runRetention(ctx context.Context, s retainingStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := evictReceipts(ctx, s, time.Now().Add(-retention))
+		if err != nil {
+			slog.Error("evicting receipts", "error", err)
+		} else if n > 0 {
+			slog.Info("evicted receipts", "receipts", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lru orders keys from most to least recently used.
+type lru struct {
+	order list.List
+	elems map[string]*list.Element
+}
+
+func (l *lru) init() {
+	l.elems = make(map[string]*list.Element)
+}
+
+// touch makes key the most recently used, adding it if it is new.
+func (l *lru) touch(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elems[key] = l.order.PushFront(key)
+}
+
+func (l *lru) remove(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.Remove(e)
+		delete(l.elems, key)
+	}
+}
+
+func (l *lru) oldest() string {
+	return l.order.Back().Value.(string)
+}
+
+// touch returns the record for id and makes it its shard's most recently
+// used.
+func (s *memoryStore) touch(id string) (Record, bool) {
+	i := s.data.shard(id)
+	sh := &s.data[i]
+	sh.Lock()
+	defer sh.Unlock()
+	rec, ok := sh.m[id]
+	if ok {
+		s.recency[i].touch(id)
+	}
+	return rec, ok
+}
+
+// evictWith has f called for each record evicted from now on.
+func (s *memoryStore) evictWith(f func(Record)) {
+	s.onEvict = f
+}
+
+// evicted reports records Save evicted to stay within --max-receipts. The
+// first eviction is logged, since it means the store is full.
+func (s *memoryStore) evicted(recs []Record) {
+	if len(recs) == 0 {
+		return
+	}
+	if s.full.CompareAndSwap(false, true) {
+		slog.Warn("memory store is full; evicting the least recently used receipts", "max_receipts", s.maxPerShard*memoryShards)
+	}
+	receiptsEvicted.WithLabelValues("capacity").Add(float64(len(recs)))
+	if s.onEvict != nil {
+		for _, rec := range recs {
+			s.onEvict(rec)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"receipt-processor/points"
+	"receipt-processor/receipttext"
+)
+
+// runScore implements "receipt-processor score [--rules=file] [--strict]
+// [receipt.json]", which scores a receipt read from a file or stdin without
+// starting the server. A PDF receipt is read from its text layer, and what
+// was read is printed before the score.
+func runScore(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("receipt-processor score", flag.ContinueOnError)
+	rulesPath := fs.String("rules", os.Getenv(envPrefix+"RULES"), "JSON file overriding the default scoring rules")
+	campaignsPath := fs.String("campaigns", os.Getenv(envPrefix+"CAMPAIGNS"), "JSON file of promotional campaigns applied after the scoring rules")
+	strict, _ := strconv.ParseBool(os.Getenv(envPrefix + "STRICT"))
+	fs.BoolVar(&strict, "strict", strict, "reject receipts with unknown fields or data after the JSON document")
+	checkTotal := fs.Bool("check-total", false, "reject a receipt whose item prices do not sum to the total")
+	tolerance := fs.Float64("total-tolerance", 0, "how far, in dollars, the item prices may differ from the total under --check-total")
+	rejectFuture := fs.Bool("reject-future", false, "reject a receipt with a purchase date and time in the future")
+	maxAgeDays := fs.Int("max-age-days", 0, "reject a receipt purchased more than this many days ago (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: receipt-processor score [--rules=file] [--strict] [receipt.json|receipt.pdf]")
+	}
+
+	reg := points.Default()
+	if *rulesPath != "" {
+		r, err := points.LoadFile(*rulesPath)
+		if err != nil {
+			return err
+		}
+		reg = r
+	}
+	var cs points.Campaigns
+	if *campaignsPath != "" {
+		c, err := points.LoadCampaigns(*campaignsPath)
+		if err != nil {
+			return err
+		}
+		cs = c
+	}
+
+	in := stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var receipt points.Receipt
+	br := bufio.NewReader(in)
+	if magic, _ := br.Peek(5); string(magic) == "%PDF-" {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		if receipt, err = receipttext.ParsePDF(data); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(receipt); err != nil {
+			return err
+		}
+	} else if err := decodeJSON(br, &receipt, strict); err != nil {
+		return fmt.Errorf("decoding receipt: %w", err)
+	}
+	val := points.Validator{
+		CheckTotal:     *checkTotal,
+		TotalTolerance: points.DollarsToMoney(*tolerance),
+		RejectFuture:   *rejectFuture,
+		MaxAgeDays:     *maxAgeDays,
+	}
+	if err := val.Validate(receipt); err != nil {
+		return err
+	}
+	version, results, err := reg.Score(receipt)
+	if err != nil {
+		return err
+	}
+	results = append(results, cs.Apply(receipt, results)...)
+
+	fmt.Fprintf(stdout, "Rule set %s\n", version)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", r.Rule, r.Points, r.Description)
+	}
+	fmt.Fprintf(tw, "Total\t%d\t\n", points.Total(results))
+	return tw.Flush()
+}
+
+// scoreReceiptHandler serves POST /receipts/score, which validates and scores
+// a receipt as processing it would, but stores nothing and assigns no ID, so
+// that clients can preview the points a receipt is worth.
+func scoreReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var receipt points.Receipt
+	if err := decodeJSON(r.Body, &receipt, strict); err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeDecodeError(w, r, err, "")
+			return
+		}
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+	receipt = validator.Normalize(receipt)
+	if err := validator.Validate(receipt); err != nil {
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+	var (
+		version string
+		results []points.Result
+		err     error
+	)
+	if receipt.IsRefund() {
+		// Refunds are scored against the receipt they refund.
+		rec := Record{Receipt: receipt}
+		err = scoreRefund(r.Context(), &rec)
+		version, results = rec.RuleVersion, refundBreakdown(rec)
+	} else {
+		version, results, err = scoreReceipt(receipt)
+	}
+	if err != nil {
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakdownResponse{points.Total(results), version, results})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"receipt-processor/points"
+)
+
+// simulateRequest is the body of POST /admin/simulate: proposed rules, in
+// the form a --rules file takes, and either a receipt or the ID of a stored
+// one.
+type simulateRequest struct {
+	Rules   json.RawMessage `json:"rules"`
+	Receipt *points.Receipt `json:"receipt,omitempty"`
+	ID      string          `json:"id,omitempty"`
+}
+
+type simulateResponse struct {
+	ID         string            `json:"id,omitempty"`
+	Current    breakdownResponse `json:"current"`
+	Proposed   breakdownResponse `json:"proposed"`
+	Difference int               `json:"difference"`
+}
+
+// simulateHandler serves POST /admin/simulate, which scores a receipt with
+// proposed rules next to its current score, so that rule changes can be
+// modeled before they are deployed. A stored receipt's current score is its
+// breakdown; campaigns apply to both scores as they are configured now.
+// Nothing is stored or changed.
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	var req simulateRequest
+	if err := decodeJSON(r.Body, &req, true); err != nil {
+		writeDecodeError(w, r, err, "The simulation is invalid. Please verify input.")
+		return
+	}
+	if len(req.Rules) == 0 || (req.Receipt == nil) == (req.ID == "") {
+		writeProblem(w, r, http.StatusBadRequest, "Send rules and either a receipt or the id of a stored one.")
+		return
+	}
+	proposed, err := points.ParseRules(req.Rules)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The rules are invalid: "+err.Error()+".")
+		return
+	}
+
+	var (
+		resp    = simulateResponse{ID: req.ID}
+		receipt points.Receipt
+	)
+	if req.Receipt != nil {
+		receipt = validator.Normalize(*req.Receipt)
+		if err := validator.Validate(receipt); err != nil {
+			writeInvalidReceipt(w, r, err)
+			return
+		}
+		if receipt.IsRefund() {
+			writeProblem(w, r, http.StatusUnprocessableEntity, refundsUnscored)
+			return
+		}
+		version, results, err := scoreReceipt(receipt)
+		if err != nil {
+			writeInvalidReceipt(w, r, err)
+			return
+		}
+		resp.Current = breakdownResponse{points.Total(results), version, results}
+	} else {
+		rec, results, err := receiptBreakdown(r.Context(), req.ID)
+		switch {
+		case errors.Is(err, errNotFound):
+			writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+			return
+		case errors.Is(err, errRuleSetMissing):
+			writeProblem(w, r, http.StatusInternalServerError, fmt.Sprintf("Rule set %q is no longer configured.", rec.RuleVersion))
+			return
+		case err != nil:
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt.")
+			return
+		}
+		if rec.RuleVersion == refundRuleVersion {
+			writeProblem(w, r, http.StatusUnprocessableEntity, refundsUnscored)
+			return
+		}
+		receipt = rec.Receipt
+		resp.Current = breakdownResponse{points.Total(results), rec.RuleVersion, results}
+	}
+
+	version, results, err := scoreWith(proposed, receipt)
+	if errors.Is(err, points.ErrNoRuleSet) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "None of the proposed rule sets is in effect on the receipt's purchase date.")
+		return
+	}
+	if err != nil {
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+	resp.Proposed = breakdownResponse{points.Total(results), version, results}
+	resp.Difference = resp.Proposed.Points - resp.Current.Points
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
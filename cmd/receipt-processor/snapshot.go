@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshot is the whole contents of a memoryStore. Seq is the last
+// write-ahead log entry it includes.
+type snapshot struct {
+	Seq          uint64        `json:"seq"`
+	Records      []Record      `json:"records"`
+	Transactions []ledgerEntry `json:"transactions"`
+}
+
+// ledgerEntry is a Transaction with its tenant, which Transaction leaves out
+// of its JSON.
+type ledgerEntry struct {
+	Tenant string `json:"tenant"`
+	Transaction
+}
+
+// snapshot copies the store's contents. Writes made while it runs may or
+// may not be included.
+func (s *memoryStore) snapshot() snapshot {
+	var snap snapshot
+	for i := range s.data {
+		sh := &s.data[i]
+		sh.RLock()
+		for _, rec := range sh.m {
+			snap.Records = append(snap.Records, rec)
+		}
+		sh.RUnlock()
+	}
+	s.ledgerMu.Lock()
+	for _, txs := range s.ledger {
+		for _, tx := range txs {
+			snap.Transactions = append(snap.Transactions, ledgerEntry{tx.Tenant, tx})
+		}
+	}
+	s.ledgerMu.Unlock()
+	return snap
+}
+
+// restore adds the contents of snap to the store.
+func (s *memoryStore) restore(snap snapshot) {
+	for _, rec := range snap.Records {
+		s.Save(context.Background(), rec)
+	}
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	for _, e := range snap.Transactions {
+		e.Transaction.Tenant = e.Tenant
+		key := ledgerKey(e.Tenant, e.UserID)
+		s.ledger[key] = append(s.ledger[key], e.Transaction)
+	}
+}
+
+// isGob reports whether a snapshot file is gob rather than JSON, which it is
+// if its name ends in .gob.
+func isGob(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gob")
+}
+
+// writeSnapshot writes snap to path atomically: readers see either the old
+// file or the complete new one.
+func writeSnapshot(path string, snap snapshot) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if isGob(path) {
+		err = gob.NewEncoder(f).Encode(snap)
+	} else {
+		err = json.NewEncoder(f).Encode(snap)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readSnapshot reads a snapshot written by writeSnapshot. A missing file is
+// an empty snapshot.
+func readSnapshot(path string) (snapshot, error) {
+	var snap snapshot
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+	if isGob(path) {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&snap)
+	} else {
+		err = json.Unmarshal(data, &snap)
+	}
+	return snap, err
+}
+
+// snapshotStore is a memoryStore restored from a snapshot file on open and
+// saved back to it every interval and on Close. Writes made since the last
+// snapshot are lost if the process dies; use walStore where they must not
+// be.
+type snapshotStore struct {
+	*memoryStore
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openSnapshotStore(path string, interval time.Duration, maxEntries int) (*snapshotStore, error) {
+	snap, err := readSnapshot(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	s := &snapshotStore{memoryStore: newMemoryStore(maxEntries), path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	s.restore(snap)
+	slog.Info("restored store", "path", path, "records", len(snap.Records))
+	go s.saveEvery(interval)
+	return s, nil
+}
+
+func (s *snapshotStore) saveEvery(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := writeSnapshot(s.path, s.snapshot()); err != nil {
+				slog.Error("writing snapshot", "error", err)
+			}
+		}
+	}
+}
+
+func (s *snapshotStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return writeSnapshot(s.path, s.snapshot())
+}
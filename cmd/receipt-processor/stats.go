@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultStatsRetailers = 10
+	maxStatsRetailers     = 100
+)
+
+// histogramBounds are the lower bounds of the points histogram's buckets;
+// each bucket runs up to the next bound, and the last has no upper bound.
+// Negative totals are counted in the first bucket.
+var histogramBounds = []int{0, 25, 50, 100, 250, 500, 1000}
+
+// statsIndex keeps running totals per tenant, updated as receipts are
+// stored, rescored, and deleted, so that GET /stats never reads the store.
+// With a shared store, which this instance does not see every change to,
+// each request builds an index of its own from the store instead.
+type statsIndex struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantStats
+}
+
+// tenantStats counts receipts per retailer by normalized name; aliases are
+// applied as reports are made, so that changing them regroups every receipt.
+// Spend is likewise kept per currency and converted as reports are made.
+type tenantStats struct {
+	receipts  int
+	points    int
+	spend     currencyTotals
+	buckets   []int
+	retailers map[string]int
+	names     retailerNames
+}
+
+var stats = newStatsIndex()
+
+func newStatsIndex() *statsIndex {
+	return &statsIndex{tenants: make(map[string]*tenantStats)}
+}
+
+// add counts a newly stored receipt; remove uncounts one deleted or about to
+// be replaced.
+func (s *statsIndex) add(rec Record)    { s.update(rec, 1) }
+func (s *statsIndex) remove(rec Record) { s.update(rec, -1) }
+
+func (s *statsIndex) update(rec Record, sign int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenants[rec.Tenant]
+	if t == nil {
+		t = &tenantStats{spend: make(currencyTotals), buckets: make([]int, len(histogramBounds)), retailers: make(map[string]int), names: make(retailerNames)}
+		s.tenants[rec.Tenant] = t
+	}
+	t.receipts += sign
+	t.points += sign * rec.Points
+	t.spend.add(rec.Receipt, sign)
+	t.buckets[histogramBucket(rec.Points)] += sign
+	retailer := t.names.note(rec.Receipt.Retailer)
+	if t.retailers[retailer] += sign; t.retailers[retailer] <= 0 {
+		delete(t.retailers, retailer)
+		delete(t.names, retailer)
+	}
+}
+
+func histogramBucket(p int) int {
+	i, found := slices.BinarySearch(histogramBounds, p)
+	if !found {
+		i--
+	}
+	return max(i, 0)
+}
+
+// load builds the index from every stored receipt, or only the tenant's if
+// ctx has one.
+func (s *statsIndex) load(ctx context.Context) error {
+	for offset := 0; ; offset += recalculatePageSize {
+		recs, _, err := store.List(ctx, ListOptions{Limit: recalculatePageSize, Offset: offset})
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			s.add(rec)
+		}
+		if len(recs) < recalculatePageSize {
+			return nil
+		}
+	}
+}
+
+type histogramBucketCount struct {
+	From  int  `json:"from"`
+	To    *int `json:"to,omitempty"`
+	Count int  `json:"count"`
+}
+
+type retailerCount struct {
+	Name     string `json:"name"`
+	Receipts int    `json:"receipts"`
+}
+
+type statsReport struct {
+	Receipts      int                    `json:"receipts"`
+	Points        int                    `json:"points"`
+	AveragePoints float64                `json:"averagePoints"`
+	Spend         spendTotal             `json:"spend"`
+	Histogram     []histogramBucketCount `json:"histogram"`
+	TopRetailers  []retailerCount        `json:"topRetailers"`
+}
+
+// report summarizes tenant's receipts, with the n retailers that have the
+// most. Its cost depends on the number of retailers, not receipts.
+func (s *statsIndex) report(ctx context.Context, tenant string, n int) statsReport {
+	rep, spend := s.summarize(tenant, n)
+	// Converting may fetch rates, so it is done outside the lock.
+	rep.Spend = spend.spend(ctx)
+	return rep
+}
+
+// summarize makes tenant's report, less the spend, which it returns as it
+// is kept.
+func (s *statsIndex) summarize(tenant string, n int) (statsReport, currencyTotals) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := statsReport{Histogram: make([]histogramBucketCount, len(histogramBounds)), TopRetailers: []retailerCount{}}
+	for i, from := range histogramBounds {
+		rep.Histogram[i].From = from
+		if i+1 < len(histogramBounds) {
+			rep.Histogram[i].To = &histogramBounds[i+1]
+		}
+	}
+	t := s.tenants[tenant]
+	if t == nil {
+		return rep, nil
+	}
+	rep.Receipts, rep.Points = t.receipts, t.points
+	if t.receipts > 0 {
+		rep.AveragePoints = math.Round(float64(t.points)/float64(t.receipts)*100) / 100
+	}
+	for i, count := range t.buckets {
+		rep.Histogram[i].Count = count
+	}
+	for name, count := range t.names.group(t.retailers) {
+		rep.TopRetailers = append(rep.TopRetailers, retailerCount{name, count})
+	}
+	slices.SortFunc(rep.TopRetailers, func(a, b retailerCount) int {
+		return cmp.Or(cmp.Compare(b.Receipts, a.Receipts), strings.Compare(a.Name, b.Name))
+	})
+	rep.TopRetailers = rep.TopRetailers[:min(n, len(rep.TopRetailers))]
+	return rep, maps.Clone(t.spend)
+}
+
+// statsHandler serves GET /stats?top=10.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	top, err := queryInt(r, "top", defaultStatsRetailers)
+	if err != nil || top < 1 || top > maxStatsRetailers {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("top must be between 1 and %d.", maxStatsRetailers))
+		return
+	}
+	tenant, _ := tenantFrom(r.Context())
+
+	index := stats
+	if sharedStore {
+		index = newStatsIndex()
+		if err := index.load(r.Context()); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to load the stats.")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index.report(r.Context(), tenant, top))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"receipt-processor/points"
+)
+
+// TestStatsSharedStore checks that with a shared store the stats count
+// receipts another instance stored, and stop counting those it deleted,
+// though this instance's index saw neither.
+func TestStatsSharedStore(t *testing.T) {
+	oldStore, oldShared := store, sharedStore
+	t.Cleanup(func() { store, sharedStore = oldStore, oldShared })
+	store, sharedStore = newMemoryStore(0), true
+
+	ctx := withTenantContext(context.Background(), "acme")
+	recs := []Record{
+		{ID: "r1", Tenant: "acme", Points: 30, Receipt: points.Receipt{Retailer: "Target", Total: "10.00"}},
+		{ID: "r2", Tenant: "acme", Points: 20, Receipt: points.Receipt{Retailer: "Target", Total: "5.00"}},
+		{ID: "r3", Tenant: "globex", Points: 50, Receipt: points.Receipt{Retailer: "Walgreens", Total: "1.00"}},
+	}
+	for _, rec := range recs {
+		if err := store.Save(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := func() statsReport {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/stats", nil)
+		statsHandler(w, r.WithContext(ctx))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var rep statsReport
+		if err := json.NewDecoder(w.Body).Decode(&rep); err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+	if rep := report(); rep.Receipts != 2 || rep.Points != 50 {
+		t.Errorf("stats = %d receipts and %d points, want 2 and 50", rep.Receipts, rep.Points)
+	}
+	if err := store.Delete(ctx, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if rep := report(); rep.Receipts != 1 || rep.Points != 20 {
+		t.Errorf("stats after a delete = %d receipts and %d points, want 1 and 20", rep.Receipts, rep.Points)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"receipt-processor/points"
+)
+
+var errNotFound = errors.New("receipt not found")
+
+// commitTimeout bounds the writes made under a commitContext.
+const commitTimeout = 10 * time.Second
+
+// commitContext returns a context for writes that must not be left half
+// done, such as storing a receipt and crediting its points. It keeps ctx's
+// values but not its cancellation, so that a client going away or a request
+// timing out between the writes does not leave one without the other.
+func commitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), commitTimeout)
+}
+
+type Record struct {
+	ID      string         `json:"id"`
+	Receipt points.Receipt `json:"receipt"`
+	Points  int            `json:"points"`
+	Hash    string         `json:"hash,omitempty"`
+
+	RuleVersion string `json:"ruleVersion"`
+	Tenant      string `json:"tenant,omitempty"`
+	UserID      string `json:"userId,omitempty"`
+
+	// Campaigns holds the campaign bonuses included in Points when the
+	// receipt was last scored, so that its breakdown still adds up after
+	// campaigns change. Unlike rules, campaigns are not versioned.
+	Campaigns []points.Result `json:"campaigns,omitempty"`
+
+	// PurchasedAt is when the receipt was purchased, in UTC; see
+	// points.Receipt.PurchasedAt. It is zero for receipts stored before it
+	// was kept.
+	PurchasedAt time.Time `json:"purchasedAt,omitzero"`
+
+	// StoredAt is when the receipt was processed. The memory store keeps it
+	// to evict receipts older than --retention, and the redis store with the
+	// rest of the record; the SQL stores drop it.
+	StoredAt time.Time `json:"storedAt,omitzero"`
+
+	// History holds the versions of the receipt that corrections replaced,
+	// oldest first. Receipt, Points and RuleVersion are the latest version,
+	// numbered one more than the last of them.
+	History []ReceiptVersion `json:"history,omitempty"`
+
+	// Metadata describes how the receipt was submitted. Corrections keep
+	// the metadata of the first version.
+	Metadata *ReceiptMetadata `json:"metadata,omitempty"`
+}
+
+// ReceiptVersion is one version of a receipt, numbered from 1 for the
+// receipt as first submitted, with the points it was scored. Versions a
+// correction replaced are never changed again; ReplacedAt says when they
+// were replaced.
+type ReceiptVersion struct {
+	Version     int            `json:"version"`
+	Receipt     points.Receipt `json:"receipt"`
+	Points      int            `json:"points"`
+	RuleVersion string         `json:"ruleVersion"`
+	ReplacedAt  time.Time      `json:"replacedAt,omitzero"`
+}
+
+// Store persists scored receipts. Save replaces any record with the same ID.
+type Store interface {
+	Save(ctx context.Context, rec Record) error
+	Get(ctx context.Context, id string) (Record, error)
+	GetPoints(ctx context.Context, id string) (int, error)
+	GetReceipt(ctx context.Context, id string) (points.Receipt, error)
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context, opts ListOptions) ([]Record, int, error)
+	FindByHash(ctx context.Context, hash string) (string, error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// ListOptions selects a page of records, ordered by ID unless Sort says
+// otherwise. A zero Limit returns every record after Offset; an empty Tenant
+// matches all tenants. The remaining fields filter the records when set.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Tenant string
+
+	// Retailer matches retailer names containing it, both normalized, and
+	// the names of the retailer it is known by; see retailerMatches.
+	Retailer string
+	// UserID matches receipts submitted for the user.
+	UserID string
+	// From and To bound the purchase date, inclusive, as YYYY-MM-DD.
+	From, To             string
+	MinPoints, MaxPoints *int
+
+	Sort string
+	Desc bool
+}
+
+// Orders a list can be sorted by, ties broken by ID.
+const (
+	sortID           = "id"
+	sortPoints       = "points"
+	sortPurchaseDate = "purchaseDate"
+	sortRetailer     = "retailer"
+)
+
+func (o ListOptions) filtered() bool {
+	return o.Retailer != "" || o.UserID != "" || o.From != "" || o.To != "" || o.MinPoints != nil || o.MaxPoints != nil
+}
+
+func (o ListOptions) match(rec Record) bool {
+	r := rec.Receipt
+	return (o.Tenant == "" || rec.Tenant == o.Tenant) &&
+		(o.Retailer == "" || retailerMatches(r.Retailer, o.Retailer)) &&
+		(o.UserID == "" || rec.UserID == o.UserID) &&
+		(o.From == "" || r.PurchaseDate >= o.From) &&
+		(o.To == "" || r.PurchaseDate <= o.To) &&
+		(o.MinPoints == nil || rec.Points >= *o.MinPoints) &&
+		(o.MaxPoints == nil || rec.Points <= *o.MaxPoints)
+}
+
+// sort orders recs as o asks.
+func (o ListOptions) sort(recs []Record) {
+	key := func(rec Record) string {
+		switch o.Sort {
+		case sortPurchaseDate:
+			return rec.Receipt.PurchaseDate
+		case sortRetailer:
+			return rec.Receipt.Retailer
+		}
+		return ""
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		a, b := recs[i], recs[j]
+		if o.Desc {
+			a, b = b, a
+		}
+		if o.Sort == sortPoints && a.Points != b.Points {
+			return a.Points < b.Points
+		}
+		if ka, kb := key(a), key(b); ka != kb {
+			return ka < kb
+		}
+		return a.ID < b.ID
+	})
+}
+
+func (o ListOptions) page(total int) (start, end int) {
+	start = min(o.Offset, total)
+	end = total
+	if o.Limit > 0 {
+		end = min(start+o.Limit, total)
+	}
+	return start, end
+}
+
+type storeConfig struct {
+	Kind       string
+	DBPath     string
+	DBURL      string
+	DBMaxConns int
+
+	RedisURL    string
+	RedisPrefix string
+	RedisTTL    time.Duration
+
+	WALDir             string
+	WALCompactInterval time.Duration
+
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	Retention         time.Duration
+	RetentionInterval time.Duration
+	MaxEntries        int
+}
+
+// backend is a storage backend, which holds both receipts and the points
+// ledger.
+type backend interface {
+	Store
+	Ledger
+}
+
+func newStore(cfg storeConfig) (backend, error) {
+	switch cfg.Kind {
+	case "memory":
+		if cfg.WALDir != "" {
+			return openWALStore(cfg.WALDir, cfg.WALCompactInterval, cfg.MaxEntries)
+		}
+		if cfg.SnapshotPath != "" {
+			return openSnapshotStore(cfg.SnapshotPath, cfg.SnapshotInterval, cfg.MaxEntries)
+		}
+		return newMemoryStore(cfg.MaxEntries), nil
+	case "sqlite":
+		return newSQLiteStore(cfg.DBPath)
+	case "postgres":
+		return newPostgresStore(cfg.DBURL, cfg.DBMaxConns)
+	case "redis":
+		return newRedisStore(cfg.RedisURL, cfg.RedisPrefix, cfg.RedisTTL)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Kind)
+	}
+}
+
+// shared reports whether other instances may store receipts in the same
+// store, or it may expire them, so that totals an instance keeps as it
+// stores and deletes receipts would drift from it.
+func (cfg storeConfig) shared() bool {
+	return cfg.Kind == "postgres" || cfg.Kind == "redis"
+}
+
+// memoryShards is how many ways memoryStore splits its maps, so that reads
+// and writes of different receipts rarely wait on the same lock.
+const memoryShards = 64
+
+type memoryStore struct {
+	data   shardedMap[Record]
+	hashes shardedMap[string]
+
+	// With maxPerShard set, each shard of data holds at most that many
+	// records, evicting its least recently used one to make room. recency
+	// orders each shard's records and is guarded by the shard's lock.
+	maxPerShard int
+	recency     [memoryShards]lru
+	onEvict     func(Record)
+	full        atomic.Bool
+
+	// ledgerMu guards ledger, which is read and written far less often than
+	// receipts.
+	ledgerMu sync.Mutex
+	ledger   map[string][]Transaction
+}
+
+// newMemoryStore returns an empty memory store holding about maxEntries
+// receipts at most, or any number if maxEntries is 0.
+func newMemoryStore(maxEntries int) *memoryStore {
+	s := &memoryStore{ledger: make(map[string][]Transaction)}
+	s.data.init()
+	s.hashes.init()
+	if maxEntries > 0 {
+		s.maxPerShard = (maxEntries + memoryShards - 1) / memoryShards
+		for i := range s.recency {
+			s.recency[i].init()
+		}
+	}
+	return s
+}
+
+// shardedMap is a string-keyed map split into shards, each with its own lock.
+type shardedMap[V any] [memoryShards]struct {
+	sync.RWMutex
+	m map[string]V
+}
+
+func (sm *shardedMap[V]) init() {
+	for i := range sm {
+		sm[i].m = make(map[string]V)
+	}
+}
+
+func (sm *shardedMap[V]) shard(key string) int {
+	return shardOf(key)
+}
+
+// shardOf picks the shard for key by its FNV-1a hash.
+func shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % memoryShards)
+}
+
+func (sm *shardedMap[V]) get(key string) (V, bool) {
+	sh := &sm[sm.shard(key)]
+	sh.RLock()
+	defer sh.RUnlock()
+	v, ok := sh.m[key]
+	return v, ok
+}
+
+func (sm *shardedMap[V]) set(key string, v V) {
+	sh := &sm[sm.shard(key)]
+	sh.Lock()
+	sh.m[key] = v
+	sh.Unlock()
+}
+
+// Save and Delete lock a receipt's shard before its hash's shard, never the
+// other way round. A record saved without StoredAt, e.g. one imported from
+// another store, is treated as stored now. A record replaced with one of a
+// different hash no longer answers to its old hash.
+func (s *memoryStore) Save(ctx context.Context, rec Record) error {
+	if rec.StoredAt.IsZero() {
+		rec.StoredAt = time.Now().UTC()
+	}
+	i := s.data.shard(rec.ID)
+	sh := &s.data[i]
+	sh.Lock()
+	if old, ok := sh.m[rec.ID]; ok && old.Hash != "" && old.Hash != rec.Hash {
+		hs := &s.hashes[s.hashes.shard(old.Hash)]
+		hs.Lock()
+		if hs.m[old.Hash] == rec.ID {
+			delete(hs.m, old.Hash)
+		}
+		hs.Unlock()
+	}
+	sh.m[rec.ID] = rec
+	if rec.Hash != "" {
+		s.hashes.set(rec.Hash, rec.ID)
+	}
+	var evicted []Record
+	if s.maxPerShard > 0 {
+		s.recency[i].touch(rec.ID)
+		for len(sh.m) > s.maxPerShard {
+			old, _ := s.remove(i, s.recency[i].oldest())
+			evicted = append(evicted, old)
+		}
+	}
+	sh.Unlock()
+	s.evicted(evicted)
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Record, error) {
+	var (
+		rec Record
+		ok  bool
+	)
+	if s.maxPerShard > 0 {
+		rec, ok = s.touch(id)
+	} else {
+		rec, ok = s.data.get(id)
+	}
+	if !ok {
+		return Record{}, errNotFound
+	}
+	return rec, nil
+}
+
+func (s *memoryStore) GetPoints(ctx context.Context, id string) (int, error) {
+	rec, err := s.Get(ctx, id)
+	return rec.Points, err
+}
+
+func (s *memoryStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	rec, err := s.Get(ctx, id)
+	return rec.Receipt, err
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	i := s.data.shard(id)
+	sh := &s.data[i]
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := s.remove(i, id); !ok {
+		return errNotFound
+	}
+	return nil
+}
+
+// remove deletes id, which belongs in shard i, with its hash. The caller
+// must hold the shard's lock.
+func (s *memoryStore) remove(i int, id string) (Record, bool) {
+	sh := &s.data[i]
+	rec, ok := sh.m[id]
+	if !ok {
+		return Record{}, false
+	}
+	delete(sh.m, id)
+	if s.maxPerShard > 0 {
+		s.recency[i].remove(id)
+	}
+	if rec.Hash != "" {
+		hs := &s.hashes[s.hashes.shard(rec.Hash)]
+		hs.Lock()
+		delete(hs.m, rec.Hash)
+		hs.Unlock()
+	}
+	return rec, true
+}
+
+func (s *memoryStore) List(ctx context.Context, opts ListOptions) ([]Record, int, error) {
+	var recs []Record
+	for i := range s.data {
+		sh := &s.data[i]
+		sh.RLock()
+		for _, rec := range sh.m {
+			if opts.match(rec) {
+				recs = append(recs, rec)
+			}
+		}
+		sh.RUnlock()
+	}
+	opts.sort(recs)
+	start, end := opts.page(len(recs))
+	return recs[start:end], len(recs), nil
+}
+
+func (s *memoryStore) FindByHash(ctx context.Context, hash string) (string, error) {
+	id, ok := s.hashes.get(hash)
+	if !ok {
+		return "", errNotFound
+	}
+	return id, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+const (
+	postgresConnectAttempts = 8
+	postgresMaxBackoff      = 10 * time.Second
+)
+
+func newPostgresStore(dsn string, maxConns int) (*sqlStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	db.SetConnMaxLifetime(30 * time.Minute)
+
+	if err := pingWithBackoff(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &sqlStore{db: db, dialect: "postgres"}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func pingWithBackoff(db *sql.DB) error {
+	delay := 250 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= postgresConnectAttempts; attempt++ {
+		if err = db.Ping(); err == nil {
+			return nil
+		}
+		slog.Warn("postgres unavailable", "attempt", attempt, "max_attempts", postgresConnectAttempts, "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, postgresMaxBackoff)
+	}
+	return err
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"receipt-processor/points"
+)
+
+// redisListChunk is how many records a filtered List fetches per MGET.
+const redisListChunk = 500
+
+// redisSaveAttempts is how many times Save starts over when another save
+// changes the receipt while it is being saved.
+const redisSaveAttempts = 10
+
+type redisStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func newRedisStore(url, prefix string, ttl time.Duration) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisStore{client: client, prefix: prefix, ttl: ttl}, nil
+}
+
+func (s *redisStore) key(id string) string {
+	return s.prefix + "receipt:" + id
+}
+
+// indexKey names the sorted set of IDs for one tenant, or for every tenant
+// when tenant is empty.
+func (s *redisStore) indexKey(tenant string) string {
+	if tenant == "" {
+		return s.prefix + "index"
+	}
+	return s.prefix + "index:" + tenant
+}
+
+func (s *redisStore) hashKey(hash string) string {
+	return s.prefix + "hash:" + hash
+}
+
+// tenantsKey names the set of tenants with an index, which List prunes
+// along with the index of every tenant.
+func (s *redisStore) tenantsKey() string {
+	return s.prefix + "tenants"
+}
+
+// Save stores rec and indexes it. A receipt saved over with a new hash, as
+// when it is corrected, has its old hash key deleted in the same
+// transaction, if the key still finds it, so that resubmitting the old
+// content does not find the corrected receipt. WATCH starts the save over
+// if another one changes the receipt or that key in between.
+func (s *redisStore) Save(ctx context.Context, rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	save := func(tx *redis.Tx) error {
+		staleHash, err := s.staleHash(ctx, tx, rec)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.key(rec.ID), data, s.ttl)
+			pipe.ZAdd(ctx, s.indexKey(""), redis.Z{Member: rec.ID})
+			if rec.Tenant != "" {
+				pipe.ZAdd(ctx, s.indexKey(rec.Tenant), redis.Z{Member: rec.ID})
+				pipe.SAdd(ctx, s.tenantsKey(), rec.Tenant)
+			}
+			if rec.Hash != "" {
+				pipe.Set(ctx, s.hashKey(rec.Hash), rec.ID, s.ttl)
+			}
+			if staleHash != "" {
+				pipe.Del(ctx, s.hashKey(staleHash))
+			}
+			return nil
+		})
+		return err
+	}
+	for range redisSaveAttempts {
+		err = s.client.Watch(ctx, save, s.key(rec.ID))
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
+
+// staleHash returns the hash the receipt rec replaces was stored with, if it
+// differs from rec's and its key still finds the receipt, and watches that
+// key.
+func (s *redisStore) staleHash(ctx context.Context, tx *redis.Tx, rec Record) (string, error) {
+	data, err := tx.Get(ctx, s.key(rec.ID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var old Record
+	if err := json.Unmarshal(data, &old); err != nil {
+		return "", err
+	}
+	if old.Hash == "" || old.Hash == rec.Hash {
+		return "", nil
+	}
+	if err := tx.Watch(ctx, s.hashKey(old.Hash)).Err(); err != nil {
+		return "", err
+	}
+	id, err := tx.Get(ctx, s.hashKey(old.Hash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil || id != rec.ID {
+		return "", err
+	}
+	return old.Hash, nil
+}
+
+func (s *redisStore) Get(ctx context.Context, id string) (Record, error) {
+	data, err := s.client.Get(ctx, s.key(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Record{}, errNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	var rec Record
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+func (s *redisStore) GetPoints(ctx context.Context, id string) (int, error) {
+	rec, err := s.Get(ctx, id)
+	return rec.Points, err
+}
+
+func (s *redisStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	rec, err := s.Get(ctx, id)
+	return rec.Receipt, err
+}
+
+func (s *redisStore) Delete(ctx context.Context, id string) error {
+	rec, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	var del *redis.IntCmd
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, s.key(id))
+		pipe.ZRem(ctx, s.indexKey(""), id)
+		if rec.Tenant != "" {
+			pipe.ZRem(ctx, s.indexKey(rec.Tenant), id)
+		}
+		if rec.Hash != "" {
+			pipe.Del(ctx, s.hashKey(rec.Hash))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if del.Val() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *redisStore) FindByHash(ctx context.Context, hash string) (string, error) {
+	id, err := s.client.Get(ctx, s.hashKey(hash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", errNotFound
+	}
+	return id, err
+}
+
+// List pages through the tenant's index of IDs, or every tenant's if opts
+// names none. IDs whose receipt has expired are dropped from the indexes as
+// they are found, so a page may come back short. Any filter or other order
+// has no index to use, so every receipt in the index is loaded, filtered and
+// sorted instead.
+func (s *redisStore) List(ctx context.Context, opts ListOptions) ([]Record, int, error) {
+	if opts.filtered() || (opts.Sort != "" && opts.Sort != sortID) || opts.Desc {
+		return s.listAll(ctx, opts)
+	}
+	total, err := s.client.ZCard(ctx, s.indexKey(opts.Tenant)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	start, end := opts.page(int(total))
+	if start == end {
+		return nil, int(total), nil
+	}
+	ids, err := s.client.ZRange(ctx, s.indexKey(opts.Tenant), int64(start), int64(end-1)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.key(id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var recs []Record
+	var expired []any
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return nil, 0, err
+		}
+		recs = append(recs, rec)
+	}
+	if len(expired) > 0 {
+		s.prune(ctx, opts.Tenant, expired)
+		total -= int64(len(expired))
+	}
+	return recs, int(total), nil
+}
+
+// prune drops the IDs of expired receipts from the index of all receipts
+// and from tenant's index, or, since the receipts' tenants expired with
+// them, from every tenant's index if tenant is empty. It is best effort:
+// IDs left behind are pruned when next found.
+func (s *redisStore) prune(ctx context.Context, tenant string, ids []any) {
+	tenants := []string{tenant}
+	if tenant == "" {
+		tenants, _ = s.client.SMembers(ctx, s.tenantsKey()).Result()
+	}
+	s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, s.indexKey(""), ids...)
+		for _, t := range tenants {
+			pipe.ZRem(ctx, s.indexKey(t), ids...)
+		}
+		return nil
+	})
+}
+
+func (s *redisStore) listAll(ctx context.Context, opts ListOptions) ([]Record, int, error) {
+	ids, err := s.client.ZRange(ctx, s.indexKey(opts.Tenant), 0, -1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	var recs []Record
+	var expired []any
+	for len(ids) > 0 {
+		chunk := ids[:min(len(ids), redisListChunk)]
+		ids = ids[len(chunk):]
+		keys := make([]string, len(chunk))
+		for i, id := range chunk {
+			keys[i] = s.key(id)
+		}
+		values, err := s.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, v := range values {
+			data, ok := v.(string)
+			if !ok {
+				expired = append(expired, chunk[i])
+				continue
+			}
+			var rec Record
+			if err := json.Unmarshal([]byte(data), &rec); err != nil {
+				return nil, 0, err
+			}
+			if opts.match(rec) {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	if len(expired) > 0 {
+		s.prune(ctx, opts.Tenant, expired)
+	}
+	opts.sort(recs)
+	start, end := opts.page(len(recs))
+	return recs[start:end], len(recs), nil
+}
+
+// ledgerKey names the sorted set of a user's transactions, scored by
+// creation time, and balanceKey the running total kept beside it. Ledger
+// keys never expire.
+func (s *redisStore) ledgerKey(tenant, userID string) string {
+	return s.prefix + "ledger:" + tenant + ":" + userID
+}
+
+func (s *redisStore) balanceKey(tenant, userID string) string {
+	return s.prefix + "balance:" + tenant + ":" + userID
+}
+
+func (s *redisStore) Append(ctx context.Context, tx Transaction) error {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, s.ledgerKey(tx.Tenant, tx.UserID), redis.Z{Score: float64(tx.CreatedAt.UnixMicro()), Member: data})
+		pipe.IncrBy(ctx, s.balanceKey(tx.Tenant, tx.UserID), int64(tx.Points))
+		return nil
+	})
+	return err
+}
+
+// redeemScript appends a transaction and adjusts the balance only if the
+// balance stays non-negative. It returns {1, balance} on success and
+// {0, balance} otherwise.
+var redeemScript = redis.NewScript(`
+local balance = tonumber(redis.call("GET", KEYS[2]) or "0")
+local points = tonumber(ARGV[3])
+if balance + points < 0 then
+	return {0, balance}
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+return {1, redis.call("INCRBY", KEYS[2], points)}
+`)
+
+func (s *redisStore) Redeem(ctx context.Context, tx Transaction) (int, error) {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{s.ledgerKey(tx.Tenant, tx.UserID), s.balanceKey(tx.Tenant, tx.UserID)}
+	res, err := redeemScript.Run(ctx, s.client, keys, tx.CreatedAt.UnixMicro(), data, tx.Points).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if res[0] == 0 {
+		return int(res[1]), errInsufficientPoints
+	}
+	return int(res[1]), nil
+}
+
+func (s *redisStore) Balance(ctx context.Context, tenant, userID string) (int, error) {
+	balance, err := s.client.Get(ctx, s.balanceKey(tenant, userID)).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// Accounts scans for ledger keys. User IDs cannot contain a colon, so the
+// last one in a key separates the tenant from the user.
+func (s *redisStore) Accounts(ctx context.Context) ([]Account, error) {
+	prefix := s.prefix + "ledger:"
+	var accounts []Account
+	iter := s.client.Scan(ctx, 0, prefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		rest := strings.TrimPrefix(iter.Val(), prefix)
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			continue
+		}
+		accounts = append(accounts, Account{Tenant: rest[:i], UserID: rest[i+1:]})
+	}
+	return accounts, iter.Err()
+}
+
+func (s *redisStore) DeleteAccount(ctx context.Context, tenant, userID string) (int, error) {
+	var count *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.ZCard(ctx, s.ledgerKey(tenant, userID))
+		pipe.Del(ctx, s.ledgerKey(tenant, userID), s.balanceKey(tenant, userID))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count.Val()), nil
+}
+
+func (s *redisStore) Transactions(ctx context.Context, tenant, userID string, opts ListOptions) ([]Transaction, int, error) {
+	key := s.ledgerKey(tenant, userID)
+	total, err := s.client.ZCard(ctx, key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	start, end := opts.page(int(total))
+	if start == end {
+		return nil, int(total), nil
+	}
+	values, err := s.client.ZRevRange(ctx, key, int64(start), int64(end-1)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	txs := make([]Transaction, len(values))
+	for i, v := range values {
+		if err := json.Unmarshal([]byte(v), &txs[i]); err != nil {
+			return nil, 0, err
+		}
+		txs[i].Tenant = tenant
+	}
+	return txs, int(total), nil
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
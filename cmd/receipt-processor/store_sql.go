@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"receipt-processor/points"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) Save(ctx context.Context, rec Record) error {
+	data, err := json.Marshal(rec.Receipt)
+	if err != nil {
+		return err
+	}
+	hash := sql.NullString{String: rec.Hash, Valid: rec.Hash != ""}
+	purchasedAt := sql.NullTime{Time: rec.PurchasedAt, Valid: !rec.PurchasedAt.IsZero()}
+	var history sql.NullString
+	if len(rec.History) > 0 {
+		data, err := json.Marshal(rec.History)
+		if err != nil {
+			return err
+		}
+		history = sql.NullString{String: string(data), Valid: true}
+	}
+	var metadata sql.NullString
+	if rec.Metadata != nil {
+		data, err := json.Marshal(rec.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = sql.NullString{String: string(data), Valid: true}
+	}
+	var campaigns sql.NullString
+	if len(rec.Campaigns) > 0 {
+		data, err := json.Marshal(rec.Campaigns)
+		if err != nil {
+			return err
+		}
+		campaigns = sql.NullString{String: string(data), Valid: true}
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`INSERT INTO receipts (`+recordColumns+`, retailer, purchase_date) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET receipt = excluded.receipt, points = excluded.points,
+			hash = excluded.hash, rule_version = excluded.rule_version, tenant = excluded.tenant,
+			user_id = excluded.user_id, purchased_at = excluded.purchased_at, history = excluded.history,
+			metadata = excluded.metadata, campaigns = excluded.campaigns, retailer = excluded.retailer,
+			purchase_date = excluded.purchase_date`),
+		rec.ID, string(data), rec.Points, hash, rec.RuleVersion, rec.Tenant, rec.UserID, purchasedAt, history, metadata,
+		campaigns, rec.Receipt.Retailer, rec.Receipt.PurchaseDate)
+	return err
+}
+
+const recordColumns = `id, receipt, points, hash, rule_version, tenant, user_id, purchased_at, history, metadata, campaigns`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRecord(row rowScanner) (Record, error) {
+	var rec Record
+	var data string
+	var hash sql.NullString
+	var purchasedAt sql.NullTime
+	var history, metadata, campaigns sql.NullString
+	if err := row.Scan(&rec.ID, &data, &rec.Points, &hash, &rec.RuleVersion, &rec.Tenant, &rec.UserID, &purchasedAt, &history, &metadata, &campaigns); err != nil {
+		return Record{}, err
+	}
+	rec.Hash = hash.String
+	if purchasedAt.Valid {
+		rec.PurchasedAt = purchasedAt.Time.UTC()
+	}
+	if history.Valid {
+		if err := json.Unmarshal([]byte(history.String), &rec.History); err != nil {
+			return Record{}, err
+		}
+	}
+	if metadata.Valid {
+		rec.Metadata = new(ReceiptMetadata)
+		if err := json.Unmarshal([]byte(metadata.String), rec.Metadata); err != nil {
+			return Record{}, err
+		}
+	}
+	if campaigns.Valid {
+		if err := json.Unmarshal([]byte(campaigns.String), &rec.Campaigns); err != nil {
+			return Record{}, err
+		}
+	}
+	err := json.Unmarshal([]byte(data), &rec.Receipt)
+	return rec, err
+}
+
+func (s *sqlStore) Get(ctx context.Context, id string) (Record, error) {
+	rec, err := scanRecord(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+recordColumns+` FROM receipts WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Record{}, errNotFound
+	}
+	return rec, err
+}
+
+func (s *sqlStore) GetPoints(ctx context.Context, id string) (int, error) {
+	var points int
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT points FROM receipts WHERE id = ?`), id).Scan(&points)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errNotFound
+	}
+	return points, err
+}
+
+func (s *sqlStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT receipt FROM receipts WHERE id = ?`), id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return points.Receipt{}, errNotFound
+	}
+	if err != nil {
+		return points.Receipt{}, err
+	}
+	var receipt points.Receipt
+	err = json.Unmarshal([]byte(data), &receipt)
+	return receipt, err
+}
+
+func (s *sqlStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM receipts WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// sortColumns maps ListOptions.Sort to the column it orders by.
+var sortColumns = map[string]string{
+	sortID:           "id",
+	sortPoints:       "points",
+	sortPurchaseDate: "purchase_date",
+	sortRetailer:     "retailer",
+}
+
+// likeEscaper escapes LIKE wildcards, with \ as the escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *sqlStore) List(ctx context.Context, opts ListOptions) ([]Record, int, error) {
+	var conds []string
+	var args []any
+	if opts.Tenant != "" {
+		conds, args = append(conds, `tenant = ?`), append(args, opts.Tenant)
+	}
+	if opts.Retailer != "" {
+		// Case is folded here but whitespace is not collapsed, so only
+		// names spelled with single spaces are found.
+		cond := `LOWER(retailer) LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(points.NormalizeRetailer(opts.Retailer))+"%")
+		if names := retailerAliases.variants(opts.Retailer); names != nil {
+			cond = `(` + cond + ` OR LOWER(retailer) IN (?` + strings.Repeat(`, ?`, len(names)-1) + `))`
+			for _, name := range names {
+				args = append(args, name)
+			}
+		}
+		conds = append(conds, cond)
+	}
+	if opts.UserID != "" {
+		conds, args = append(conds, `user_id = ?`), append(args, opts.UserID)
+	}
+	if opts.From != "" {
+		conds, args = append(conds, `purchase_date >= ?`), append(args, opts.From)
+	}
+	if opts.To != "" {
+		conds, args = append(conds, `purchase_date <= ?`), append(args, opts.To)
+	}
+	if opts.MinPoints != nil {
+		conds, args = append(conds, `points >= ?`), append(args, *opts.MinPoints)
+	}
+	if opts.MaxPoints != nil {
+		conds, args = append(conds, `points <= ?`), append(args, *opts.MaxPoints)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	dir := ""
+	if opts.Desc {
+		dir = ` DESC`
+	}
+	order := ` ORDER BY id` + dir
+	if col := sortColumns[opts.Sort]; col != "" && col != "id" {
+		order = ` ORDER BY ` + col + dir + `, id` + dir
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM receipts`+where), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+recordColumns+` FROM receipts`+where+order+` LIMIT ? OFFSET ?`),
+		append(args, limit, opts.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var recs []Record
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, total, rows.Err()
+}
+
+func (s *sqlStore) FindByHash(ctx context.Context, hash string) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT id FROM receipts WHERE hash = ?`), hash).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errNotFound
+	}
+	return id, err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlStore) Append(ctx context.Context, tx Transaction) error {
+	return s.appendTransaction(ctx, s.db, tx)
+}
+
+func (s *sqlStore) appendTransaction(ctx context.Context, db execer, tx Transaction) error {
+	receiptID := sql.NullString{String: tx.ReceiptID, Valid: tx.ReceiptID != ""}
+	reference := sql.NullString{String: tx.Reference, Valid: tx.Reference != ""}
+	var expiresAt sql.NullTime
+	if tx.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *tx.ExpiresAt, Valid: true}
+	}
+	_, err := db.ExecContext(ctx, s.rebind(`INSERT INTO ledger (`+transactionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		tx.ID, tx.Tenant, tx.UserID, tx.Kind, tx.Points, receiptID, reference, expiresAt, tx.CreatedAt)
+	return err
+}
+
+const transactionColumns = `id, tenant, user_id, kind, points, receipt_id, reference, expires_at, created_at`
+
+func (s *sqlStore) Balance(ctx context.Context, tenant, userID string) (int, error) {
+	return s.balance(ctx, s.db, tenant, userID)
+}
+
+func (s *sqlStore) balance(ctx context.Context, db execer, tenant, userID string) (int, error) {
+	var balance int
+	err := db.QueryRowContext(ctx, s.rebind(`SELECT COALESCE(SUM(points), 0) FROM ledger WHERE tenant = ? AND user_id = ?`),
+		tenant, userID).Scan(&balance)
+	return balance, err
+}
+
+// Redeem checks the balance and appends tx in one database transaction. On
+// postgres an advisory lock held until commit serializes redemptions for the
+// same user; sqlite has a single connection, which already does.
+func (s *sqlStore) Redeem(ctx context.Context, tx Transaction) (int, error) {
+	dbtx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer dbtx.Rollback()
+
+	if s.dialect == "postgres" {
+		if _, err := dbtx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, ledgerKey(tx.Tenant, tx.UserID)); err != nil {
+			return 0, err
+		}
+	}
+	balance, err := s.balance(ctx, dbtx, tx.Tenant, tx.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if balance+tx.Points < 0 {
+		return balance, errInsufficientPoints
+	}
+	if err := s.appendTransaction(ctx, dbtx, tx); err != nil {
+		return 0, err
+	}
+	return balance + tx.Points, dbtx.Commit()
+}
+
+func (s *sqlStore) Accounts(ctx context.Context) ([]Account, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT tenant, user_id FROM ledger`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var a Account
+		if err := rows.Scan(&a.Tenant, &a.UserID); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *sqlStore) DeleteAccount(ctx context.Context, tenant, userID string) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM ledger WHERE tenant = ? AND user_id = ?`), tenant, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqlStore) Transactions(ctx context.Context, tenant, userID string, opts ListOptions) ([]Transaction, int, error) {
+	var total int
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM ledger WHERE tenant = ? AND user_id = ?`),
+		tenant, userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+transactionColumns+` FROM ledger WHERE tenant = ? AND user_id = ?
+		ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`), tenant, userID, limit, opts.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var txs []Transaction
+	for rows.Next() {
+		var tx Transaction
+		var receiptID, reference sql.NullString
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&tx.ID, &tx.Tenant, &tx.UserID, &tx.Kind, &tx.Points, &receiptID, &reference, &expiresAt, &tx.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		tx.ReceiptID = receiptID.String
+		tx.Reference = reference.String
+		if expiresAt.Valid {
+			t := expiresAt.Time.UTC()
+			tx.ExpiresAt = &t
+		}
+		tx.CreatedAt = tx.CreatedAt.UTC()
+		txs = append(txs, tx)
+	}
+	return txs, total, rows.Err()
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies the migrations not yet recorded in schema_migrations. On
+// postgres an advisory lock held for the duration keeps instances started
+// together from applying the same migration twice; sqlite has a single
+// connection, which already does.
+func (s *sqlStore) migrate() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.dialect == "postgres" {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1))`, "schema_migrations"); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, "schema_migrations")
+	}
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version TEXT PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrations, path.Join("migrations", s.dialect, "*.sql"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := path.Base(name)
+		var applied int
+		if err := conn.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+
+		body, err := migrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		if _, err := tx.Exec(s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
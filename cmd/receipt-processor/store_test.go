@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// mutexStore is the memory store as it was before it was sharded: one map
+// behind one lock, kept to benchmark the sharded store against.
+type mutexStore struct {
+	mu   sync.RWMutex
+	data map[string]Record
+}
+
+func (s *mutexStore) Save(ctx context.Context, rec Record) error {
+	s.mu.Lock()
+	s.data[rec.ID] = rec
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *mutexStore) Get(ctx context.Context, id string) (Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.data[id]
+	if !ok {
+		return Record{}, errNotFound
+	}
+	return rec, nil
+}
+
+// recordStore is the part of Store the benchmark exercises.
+type recordStore interface {
+	Save(ctx context.Context, rec Record) error
+	Get(ctx context.Context, id string) (Record, error)
+}
+
+// BenchmarkMemoryStore runs parallel Gets and Saves, one Save in every
+// tenth call, against the sharded memory store, with and without
+// --max-receipts (whose LRU write-locks a shard on every Get), and against
+// a single map behind one lock.
+func BenchmarkMemoryStore(b *testing.B) {
+	const receipts = 10000
+	stores := []struct {
+		name string
+		new  func() recordStore
+	}{
+		{"mutex", func() recordStore {
+			return &mutexStore{data: make(map[string]Record)}
+		}},
+		{"sharded", func() recordStore {
+			return newMemoryStore(0)
+		}},
+		{"sharded-lru", func() recordStore {
+			return newMemoryStore(2 * receipts)
+		}},
+	}
+	ids := make([]string, receipts)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	ctx := context.Background()
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			s := st.new()
+			for _, id := range ids {
+				s.Save(ctx, Record{ID: id, Points: 1})
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				for n := 0; pb.Next(); n++ {
+					id := ids[rng.IntN(receipts)]
+					if n%10 == 0 {
+						s.Save(ctx, Record{ID: id, Points: n})
+					} else if _, err := s.Get(ctx, id); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// feedBuffer is how many events a subscriber may fall behind by before
+	// it is disconnected.
+	feedBuffer = 64
+	// feedHistory is how many recent events are kept for subscribers
+	// resuming after a disconnect.
+	feedHistory = 1000
+	// streamKeepAlive is how often an idle stream sends a comment so that
+	// proxies do not time it out.
+	streamKeepAlive = 15 * time.Second
+)
+
+// feedEvent is a receiptEvent numbered in the order it was published.
+type feedEvent struct {
+	ID uint64 `json:"id"`
+	receiptEvent
+}
+
+// feedFilter selects the events a subscriber sees: its tenant's, and if
+// retailer is set only those from that retailer.
+type feedFilter struct {
+	tenant   string
+	retailer string
+}
+
+func (f feedFilter) match(e receiptEvent) bool {
+	return e.Tenant == f.tenant && (f.retailer == "" || retailerKey(e.Retailer) == retailerKey(f.retailer))
+}
+
+// feed fans newly processed receipts out to live subscribers in this
+// process. A subscriber that cannot keep up is dropped rather than slowing
+// down processing. Event IDs restart from 1 with the process.
+type feed struct {
+	mu      sync.Mutex
+	seq     uint64
+	history []feedEvent
+	subs    map[chan feedEvent]feedFilter
+	closed  bool
+}
+
+var live = &feed{subs: make(map[chan feedEvent]feedFilter)}
+
+func (f *feed) publish(e receiptEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	fe := feedEvent{f.seq, e}
+	if len(f.history) == feedHistory {
+		f.history = f.history[1:]
+	}
+	f.history = append(f.history, fe)
+	for ch, filter := range f.subs {
+		if !filter.match(e) {
+			continue
+		}
+		select {
+		case ch <- fe:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the retained events after lastID that match filter, and
+// a channel of those published from now on, which is closed when the
+// subscriber falls too far behind or the feed is closed. A lastID of 0, or
+// one this process never issued, replays nothing. The channel is nil if the
+// feed is already closed.
+func (f *feed) subscribe(filter feedFilter, lastID uint64) ([]feedEvent, chan feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, nil
+	}
+	var missed []feedEvent
+	if lastID > 0 && lastID < f.seq {
+		for _, e := range f.history {
+			if e.ID > lastID && filter.match(e.receiptEvent) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	ch := make(chan feedEvent, feedBuffer)
+	f.subs[ch] = filter
+	return missed, ch
+}
+
+func (f *feed) unsubscribe(ch chan feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every subscription, so that streams finish before shutdown.
+func (f *feed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// feedRequest reads the filter and resume cursor shared by the streaming
+// endpoints. The cursor comes from the Last-Event-ID header, which
+// EventSource sends when it reconnects, or the lastEventId parameter.
+func feedRequest(r *http.Request) (feedFilter, uint64, error) {
+	tenant, _ := tenantFrom(r.Context())
+	filter := feedFilter{tenant: tenant, retailer: r.URL.Query().Get("retailer")}
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("lastEventId")
+	}
+	if cursor == "" {
+		return filter, 0, nil
+	}
+	lastID, err := strconv.ParseUint(cursor, 10, 64)
+	return filter, lastID, err
+}
+
+// streamReceiptsHandler sends a Server-Sent Event for each receipt the
+// caller's tenant processes from now on, or since the given event ID.
+func streamReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, lastID, err := feedRequest(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The last event ID must be a non-negative integer.")
+		return
+	}
+	missed, ch := live.subscribe(filter, lastID)
+	if ch == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, "The server is shutting down.")
+		return
+	}
+	defer live.unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	// The stream outlives --write-timeout and --request-timeout.
+	rc.SetWriteDeadline(time.Time{})
+	liftDeadline(r.Context())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(e feedEvent) error {
+		data, err := json.Marshal(e.receiptEvent)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, data)
+		return err
+	}
+	for _, e := range missed {
+		if err := writeEvent(e); err != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeEvent(e); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
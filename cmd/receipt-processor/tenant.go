@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"receipt-processor/points"
+)
+
+const defaultTenant = "default"
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+var (
+	errUnauthorized  = errors.New("a valid API key is required")
+	errInvalidTenant = errors.New("invalid tenant ID")
+)
+
+type tenantKey struct{}
+
+// tenantResolver works out which tenant a request belongs to. With API keys
+// configured the key decides; otherwise the tenant header does, falling back
+// to the default tenant.
+type tenantResolver struct {
+	header  string
+	apiKeys map[string]string
+}
+
+var tenancy = tenantResolver{header: "X-Tenant-ID"}
+
+func loadAPIKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("api keys file %s: %w", path, err)
+	}
+	for key, tenant := range keys {
+		if key == "" || !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("api keys file %s: invalid entry for tenant %q", path, tenant)
+		}
+	}
+	return keys, nil
+}
+
+// resolve maps the API key and claimed tenant sent by a caller to the
+// tenant it may act as.
+func (t tenantResolver) resolve(apiKey, claimed string) (string, error) {
+	if t.apiKeys != nil {
+		tenant, ok := t.apiKeys[apiKey]
+		if !ok {
+			return "", errUnauthorized
+		}
+		return tenant, nil
+	}
+	if claimed == "" {
+		return defaultTenant, nil
+	}
+	if !tenantPattern.MatchString(claimed) {
+		return "", errInvalidTenant
+	}
+	return claimed, nil
+}
+
+func withTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// allTenants returns ctx without its tenant, for store calls that must see
+// every tenant's records, such as checking whether an ID is taken.
+func allTenants(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantKey{}, nil)
+}
+
+// withTenant scopes every store call made by h to the caller's tenant.
+func withTenant(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenancy.resolve(r.Header.Get("X-API-Key"), r.Header.Get(tenancy.header))
+		switch {
+		case errors.Is(err, errUnauthorized):
+			writeProblem(w, r, http.StatusUnauthorized, "A valid API key is required.")
+			return
+		case err != nil:
+			writeProblem(w, r, http.StatusBadRequest, "The tenant ID is invalid.")
+			return
+		}
+		ctx := withActor(withTenantContext(r.Context(), tenant), keyActor(r.Header.Get("X-API-Key")))
+		h(w, r.WithContext(ctx))
+	})
+}
+
+// tenantFrom reports the tenant a context is scoped to. Contexts without a
+// tenant, such as admin requests, see every tenant's receipts.
+func tenantFrom(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// tenantStore partitions the underlying store by the tenant carried in the
+// request context. Records belonging to another tenant behave as missing.
+type tenantStore struct {
+	next Store
+}
+
+// errTenantConflict is returned for a save under an ID that another
+// tenant's receipt is stored under, which would otherwise be overwritten.
+var errTenantConflict = errors.New("ID belongs to another tenant's receipt")
+
+func (s tenantStore) Save(ctx context.Context, rec Record) error {
+	if tenant, ok := tenantFrom(ctx); ok {
+		existing, err := s.next.Get(ctx, rec.ID)
+		switch {
+		case err == nil && existing.Tenant != tenant:
+			return errTenantConflict
+		case err != nil && !errors.Is(err, errNotFound):
+			return err
+		}
+		rec.Tenant = tenant
+	}
+	return s.next.Save(ctx, rec)
+}
+
+func (s tenantStore) Get(ctx context.Context, id string) (Record, error) {
+	rec, err := s.next.Get(ctx, id)
+	if err != nil {
+		return Record{}, err
+	}
+	if tenant, ok := tenantFrom(ctx); ok && rec.Tenant != tenant {
+		return Record{}, errNotFound
+	}
+	return rec, nil
+}
+
+func (s tenantStore) GetPoints(ctx context.Context, id string) (int, error) {
+	if _, ok := tenantFrom(ctx); !ok {
+		return s.next.GetPoints(ctx, id)
+	}
+	rec, err := s.Get(ctx, id)
+	return rec.Points, err
+}
+
+func (s tenantStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	if _, ok := tenantFrom(ctx); !ok {
+		return s.next.GetReceipt(ctx, id)
+	}
+	rec, err := s.Get(ctx, id)
+	return rec.Receipt, err
+}
+
+func (s tenantStore) Delete(ctx context.Context, id string) error {
+	if _, ok := tenantFrom(ctx); ok {
+		if _, err := s.Get(ctx, id); err != nil {
+			return err
+		}
+	}
+	return s.next.Delete(ctx, id)
+}
+
+func (s tenantStore) List(ctx context.Context, opts ListOptions) ([]Record, int, error) {
+	if tenant, ok := tenantFrom(ctx); ok {
+		opts.Tenant = tenant
+	}
+	return s.next.List(ctx, opts)
+}
+
+func (s tenantStore) FindByHash(ctx context.Context, hash string) (string, error) {
+	id, err := s.next.FindByHash(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.Get(ctx, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s tenantStore) Ping(ctx context.Context) error {
+	return s.next.Ping(ctx)
+}
+
+func (s tenantStore) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"receipt-processor/points"
+)
+
+// TestTenantStoreIsolation checks that a tenant can neither read, find,
+// list, delete nor overwrite another tenant's receipt.
+func TestTenantStoreIsolation(t *testing.T) {
+	s := tenantStore{newMemoryStore(0)}
+	acme := withTenantContext(context.Background(), "acme")
+	globex := withTenantContext(context.Background(), "globex")
+
+	rec := Record{ID: "r1", Receipt: points.Receipt{Retailer: "Target", Total: "20.00"}, Points: 95, Hash: "h1"}
+	if err := s.Save(acme, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(globex, "r1"); !errors.Is(err, errNotFound) {
+		t.Errorf("Get from another tenant: err = %v, want errNotFound", err)
+	}
+	if _, err := s.GetPoints(globex, "r1"); !errors.Is(err, errNotFound) {
+		t.Errorf("GetPoints from another tenant: err = %v, want errNotFound", err)
+	}
+	if _, err := s.GetReceipt(globex, "r1"); !errors.Is(err, errNotFound) {
+		t.Errorf("GetReceipt from another tenant: err = %v, want errNotFound", err)
+	}
+	if _, err := s.FindByHash(globex, "h1"); !errors.Is(err, errNotFound) {
+		t.Errorf("FindByHash from another tenant: err = %v, want errNotFound", err)
+	}
+	if recs, total, err := s.List(globex, ListOptions{Limit: 10}); err != nil || total != 0 || len(recs) != 0 {
+		t.Errorf("List from another tenant = %d records of %d, %v; want none", len(recs), total, err)
+	}
+	if err := s.Delete(globex, "r1"); !errors.Is(err, errNotFound) {
+		t.Errorf("Delete from another tenant: err = %v, want errNotFound", err)
+	}
+
+	overwrite := Record{ID: "r1", Receipt: points.Receipt{Retailer: "Walmart", Total: "1.00"}, Points: 5}
+	if err := s.Save(globex, overwrite); !errors.Is(err, errTenantConflict) {
+		t.Errorf("Save over another tenant's receipt: err = %v, want errTenantConflict", err)
+	}
+
+	got, err := s.Get(acme, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tenant != "acme" || got.Points != 95 || got.Receipt.Retailer != "Target" {
+		t.Errorf("owner's receipt = %+v, want it unchanged", got)
+	}
+	if err := s.Save(acme, Record{ID: "r1", Receipt: got.Receipt, Points: 100}); err != nil {
+		t.Errorf("owner's Save: %v", err)
+	}
+}
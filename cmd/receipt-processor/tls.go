@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type tlsConfig struct {
+	CertFile string
+	KeyFile  string
+	ClientCA string
+
+	AutocertDomains  string
+	AutocertCacheDir string
+	AutocertEmail    string
+
+	RedirectAddr string
+}
+
+func (c tlsConfig) enabled() bool {
+	return c.CertFile != "" || c.AutocertDomains != ""
+}
+
+// keyPair serves the certificate from --tls-cert and --tls-key, reloaded
+// with the rest of the configuration so that renewed certificates are
+// picked up without a restart.
+type keyPair struct {
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+func (k *keyPair) read() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (k *keyPair) set(cert *tls.Certificate) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cert = cert
+}
+
+func (k *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cert, nil
+}
+
+// newTLS returns the TLS configuration for the API listener, and the handler
+// for the plain HTTP listener on --redirect-addr: it redirects to HTTPS and,
+// with autocert, answers Let's Encrypt's HTTP-01 challenges. With a client
+// CA bundle, every client must present a certificate it signed.
+func newTLS(c tlsConfig, httpsAddr string) (*tls.Config, http.Handler, error) {
+	var (
+		cfg      *tls.Config
+		redirect = redirectToHTTPS(httpsAddr)
+	)
+	if c.AutocertDomains != "" {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(c.AutocertDomains, ",")...),
+			Cache:      autocert.DirCache(c.AutocertCacheDir),
+			Email:      c.AutocertEmail,
+		}
+		cfg, redirect = m.TLSConfig(), m.HTTPHandler(redirect)
+	} else {
+		k := &keyPair{certFile: c.CertFile, keyFile: c.KeyFile}
+		cert, err := k.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		k.set(cert)
+		reloader.keyPair = k
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: k.getCertificate}
+	}
+
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, redirect, nil
+}
+
+// clientCN returns the common name of the verified client certificate r was
+// sent with, if any.
+func clientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// grpcClientCN is clientCN for a gRPC call's context.
+func grpcClientCN(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// redirectToHTTPS redirects every request to the same URL over HTTPS on the
+// port of httpsAddr.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"receipt-processor/receiptpb"
+)
+
+// testCert issues a certificate for cn, signed by parent, or self-signed if
+// parent is nil.
+func testCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGRPCMutualTLS checks that with --tls-client-ca the gRPC listener
+// refuses clients without a certificate the CA signed, and counts calls
+// from those with one by their common name.
+func TestGRPCMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := testCert(t, "test CA", nil)
+	server := testCert(t, "localhost", &ca)
+	client := testCert(t, "billing-service", &ca)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Certificate[0])
+	writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", server.Certificate[0])
+	key, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "key.pem"), "PRIVATE KEY", key)
+
+	tlsCfg, _, err := newTLS(tlsConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+	}, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newGRPCServer(0, tlsCfg)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	call := func(t *testing.T, creds credentials.TransportCredentials) error {
+		t.Helper()
+		conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = receiptpb.NewReceiptProcessorClient(conn).GetPoints(ctx, &receiptpb.GetPointsRequest{Id: "missing"})
+		return err
+	}
+
+	t.Run("no certificate", func(t *testing.T) {
+		err := call(t, credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: "localhost"}))
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("err = %v, want the handshake to fail", err)
+		}
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		if err := call(t, insecure.NewCredentials()); status.Code(err) != codes.Unavailable {
+			t.Errorf("err = %v, want the connection to fail", err)
+		}
+	})
+	t.Run("client certificate", func(t *testing.T) {
+		before := testutil.ToFloat64(clientRequests.WithLabelValues("billing-service", codes.NotFound.String()))
+		err := call(t, credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{client}}))
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("err = %v, want NotFound", err)
+		}
+		after := testutil.ToFloat64(clientRequests.WithLabelValues("billing-service", codes.NotFound.String()))
+		if after != before+1 {
+			t.Errorf("client_requests_total{client=billing-service} went from %v to %v, want one more", before, after)
+		}
+	})
+}
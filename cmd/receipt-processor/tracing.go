@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"receipt-processor/points"
+)
+
+var tracer = otel.Tracer("receipt-processor")
+
+// setupTracing installs an OTLP/HTTP exporter when one of the standard
+// OTEL_EXPORTER_OTLP_* endpoint variables is set; otherwise tracing stays a
+// no-op. The exporter reads the rest of its settings from the environment.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "receipt-processor")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+func traceHTTP(next http.Handler) http.Handler {
+	withClient := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cn := clientCN(r); cn != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("tls.client.common_name", cn))
+		}
+		next.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(withClient, "receipt-processor",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeLabel(r.URL.Path)
+		}))
+}
+
+type tracedStore struct {
+	next Store
+}
+
+func startStoreSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "store."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != errNotFound && err != errInsufficientPoints {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s tracedStore) Save(ctx context.Context, rec Record) error {
+	ctx, span := startStoreSpan(ctx, "Save", attribute.String("receipt.id", rec.ID))
+	err := s.next.Save(ctx, rec)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStore) Get(ctx context.Context, id string) (Record, error) {
+	ctx, span := startStoreSpan(ctx, "Get", attribute.String("receipt.id", id))
+	rec, err := s.next.Get(ctx, id)
+	endSpan(span, err)
+	return rec, err
+}
+
+func (s tracedStore) GetPoints(ctx context.Context, id string) (int, error) {
+	ctx, span := startStoreSpan(ctx, "GetPoints", attribute.String("receipt.id", id))
+	points, err := s.next.GetPoints(ctx, id)
+	endSpan(span, err)
+	return points, err
+}
+
+func (s tracedStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	ctx, span := startStoreSpan(ctx, "GetReceipt", attribute.String("receipt.id", id))
+	receipt, err := s.next.GetReceipt(ctx, id)
+	endSpan(span, err)
+	return receipt, err
+}
+
+func (s tracedStore) Delete(ctx context.Context, id string) error {
+	ctx, span := startStoreSpan(ctx, "Delete", attribute.String("receipt.id", id))
+	err := s.next.Delete(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStore) List(ctx context.Context, opts ListOptions) ([]Record, int, error) {
+	ctx, span := startStoreSpan(ctx, "List", attribute.Int("list.limit", opts.Limit), attribute.Int("list.offset", opts.Offset))
+	recs, total, err := s.next.List(ctx, opts)
+	endSpan(span, err)
+	return recs, total, err
+}
+
+func (s tracedStore) FindByHash(ctx context.Context, hash string) (string, error) {
+	ctx, span := startStoreSpan(ctx, "FindByHash")
+	id, err := s.next.FindByHash(ctx, hash)
+	endSpan(span, err)
+	return id, err
+}
+
+func (s tracedStore) Ping(ctx context.Context) error {
+	ctx, span := startStoreSpan(ctx, "Ping")
+	err := s.next.Ping(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStore) Close() error {
+	return s.next.Close()
+}
+
+type tracedLedger struct {
+	next Ledger
+}
+
+func (l tracedLedger) Append(ctx context.Context, tx Transaction) error {
+	ctx, span := startStoreSpan(ctx, "Ledger.Append", attribute.String("transaction.kind", tx.Kind))
+	err := l.next.Append(ctx, tx)
+	endSpan(span, err)
+	return err
+}
+
+func (l tracedLedger) Balance(ctx context.Context, tenant, userID string) (int, error) {
+	ctx, span := startStoreSpan(ctx, "Ledger.Balance")
+	balance, err := l.next.Balance(ctx, tenant, userID)
+	endSpan(span, err)
+	return balance, err
+}
+
+func (l tracedLedger) Redeem(ctx context.Context, tx Transaction) (int, error) {
+	ctx, span := startStoreSpan(ctx, "Ledger.Redeem")
+	balance, err := l.next.Redeem(ctx, tx)
+	endSpan(span, err)
+	return balance, err
+}
+
+func (l tracedLedger) Accounts(ctx context.Context) ([]Account, error) {
+	ctx, span := startStoreSpan(ctx, "Ledger.Accounts")
+	accounts, err := l.next.Accounts(ctx)
+	endSpan(span, err)
+	return accounts, err
+}
+
+func (l tracedLedger) DeleteAccount(ctx context.Context, tenant, userID string) (int, error) {
+	ctx, span := startStoreSpan(ctx, "Ledger.DeleteAccount")
+	n, err := l.next.DeleteAccount(ctx, tenant, userID)
+	endSpan(span, err)
+	return n, err
+}
+
+func (l tracedLedger) Transactions(ctx context.Context, tenant, userID string, opts ListOptions) ([]Transaction, int, error) {
+	ctx, span := startStoreSpan(ctx, "Ledger.Transactions", attribute.Int("list.limit", opts.Limit), attribute.Int("list.offset", opts.Offset))
+	txs, total, err := l.next.Transactions(ctx, tenant, userID, opts)
+	endSpan(span, err)
+	return txs, total, err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"receipt-processor/points"
+)
+
+var (
+	// errRefundCorrection is returned for a correction of a refund, or one
+	// that would turn a receipt into a refund, whose points depend on the
+	// receipt it refunds.
+	errRefundCorrection = errors.New("refunds cannot be corrected")
+	// errDuplicateCorrection is returned in dedup mode for a correction
+	// identical to another stored receipt.
+	errDuplicateCorrection = errors.New("correction duplicates another receipt")
+)
+
+// correctionLocks serializes corrections of the same receipt, so that two at
+// once cannot both replace the same version. They are held per instance.
+var correctionLocks [memoryShards]sync.Mutex
+
+// updateReceiptHandler serves PUT /receipts/{id}, which replaces a receipt,
+// e.g. after its text was misread, and rescores it.
+func updateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var sub submission
+	if err := decodeJSON(r.Body, &sub, strict); err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeDecodeError(w, r, err, "")
+			return
+		}
+		writeInvalidReceipt(w, r, err)
+		return
+	}
+
+	id := receiptID(r)
+	var (
+		rec Record
+		err error
+	)
+	if qerr := ingest.do(r.Context(), func(ctx context.Context) {
+		rec, err = correctReceipt(ctx, id, sub.Receipt, sub.UserID)
+	}); qerr != nil {
+		writeIngestError(w, r, qerr)
+		return
+	}
+	switch {
+	case errors.Is(err, errNotFound):
+		writeProblem(w, r, http.StatusNotFound, "No receipt found for that ID.")
+		return
+	case errors.Is(err, points.ErrInvalidReceipt):
+		writeInvalidReceipt(w, r, err)
+		return
+	case errors.Is(err, errRefundCorrection):
+		writeProblem(w, r, http.StatusUnprocessableEntity, "Refunds cannot be corrected; delete the refund and submit it again.")
+		return
+	case errors.Is(err, errDuplicateCorrection):
+		writeProblem(w, r, http.StatusConflict, "An identical receipt has already been submitted.")
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "correcting receipt failed", "error", err, "receipt_id", id)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to store receipt.")
+		return
+	}
+
+	results, err := evaluateRecord(rec)
+	if err != nil {
+		slog.WarnContext(r.Context(), "breakdown of corrected receipt failed", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(processResponse{ID: rec.ID, Points: &rec.Points, RuleVersion: rec.RuleVersion, Breakdown: results})
+}
+
+// correctReceipt replaces the receipt stored under id with receipt, scores
+// it with the rules now in effect, and adjusts its user's balance by the
+// change in points. The replaced version is kept in the record's history,
+// and replacing a receipt with the same receipt changes nothing. The receipt
+// stays with the user it was submitted for; userID, if set, must name that
+// user. Corrections are not run through the fraud checks or velocity limits,
+// which the receipt passed when it was first submitted.
+func correctReceipt(ctx context.Context, id string, receipt points.Receipt, userID string) (Record, error) {
+	if ctx.Err() != nil {
+		return Record{}, context.Cause(ctx)
+	}
+	receipt, err := validateSubmission(receipt, userID)
+	if err != nil {
+		return Record{}, err
+	}
+
+	mu := &correctionLocks[shardOf(id)]
+	mu.Lock()
+	defer mu.Unlock()
+	old, err := store.Get(ctx, id)
+	if err != nil {
+		return Record{}, err
+	}
+	if old.RuleVersion == refundRuleVersion || receipt.IsRefund() {
+		return Record{}, errRefundCorrection
+	}
+	if userID != "" && userID != old.UserID {
+		validationFailures.Inc()
+		return Record{}, &points.ValidationError{Fields: []points.FieldError{{Field: "userId", Message: "must be the user the receipt was submitted for"}}}
+	}
+	if receiptHash(old.Tenant, receipt) == receiptHash(old.Tenant, old.Receipt) {
+		// Nothing to correct, as when a client retries.
+		return old, nil
+	}
+
+	rec := old
+	rec.Receipt = receipt
+	rec.PurchasedAt = time.Time{}
+	if at, err := receipt.PurchasedAt(); err == nil {
+		rec.PurchasedAt = at.UTC()
+	}
+	if dedup {
+		rec.Hash = receiptHash(old.Tenant, receipt)
+		mu := &hashLocks[shardOf(rec.Hash)]
+		mu.Lock()
+		defer mu.Unlock()
+		other, err := store.FindByHash(ctx, rec.Hash)
+		if err == nil && other != id {
+			if existing, err := store.Get(ctx, other); err == nil && existing.Hash == rec.Hash {
+				return Record{}, errDuplicateCorrection
+			}
+		} else if err != nil && !errors.Is(err, errNotFound) {
+			return Record{}, err
+		}
+	}
+	if err := scoreRecord(&rec); err != nil {
+		if errors.Is(err, points.ErrInvalidReceipt) {
+			validationFailures.Inc()
+		}
+		return Record{}, err
+	}
+	rec.History = append(slices.Clone(old.History), ReceiptVersion{
+		Version:     len(old.History) + 1,
+		Receipt:     old.Receipt,
+		Points:      old.Points,
+		RuleVersion: old.RuleVersion,
+		ReplacedAt:  time.Now().UTC(),
+	})
+	if ctx.Err() != nil {
+		return Record{}, context.Cause(ctx)
+	}
+
+	ctx, cancel := commitContext(ctx)
+	defer cancel()
+	if err := store.Save(ctx, rec); err != nil {
+		return Record{}, err
+	}
+	change := rec.Points - old.Points
+	leaderboard.record(rec, change)
+	stats.remove(old)
+	stats.add(rec)
+	audit.record(ctx, auditEntry{Action: auditReceiptCorrected, Tenant: rec.Tenant, Target: rec.ID,
+		Details: map[string]any{"points": rec.Points, "previousPoints": old.Points, "ruleVersion": rec.RuleVersion}})
+	return rec, recordTransaction(ctx, rec, txAdjustment, change)
+}
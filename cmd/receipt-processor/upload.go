@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"receipt-processor/points"
+	"receipt-processor/receipttext"
+)
+
+// uploadReceiptHandler serves POST /receipts/upload, a multipart form with a
+// photo, scan or PDF of a receipt in its file field and an optional userId.
+// The text is taken from a PDF's text layer if it has one and read by the
+// OCR provider otherwise, then parsed and scored like a submitted receipt;
+// the response has the parsed receipt as well as the ID and points.
+func uploadReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeDecodeError(w, r, err, "The request must be a multipart form with the image in a file field.")
+		return
+	}
+	defer file.Close()
+	image, err := io.ReadAll(file)
+	if err != nil {
+		writeDecodeError(w, r, err, "The image could not be read.")
+		return
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(image), ";")
+	switch contentType {
+	case "image/jpeg", "image/png", "application/pdf":
+	default:
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "The file must be a JPEG, PNG or PDF.")
+		return
+	}
+
+	var text string
+	if contentType == "application/pdf" {
+		// A PDF without a readable text layer is left to OCR.
+		text, _ = receipttext.PDFText(image)
+	}
+	if text == "" {
+		if ocr == nil {
+			writeProblem(w, r, http.StatusNotImplemented, "Uploads of images and scanned PDFs are not enabled on this server.")
+			return
+		}
+		text, err = ocr.Recognize(r.Context(), image, contentType)
+		if errors.Is(err, errUnsupportedImage) {
+			writeProblem(w, r, http.StatusUnsupportedMediaType, "The OCR provider cannot read this type of file.")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "OCR failed", "error", err)
+			writeProblem(w, r, http.StatusBadGateway, "The image could not be read.")
+			return
+		}
+	}
+	receipt, err := receipttext.Parse(text)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "No receipt was found in the image.")
+		return
+	}
+	scoreParsedReceipt(w, r, receipt, r.FormValue("userId"))
+}
+
+// scoreParsedReceipt processes a receipt read from an upload and responds
+// with it, its ID and its points.
+func scoreParsedReceipt(w http.ResponseWriter, r *http.Request, receipt points.Receipt, userID string) {
+	var (
+		rec       Record
+		duplicate bool
+		err       error
+	)
+	if qerr := ingest.do(r.Context(), func(ctx context.Context) {
+		rec, duplicate, err = processReceipt(ctx, receipt, userID)
+	}); qerr != nil {
+		writeIngestError(w, r, qerr)
+		return
+	}
+	if errors.Is(err, points.ErrInvalidReceipt) {
+		p := newProblem(r, http.StatusBadRequest, "The receipt that was read is invalid. Please verify input.")
+		var v *points.ValidationError
+		if errors.As(err, &v) {
+			p.Errors = v.Fields
+		}
+		p.Receipt = &receipt
+		p.write(w)
+		return
+	}
+	if errors.Is(err, errReceiptRejected) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, rejectedMessage(err))
+		return
+	}
+	if errors.Is(err, errVelocityLimit) {
+		writeVelocityError(w, r, err)
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to store receipt.")
+		return
+	}
+
+	setReceiptID(r.Context(), rec.ID)
+	w.Header().Set("Content-Type", "application/json")
+	if dedup && !duplicate {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(struct {
+		ID      string         `json:"id"`
+		Points  int            `json:"points"`
+		Receipt points.Receipt `json:"receipt"`
+	}{rec.ID, rec.Points, receipt})
+}
+
+// emailReceiptHandler serves POST /receipts/email?userId=, whose body is a
+// raw RFC 822 email message with an e-receipt, as forwarded by a customer and
+// posted by a mail server's inbound hook. The receipt is parsed from the
+// message and scored as for an upload.
+func emailReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	receipt, err := receipttext.ParseEmail(r.Body)
+	if errors.Is(err, receipttext.ErrNoReceipt) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "No receipt was found in the email.")
+		return
+	}
+	if err != nil {
+		writeDecodeError(w, r, err, "The body must be an RFC 822 email message.")
+		return
+	}
+	scoreParsedReceipt(w, r, receipt, r.URL.Query().Get("userId"))
+}
+
+// qrReceiptHandler serves POST /receipts/qr, a form with either an image of
+// a receipt's QR code in its file field or the code's decoded payload, and
+// an optional userId. Fiscal receipt codes and receipts as JSON are read
+// (see receipttext.ParseQR) and scored as for an upload.
+func qrReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	payload := r.FormValue("payload")
+	if payload == "" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeDecodeError(w, r, err, "The request must be a form with a QR code image in a file field or its payload in a payload field.")
+			return
+		}
+		defer file.Close()
+		image, err := io.ReadAll(file)
+		if err != nil {
+			writeDecodeError(w, r, err, "The image could not be read.")
+			return
+		}
+		switch contentType, _, _ := strings.Cut(http.DetectContentType(image), ";"); contentType {
+		case "image/jpeg", "image/png":
+		default:
+			writeProblem(w, r, http.StatusUnsupportedMediaType, "The file must be a JPEG or PNG.")
+			return
+		}
+		if payload, err = receipttext.DecodeQR(image); err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "No QR code was found in the image.")
+			return
+		}
+	}
+	receipt, err := receipttext.ParseQR(payload)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The QR code is not a receipt in a supported format.")
+		return
+	}
+	scoreParsedReceipt(w, r, receipt, r.FormValue("userId"))
+}
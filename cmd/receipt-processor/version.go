@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// currentAPIVersion is the newest API version, served to requests that do
+// not ask for one. Handlers that change a response's shape in a later
+// version check apiVersion.
+const currentAPIVersion = 1
+
+// supportedAPIVersions are the versions still served.
+var supportedAPIVersions = map[int]bool{1: true}
+
+// versionedRoutes are the first path segments of the routes served under
+// /v<N>. Admin, health, metrics and documentation routes are not versioned.
+var versionedRoutes = []string{"receipts", "users", "leaderboard", "stats", "reports", "graphql", "jobs"}
+
+var (
+	versionPrefix = regexp.MustCompile(`^/v(\d+)(/.*)$`)
+	vendorType    = regexp.MustCompile(`^application/vnd\.receipt-processor\.v([1-9]\d*)(?:\+json)?$`)
+)
+
+type apiRequestKey struct{}
+
+// apiRequest records which version a request negotiated and whether it
+// named it in the path, so that links in the response can do the same.
+type apiRequest struct {
+	version  int
+	prefixed bool
+}
+
+// apiVersion returns the API version negotiated for the request ctx belongs
+// to.
+func apiVersion(ctx context.Context) int {
+	if a, ok := ctx.Value(apiRequestKey{}).(apiRequest); ok {
+		return a.version
+	}
+	return currentAPIVersion
+}
+
+// apiPath returns the path of an API route as the client should request it:
+// under /v<N> if the request was made there, as is otherwise.
+func apiPath(ctx context.Context, path string) string {
+	if a, ok := ctx.Value(apiRequestKey{}).(apiRequest); ok && a.prefixed {
+		return fmt.Sprintf("/v%d%s", a.version, path)
+	}
+	return path
+}
+
+// splitVersion splits /v<N> off the front of a versioned route's path.
+func splitVersion(path string) (version int, rest string, ok bool) {
+	m := versionPrefix.FindStringSubmatch(path)
+	if m == nil || !versionedRoute(m[2]) {
+		return 0, path, false
+	}
+	version, err := strconv.Atoi(m[1])
+	return version, m[2], err == nil
+}
+
+func versionedRoute(path string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	for _, route := range versionedRoutes {
+		if first == route {
+			return true
+		}
+	}
+	return false
+}
+
+// apiVersioning serves the versioned routes under /v<N>, and, unless legacy
+// is off, at their original unprefixed paths too. Those are deprecated: their
+// responses say so and link to the /v<N> path, with the date they go away if
+// sunset is set. Clients can also ask for a version with an API-Version
+// header or an application/vnd.receipt-processor.v<N>+json Accept type.
+type apiVersioning struct {
+	legacy bool
+	sunset time.Time
+}
+
+func (v apiVersioning) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, rest, prefixed := splitVersion(r.URL.Path)
+		if !prefixed && !versionedRoute(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if prefixed && !supportedAPIVersions[version] {
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("API version %d is not available.", version))
+			return
+		}
+		if !prefixed && !v.legacy {
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("This path has moved to /v%d%s.", currentAPIVersion, r.URL.Path))
+			return
+		}
+
+		requested, err := requestedVersion(r)
+		switch {
+		case err != nil:
+			writeProblem(w, r, http.StatusBadRequest, "API-Version must be a positive integer.")
+			return
+		case requested == 0 && !prefixed:
+			version = currentAPIVersion
+		case requested == 0:
+		case prefixed && requested != version:
+			writeProblem(w, r, http.StatusNotAcceptable, fmt.Sprintf("The path is for API version %d but version %d was requested.", version, requested))
+			return
+		case !supportedAPIVersions[requested]:
+			writeProblem(w, r, http.StatusNotAcceptable, fmt.Sprintf("API version %d is not available; the current version is %d.", requested, currentAPIVersion))
+			return
+		default:
+			version = requested
+		}
+
+		h := w.Header()
+		h.Set("API-Version", strconv.Itoa(version))
+		h.Add("Vary", "API-Version")
+		if prefixed {
+			r = stripPath(r, rest)
+		} else {
+			h.Set("Deprecation", "true")
+			h.Set("Link", fmt.Sprintf(`</v%d%s>; rel="successor-version"`, version, r.URL.Path))
+			if !v.sunset.IsZero() {
+				h.Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+			}
+		}
+		ctx := context.WithValue(r.Context(), apiRequestKey{}, apiRequest{version: version, prefixed: prefixed})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestedVersion returns the version asked for by the API-Version header
+// or an Accept vendor type, or 0 if neither names one.
+func requestedVersion(r *http.Request) (int, error) {
+	if s := r.Header.Get("API-Version"); s != "" {
+		version, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || version < 1 {
+			return 0, fmt.Errorf("invalid API-Version %q", s)
+		}
+		return version, nil
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			if m := vendorType.FindStringSubmatch(strings.ToLower(strings.TrimSpace(mediaType))); m != nil {
+				version, _ := strconv.Atoi(m[1])
+				return version, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// stripPath returns a shallow copy of r for path, as http.StripPrefix does.
+func stripPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walEntry is one line of the write-ahead log.
+type walEntry struct {
+	Seq     uint64       `json:"seq"`
+	Op      string       `json:"op"`
+	Record  *Record      `json:"record,omitempty"`
+	ID      string       `json:"id,omitempty"`
+	Tx      *ledgerEntry `json:"tx,omitempty"`
+	Account *Account     `json:"account,omitempty"`
+}
+
+// Write-ahead log operations.
+const (
+	walSave          = "save"
+	walDelete        = "delete"
+	walTx            = "tx"
+	walDeleteAccount = "deleteAccount"
+)
+
+// walStore is a memoryStore whose writes are first appended to a log in dir
+// and synced to disk, so that a crash loses nothing that was acknowledged.
+// On open it loads the latest snapshot and replays the log entries after it.
+// Every compactInterval, and on Close, it writes a new snapshot and starts an
+// empty log.
+type walStore struct {
+	*memoryStore
+	dir string
+
+	// mu orders writes so the log replays them as they were applied.
+	mu   sync.Mutex
+	log  *os.File
+	seq  uint64
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openWALStore(dir string, compactInterval time.Duration, maxEntries int) (*walStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &walStore{memoryStore: newMemoryStore(maxEntries), dir: dir, stop: make(chan struct{}), done: make(chan struct{})}
+
+	snap, err := readSnapshot(s.snapshotPath())
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	s.restore(snap)
+	s.seq = snap.Seq
+	replayed, err := s.replay()
+	if err != nil {
+		return nil, fmt.Errorf("replaying write-ahead log: %w", err)
+	}
+	slog.Info("restored store", "dir", dir, "records", len(snap.Records), "replayed", replayed)
+
+	s.log, err = os.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	go s.compactEvery(compactInterval)
+	return s, nil
+}
+
+func (s *walStore) logPath() string      { return filepath.Join(s.dir, "wal.log") }
+func (s *walStore) snapshotPath() string { return filepath.Join(s.dir, "snapshot.json") }
+
+// replay applies the log entries newer than the snapshot. A partial last
+// line, left by a crash mid-write, is dropped; any other bad line is an
+// error.
+func (s *walStore) replay() (int, error) {
+	f, err := os.Open(s.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	n := 0
+	var valid int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				slog.Warn("dropping incomplete write-ahead log entry", "bytes", len(line))
+				return n, os.Truncate(s.logPath(), valid)
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return n, fmt.Errorf("entry after seq %d: %w", s.seq, err)
+		}
+		valid += int64(len(line))
+		if e.Seq <= s.seq {
+			continue
+		}
+		s.apply(e)
+		s.seq = e.Seq
+		n++
+	}
+}
+
+func (s *walStore) apply(e walEntry) {
+	ctx := context.Background()
+	switch e.Op {
+	case walSave:
+		s.memoryStore.Save(ctx, *e.Record)
+	case walDelete:
+		s.memoryStore.Delete(ctx, e.ID)
+	case walTx:
+		e.Tx.Transaction.Tenant = e.Tx.Tenant
+		s.memoryStore.Append(ctx, e.Tx.Transaction)
+	case walDeleteAccount:
+		s.memoryStore.DeleteAccount(ctx, e.Account.Tenant, e.Account.UserID)
+	}
+}
+
+// write appends e to the log and syncs it. The caller must hold s.mu.
+func (s *walStore) write(e walEntry) error {
+	e.Seq = s.seq + 1
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.seq = e.Seq
+	return nil
+}
+
+func (s *walStore) Save(ctx context.Context, rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(walEntry{Op: walSave, Record: &rec}); err != nil {
+		return err
+	}
+	return s.memoryStore.Save(ctx, rec)
+}
+
+func (s *walStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.memoryStore.Get(ctx, id); err != nil {
+		return err
+	}
+	if err := s.write(walEntry{Op: walDelete, ID: id}); err != nil {
+		return err
+	}
+	return s.memoryStore.Delete(ctx, id)
+}
+
+func (s *walStore) Append(ctx context.Context, tx Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(walEntry{Op: walTx, Tx: &ledgerEntry{tx.Tenant, tx}}); err != nil {
+		return err
+	}
+	return s.memoryStore.Append(ctx, tx)
+}
+
+func (s *walStore) Redeem(ctx context.Context, tx Transaction) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Every ledger write goes through s.mu, so the balance cannot change
+	// between this check and the append.
+	balance, err := s.memoryStore.Balance(ctx, tx.Tenant, tx.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if balance+tx.Points < 0 {
+		return balance, errInsufficientPoints
+	}
+	if err := s.write(walEntry{Op: walTx, Tx: &ledgerEntry{tx.Tenant, tx}}); err != nil {
+		return 0, err
+	}
+	return s.memoryStore.Redeem(ctx, tx)
+}
+
+func (s *walStore) DeleteAccount(ctx context.Context, tenant, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(walEntry{Op: walDeleteAccount, Account: &Account{tenant, userID}}); err != nil {
+		return 0, err
+	}
+	return s.memoryStore.DeleteAccount(ctx, tenant, userID)
+}
+
+// compact writes a snapshot of the store and empties the log.
+func (s *walStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.snapshot()
+	snap.Seq = s.seq
+	if err := writeSnapshot(s.snapshotPath(), snap); err != nil {
+		return err
+	}
+	// Entries up to snap.Seq are skipped on replay, so a crash before the
+	// truncation only leaves them to be read again.
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+func (s *walStore) compactEvery(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.compact(); err != nil {
+				slog.Error("compacting write-ahead log", "error", err)
+			}
+		}
+	}
+}
+
+func (s *walStore) Close() error {
+	close(s.stop)
+	<-s.done
+	err := s.compact()
+	return errors.Join(err, s.log.Close())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// crash abandons s as a crash would: without the snapshot Close writes.
+func crash(s *walStore) {
+	close(s.stop)
+	<-s.done
+	s.log.Close()
+}
+
+// TestWALReplayTruncatedLastLine checks that a log whose last line was cut
+// off by a crash mid-write replays every complete entry, drops the partial
+// one, and takes new entries after them.
+func TestWALReplayTruncatedLastLine(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := openWALStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"r1", "r2"} {
+		if err := s.Save(ctx, Record{ID: id, Points: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crash(s)
+
+	logPath := filepath.Join(dir, "wal.log")
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := info.Size()
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"op":"save","record":{"id":"r3","poi`)
+	f.Close()
+
+	s, err = openWALStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("reopening after a partial write: %v", err)
+	}
+	for _, id := range []string{"r1", "r2"} {
+		if _, err := s.Get(ctx, id); err != nil {
+			t.Errorf("Get(%q) after replay: %v", id, err)
+		}
+	}
+	if _, err := s.Get(ctx, "r3"); !errors.Is(err, errNotFound) {
+		t.Errorf("Get of the partial entry's record: err = %v, want errNotFound", err)
+	}
+	if info, err := os.Stat(logPath); err != nil {
+		t.Error(err)
+	} else if info.Size() != complete {
+		t.Errorf("log is %d bytes after replay, want the %d of its complete entries", info.Size(), complete)
+	}
+
+	if err := s.Save(ctx, Record{ID: "r4", Points: 10}); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+	s, err = openWALStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("reopening after writing past the dropped entry: %v", err)
+	}
+	defer s.Close()
+	for _, id := range []string{"r1", "r2", "r4"} {
+		if _, err := s.Get(ctx, id); err != nil {
+			t.Errorf("Get(%q) after second replay: %v", id, err)
+		}
+	}
+}
+
+// TestWALReplayCorruptEntry checks that a bad line other than the last is
+// reported rather than skipped.
+func TestWALReplayCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	data := "{\"seq\":1,\"op\":\"save\",\"record\":{\"id\":\"r1\"}}\nnot json\n{\"seq\":3,\"op\":\"delete\",\"id\":\"r1\"}\n"
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := openWALStore(dir, time.Hour, 0); err == nil {
+		s.Close()
+		t.Fatal("opened a log with a corrupt entry")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// The default origin check allows same-origin pages and non-browser
+// clients.
+var upgrader = websocket.Upgrader{}
+
+// liveReceiptsHandler is the WebSocket form of streamReceiptsHandler: each
+// event is a JSON text message carrying its id, which a client passes back
+// as lastEventId when it reconnects. Messages from the client are ignored.
+func liveReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, lastID, err := feedRequest(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The last event ID must be a non-negative integer.")
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeProblem(w, r, http.StatusUpgradeRequired, "This endpoint requires a WebSocket connection.")
+		return
+	}
+	missed, ch := live.subscribe(filter, lastID)
+	if ch == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, "The server is shutting down.")
+		return
+	}
+	defer live.unsubscribe(ch)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already responded.
+		return
+	}
+	defer conn.Close()
+	// The connection outlives --request-timeout.
+	liftDeadline(r.Context())
+
+	// Read so that pongs and the client's close are handled; closed is
+	// closed once the connection fails or the client goes away.
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e feedEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(e)
+	}
+	for _, e := range missed {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteWait))
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BonusConfig is the JSON form of a promotional bonus: Points awarded for
+// purchases on any of Days, after Start and before End. Days may be left
+// out to match every day, or Start and End to match the whole day, but not
+// both.
+type BonusConfig struct {
+	Name   string   `json:"name"`
+	Points int      `json:"points"`
+	Days   []string `json:"days,omitempty"`
+	Start  string   `json:"start,omitempty"`
+	End    string   `json:"end,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// parseWeekday accepts a weekday's English name or its first three letters,
+// in any case.
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for name, d := range weekdays {
+		if s == name || s == name[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func (b BonusConfig) validate() error {
+	var errs []error
+	if b.Points < 0 {
+		errs = append(errs, errors.New("points must not be negative"))
+	}
+	for _, d := range b.Days {
+		if _, ok := parseWeekday(d); !ok {
+			errs = append(errs, fmt.Errorf("%q is not a day of the week", d))
+		}
+	}
+	switch {
+	case b.Start == "" && b.End == "":
+		if len(b.Days) == 0 {
+			errs = append(errs, errors.New("needs days, a start and end, or both"))
+		}
+	case b.Start == "" || b.End == "":
+		errs = append(errs, errors.New("start and end must be given together"))
+	default:
+		start, err := time.Parse(TimeLayout, b.Start)
+		if err != nil {
+			errs = append(errs, errors.New("start must be HH:MM"))
+		}
+		end, err := time.Parse(TimeLayout, b.End)
+		if err != nil {
+			errs = append(errs, errors.New("end must be HH:MM"))
+		}
+		if !end.After(start) {
+			errs = append(errs, errors.New("end must be after start"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rule builds the bonus rule described by b, which must already be valid.
+func (b BonusConfig) rule() bonusRule {
+	r := bonusRule{name: b.Name, points: b.Points}
+	for _, d := range b.Days {
+		day, _ := parseWeekday(d)
+		r.days = append(r.days, day)
+	}
+	if b.Start != "" {
+		r.window = true
+		r.start, _ = time.Parse(TimeLayout, b.Start)
+		r.end, _ = time.Parse(TimeLayout, b.End)
+	}
+	return r
+}
+
+type bonusRule struct {
+	name       string
+	points     int
+	days       []time.Weekday
+	window     bool
+	start, end time.Time
+}
+
+func (r bonusRule) Name() string { return r.name }
+
+func (r bonusRule) Description() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d points if purchased", r.points)
+	if len(r.days) > 0 {
+		names := make([]string, len(r.days))
+		for i, d := range r.days {
+			names[i] = d.String()
+		}
+		fmt.Fprintf(&b, " on %s", strings.Join(names, ", "))
+	}
+	if r.window {
+		fmt.Fprintf(&b, " after %s and before %s", r.start.Format(TimeLayout), r.end.Format(TimeLayout))
+	}
+	return b.String()
+}
+
+func (r bonusRule) Evaluate(receipt Receipt) int {
+	if len(r.days) > 0 {
+		date, err := time.Parse(DateLayout, receipt.PurchaseDate)
+		if err != nil || !r.onDay(date.Weekday()) {
+			return 0
+		}
+	}
+	if r.window {
+		t, err := time.Parse(TimeLayout, receipt.PurchaseTime)
+		if err != nil || !t.After(r.start) || !t.Before(r.end) {
+			return 0
+		}
+	}
+	return r.points
+}
+
+func (r bonusRule) onDay(day time.Weekday) bool {
+	for _, d := range r.days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package points
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Campaign is a time-bounded promotion applied after a rule set has scored
+// a receipt. It matches receipts purchased on or after From and before To,
+// optionally only at Retailer, compared with NormalizeRetailer, or with a
+// total of at least MinTotal, and awards ExtraPoints plus the base points
+// times Multiplier - 1, rounded down.
+type Campaign struct {
+	ID          string  `json:"id"`
+	Description string  `json:"description,omitempty"`
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Retailer    string  `json:"retailer,omitempty"`
+	MinTotal    string  `json:"minTotal,omitempty"`
+	Multiplier  float64 `json:"multiplier,omitempty"`
+	ExtraPoints int     `json:"extraPoints,omitempty"`
+}
+
+func (c Campaign) Validate() error {
+	var errs []error
+	if c.ID == "" {
+		errs = append(errs, errors.New("id must not be empty"))
+	}
+	from, err := time.Parse(DateLayout, c.From)
+	if err != nil {
+		errs = append(errs, errors.New("from must be YYYY-MM-DD"))
+	}
+	to, err := time.Parse(DateLayout, c.To)
+	if err != nil {
+		errs = append(errs, errors.New("to must be YYYY-MM-DD"))
+	} else if !to.After(from) {
+		errs = append(errs, errors.New("to must be after from"))
+	}
+	if c.MinTotal != "" {
+		if m, err := ParseMoney(c.MinTotal); err != nil || m < 0 {
+			errs = append(errs, errors.New("minTotal must be a price such as 50.00"))
+		}
+	}
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		errs = append(errs, errors.New("multiplier must be at least 1"))
+	}
+	if c.ExtraPoints < 0 {
+		errs = append(errs, errors.New("extraPoints must not be negative"))
+	}
+	if c.Multiplier <= 1 && c.ExtraPoints == 0 {
+		errs = append(errs, errors.New("needs a multiplier above 1 or extraPoints"))
+	}
+	return errors.Join(errs...)
+}
+
+// Rule is the name a campaign's points appear under in a breakdown.
+func (c Campaign) Rule() string { return "campaign:" + c.ID }
+
+func (c Campaign) describe() string {
+	if c.Description != "" {
+		return c.Description
+	}
+	var parts []string
+	if c.Multiplier > 1 {
+		parts = append(parts, fmt.Sprintf("%g times the points", c.Multiplier))
+	}
+	if c.ExtraPoints > 0 {
+		parts = append(parts, fmt.Sprintf("%d extra points", c.ExtraPoints))
+	}
+	s := strings.Join(parts, " plus ")
+	if c.Retailer != "" {
+		s += " at " + c.Retailer
+	}
+	if c.MinTotal != "" {
+		s += " for totals of at least " + c.MinTotal
+	}
+	return s + fmt.Sprintf(" from %s until %s", c.From, c.To)
+}
+
+func (c Campaign) matches(receipt Receipt) bool {
+	// Valid YYYY-MM-DD dates order the same as strings.
+	if _, err := time.Parse(DateLayout, receipt.PurchaseDate); err != nil || receipt.PurchaseDate < c.From || receipt.PurchaseDate >= c.To {
+		return false
+	}
+	if c.Retailer != "" && NormalizeRetailer(receipt.Retailer) != NormalizeRetailer(c.Retailer) {
+		return false
+	}
+	if c.MinTotal != "" {
+		// MinTotal has two decimal places, and the total those of its
+		// currency.
+		minTotal, _ := ParseMoney(c.MinTotal)
+		total, err := ParseAmount(receipt.Total, receipt.Currency)
+		if err != nil || total.Rescale(MinorUnits(receipt.Currency), maxMinorUnits) < minTotal.Rescale(2, maxMinorUnits) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Campaign) points(base int) int {
+	points := c.ExtraPoints
+	if c.Multiplier > 1 {
+		extra := new(big.Rat).Mul(exactFactor(c.Multiplier-1), big.NewRat(int64(base), 1))
+		points += int(new(big.Int).Quo(extra.Num(), extra.Denom()).Int64())
+	}
+	return points
+}
+
+// Campaigns is a set of campaigns with unique IDs.
+type Campaigns []Campaign
+
+// Apply returns a result for each campaign matching receipt, given the
+// results of the base rules. Multipliers apply to the base points only, not
+// to other campaigns.
+func (cs Campaigns) Apply(receipt Receipt, base []Result) []Result {
+	total := Total(base)
+	var results []Result
+	for _, c := range cs {
+		if c.matches(receipt) {
+			results = append(results, Result{c.Rule(), c.describe(), c.points(total)})
+		}
+	}
+	return results
+}
+
+// Validate checks every campaign and that their IDs are unique.
+func (cs Campaigns) Validate() error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, c := range cs {
+		if err := c.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("campaign %d (%q): %w", i, c.ID, err))
+		}
+		if seen[c.ID] {
+			errs = append(errs, fmt.Errorf("duplicate campaign id %q", c.ID))
+		}
+		seen[c.ID] = true
+	}
+	return errors.Join(errs...)
+}
+
+// LoadCampaigns reads a JSON file holding an array of campaigns.
+func LoadCampaigns(path string) (Campaigns, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cs Campaigns
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cs); err != nil {
+		return nil, fmt.Errorf("campaigns file %s: %w", path, err)
+	}
+	if err := cs.Validate(); err != nil {
+		return nil, fmt.Errorf("campaigns file %s: %w", path, err)
+	}
+	return cs, nil
+}
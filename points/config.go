@@ -0,0 +1,217 @@
+package points
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the JSON form of a rule set: its version, effective dates, the
+// point values of the built-in rules, and any promotional bonuses.
+type Config struct {
+	Version       string `json:"version"`
+	EffectiveFrom string `json:"effectiveFrom,omitempty"`
+	EffectiveTo   string `json:"effectiveTo,omitempty"`
+
+	RetailerCharPoints      int     `json:"retailerCharPoints"`
+	UnicodeRetailer         bool    `json:"unicodeRetailer,omitempty"`
+	RoundDollarPoints       int     `json:"roundDollarPoints"`
+	QuarterMultiplePoints   int     `json:"quarterMultiplePoints"`
+	PreTaxTotal             bool    `json:"preTaxTotal,omitempty"`
+	ItemPairPoints          int     `json:"itemPairPoints"`
+	CountItemUnits          bool    `json:"countItemUnits,omitempty"`
+	DescriptionLengthFactor int     `json:"descriptionLengthMultiple"`
+	DescriptionPriceFactor  float64 `json:"descriptionPriceMultiplier"`
+	OddDayPoints            int     `json:"oddDayPoints"`
+	AfternoonPoints         int     `json:"afternoonPoints"`
+	AfternoonStart          string  `json:"afternoonStart"`
+	AfternoonEnd            string  `json:"afternoonEnd"`
+
+	CategoryPoints map[string]int `json:"categoryPoints,omitempty"`
+	Bonuses        []BonusConfig  `json:"bonuses,omitempty"`
+}
+
+// DefaultConfig returns version "1" of the rules, as published in the
+// original challenge. Its retailer rule counts only ASCII letters and digits;
+// set UnicodeRetailer to count every letter and digit, e.g. in "Müller". Its
+// item pairs rule counts lines; set CountItemUnits to count the units of
+// items with a Quantity. Its total rules score the total as paid; set
+// PreTaxTotal to score it less the receipt's tax.
+func DefaultConfig() Config {
+	return Config{
+		Version:                 "1",
+		RetailerCharPoints:      1,
+		RoundDollarPoints:       50,
+		QuarterMultiplePoints:   25,
+		ItemPairPoints:          5,
+		DescriptionLengthFactor: 3,
+		DescriptionPriceFactor:  0.2,
+		OddDayPoints:            6,
+		AfternoonPoints:         10,
+		AfternoonStart:          "14:00",
+		AfternoonEnd:            "16:00",
+	}
+}
+
+// LoadFile reads a JSON rules file holding either a single rule set or an
+// array of them. Fields left out of a rule set keep their default values.
+func LoadFile(path string) (Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("rules file %s: %w", path, err)
+	}
+	return reg, nil
+}
+
+// ParseRules parses and validates rules in the form LoadFile reads them.
+func ParseRules(data []byte) (Registry, error) {
+	var raw []json.RawMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		raw = []json.RawMessage{data}
+	}
+
+	var reg Registry
+	for i, msg := range raw {
+		r := DefaultConfig()
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&r); err != nil {
+			return nil, fmt.Errorf("rule set %d: %w", i, err)
+		}
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("rule set %q: %w", r.Version, err)
+		}
+		reg = append(reg, r.RuleSet())
+	}
+	if err := reg.Validate(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// RuleSet builds the rule set described by r, which must already be valid.
+func (r Config) RuleSet() RuleSet {
+	var from, to time.Time
+	if r.EffectiveFrom != "" {
+		from, _ = time.Parse(DateLayout, r.EffectiveFrom)
+	}
+	if r.EffectiveTo != "" {
+		to, _ = time.Parse(DateLayout, r.EffectiveTo)
+	}
+	start, _ := time.Parse(TimeLayout, r.AfternoonStart)
+	end, _ := time.Parse(TimeLayout, r.AfternoonEnd)
+
+	rs := RuleSet{
+		Version:       r.Version,
+		EffectiveFrom: from,
+		EffectiveTo:   to,
+		Rules: []Rule{
+			retailerNameRule{r.RetailerCharPoints, r.UnicodeRetailer},
+			roundDollarRule{r.RoundDollarPoints, r.PreTaxTotal},
+			quarterMultipleRule{r.QuarterMultiplePoints, r.PreTaxTotal},
+			itemPairsRule{r.ItemPairPoints, r.CountItemUnits},
+			newItemDescriptionRule(r.DescriptionLengthFactor, r.DescriptionPriceFactor),
+			oddDayRule{r.OddDayPoints},
+			timeWindowRule{r.AfternoonPoints, start, end},
+		},
+	}
+	if len(r.CategoryPoints) > 0 {
+		rs.Rules = append(rs.Rules, newItemCategoryRule(r.CategoryPoints))
+	}
+	for _, b := range r.Bonuses {
+		rs.Rules = append(rs.Rules, b.rule())
+	}
+	return rs
+}
+
+func (r Config) Validate() error {
+	var errs []error
+	if r.Version == "" {
+		errs = append(errs, errors.New("version must not be empty"))
+	}
+	var from, to time.Time
+	var err error
+	if r.EffectiveFrom != "" {
+		if from, err = time.Parse(DateLayout, r.EffectiveFrom); err != nil {
+			errs = append(errs, errors.New("effectiveFrom must be YYYY-MM-DD"))
+		}
+	}
+	if r.EffectiveTo != "" {
+		if to, err = time.Parse(DateLayout, r.EffectiveTo); err != nil {
+			errs = append(errs, errors.New("effectiveTo must be YYYY-MM-DD"))
+		} else if !to.After(from) {
+			errs = append(errs, errors.New("effectiveTo must be after effectiveFrom"))
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"retailerCharPoints", r.RetailerCharPoints},
+		{"roundDollarPoints", r.RoundDollarPoints},
+		{"quarterMultiplePoints", r.QuarterMultiplePoints},
+		{"itemPairPoints", r.ItemPairPoints},
+		{"oddDayPoints", r.OddDayPoints},
+		{"afternoonPoints", r.AfternoonPoints},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", f.name))
+		}
+	}
+	if r.DescriptionLengthFactor < 1 {
+		errs = append(errs, errors.New("descriptionLengthMultiple must be at least 1"))
+	}
+	if r.DescriptionPriceFactor < 0 {
+		errs = append(errs, errors.New("descriptionPriceMultiplier must not be negative"))
+	}
+	start, err := time.Parse(TimeLayout, r.AfternoonStart)
+	if err != nil {
+		errs = append(errs, errors.New("afternoonStart must be HH:MM"))
+	}
+	end, err := time.Parse(TimeLayout, r.AfternoonEnd)
+	if err != nil {
+		errs = append(errs, errors.New("afternoonEnd must be HH:MM"))
+	}
+	if !end.After(start) {
+		errs = append(errs, errors.New("afternoonEnd must be after afternoonStart"))
+	}
+
+	for category, points := range r.CategoryPoints {
+		if strings.TrimSpace(category) == "" {
+			errs = append(errs, errors.New("categoryPoints must not have an empty category"))
+		}
+		if points < 0 {
+			errs = append(errs, fmt.Errorf("categoryPoints[%q] must not be negative", category))
+		}
+	}
+
+	names := map[string]bool{itemCategoryRuleName: true}
+	for _, rule := range DefaultConfig().RuleSet().Rules {
+		names[rule.Name()] = true
+	}
+	for i, b := range r.Bonuses {
+		switch {
+		case b.Name == "":
+			errs = append(errs, fmt.Errorf("bonuses[%d]: name must not be empty", i))
+		case names[b.Name]:
+			errs = append(errs, fmt.Errorf("bonuses[%d]: name %q is already used", i, b.Name))
+		}
+		names[b.Name] = true
+		if err := b.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("bonuses[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
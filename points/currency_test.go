@@ -0,0 +1,136 @@
+package points
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in, currency string
+		want         Money
+		wantErr      bool
+	}{
+		{in: "6.49", want: 649},
+		{in: "6.49", currency: "USD", want: 649},
+		{in: "1200", currency: "JPY", want: 1200},
+		{in: "1200.00", currency: "JPY", want: 1200},
+		{in: "-500", currency: "KRW", want: -500},
+		{in: "12.345", currency: "KWD", want: 12345},
+		{in: "1200.50", currency: "JPY", wantErr: true},
+		{in: "1200", currency: "USD", wantErr: true},
+		{in: "12.34", currency: "KWD", wantErr: true},
+		{in: "12.3456", currency: "KWD", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.in, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAmount(%q, %q) error = %v, want error %v", tt.in, tt.currency, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseAmount(%q, %q) = %d, want %d", tt.in, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		m        Money
+		currency string
+		want     string
+	}{
+		{649, "", "6.49"},
+		{-649, "USD", "-6.49"},
+		{1200, "JPY", "1200"},
+		{-500, "KRW", "-500"},
+		{12345, "KWD", "12.345"},
+		{-5, "KWD", "-0.005"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Format(tt.currency); got != tt.want {
+			t.Errorf("Money(%d).Format(%q) = %q, want %q", tt.m, tt.currency, got, tt.want)
+		}
+	}
+}
+
+// TestCurrencyTotalRules scores the round and quarter total rules in
+// currencies with no, two and three minor units.
+func TestCurrencyTotalRules(t *testing.T) {
+	rs := Default()[0]
+	tests := []struct {
+		name, currency, total string
+		round, quarter        bool
+	}{
+		{"USD round", "USD", "12.00", true, true},
+		{"USD quarter", "USD", "12.25", false, true},
+		{"USD neither", "USD", "12.10", false, false},
+		{"JPY round", "JPY", "1200", true, true},
+		{"JPY legacy round", "JPY", "1200.00", true, true},
+		{"JPY quarter", "JPY", "1225", false, true},
+		{"JPY neither", "JPY", "1234", false, false},
+		{"KWD round", "KWD", "12.000", true, true},
+		{"KWD quarter", "KWD", "12.250", false, true},
+		{"KWD neither", "KWD", "12.100", false, false},
+		{"KWD tenth", "KWD", "12.500", false, true},
+	}
+	for _, tt := range tests {
+		receipt := Receipt{
+			Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "13:01", Currency: tt.currency,
+			Total: tt.total, Items: []Item{{ShortDescription: "Pepsi", Price: tt.total}},
+		}
+		if err := Validate(receipt); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		scored := map[string]int{}
+		for _, r := range rs.Evaluate(receipt) {
+			scored[r.Rule] = r.Points
+		}
+		if got := scored["roundDollarTotal"] > 0; got != tt.round {
+			t.Errorf("%s: round rule scored %d", tt.name, scored["roundDollarTotal"])
+		}
+		if got := scored["quarterMultipleTotal"] > 0; got != tt.quarter {
+			t.Errorf("%s: quarter rule scored %d", tt.name, scored["quarterMultipleTotal"])
+		}
+	}
+}
+
+func TestCurrencyItemDescription(t *testing.T) {
+	rule := newItemDescriptionRule(3, 0.2)
+	tests := []struct {
+		currency, price string
+		want            int
+	}{
+		{"USD", "12.25", 3},
+		{"JPY", "1225", 245},
+		{"KWD", "12.250", 3},
+		{"KWD", "12.001", 3},
+	}
+	for _, tt := range tests {
+		receipt := Receipt{Currency: tt.currency, Items: []Item{{ShortDescription: "Pie", Price: tt.price}}}
+		if got := rule.Evaluate(receipt); got != tt.want {
+			t.Errorf("%s %s: %d points, want %d", tt.price, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestCurrencyTotalTolerance(t *testing.T) {
+	val := Validator{CheckTotal: true, TotalTolerance: 5}
+	tests := []struct {
+		currency, price, total string
+		ok                     bool
+	}{
+		{"USD", "12.00", "12.05", true},
+		{"USD", "12.00", "12.06", false},
+		{"KWD", "12.000", "12.050", true},
+		{"KWD", "12.000", "12.051", false},
+		{"JPY", "1200", "1201", false},
+	}
+	for _, tt := range tests {
+		receipt := Receipt{
+			Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "13:01", Currency: tt.currency,
+			Total: tt.total, Items: []Item{{ShortDescription: "Pepsi", Price: tt.price}},
+		}
+		if err := val.Validate(receipt); (err == nil) != tt.ok {
+			t.Errorf("%s %s of %s: err = %v, want ok %v", tt.total, tt.currency, tt.price, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrNoRuleSet = errors.New("no scoring rules in effect")
+
+// Rule awards points for one property of a receipt.
+type Rule interface {
+	Name() string
+	Description() string
+	Evaluate(receipt Receipt) int
+}
+
+// RuleSet is a versioned group of rules applied to receipts purchased on or
+// after EffectiveFrom and before EffectiveTo. A zero bound is open-ended.
+type RuleSet struct {
+	Version       string
+	EffectiveFrom time.Time
+	EffectiveTo   time.Time
+	Rules         []Rule
+}
+
+// Result is the points one rule awarded a receipt.
+type Result struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	Points      int    `json:"points"`
+}
+
+func (rs RuleSet) covers(date time.Time) bool {
+	return !date.Before(rs.EffectiveFrom) && (rs.EffectiveTo.IsZero() || date.Before(rs.EffectiveTo))
+}
+
+func (rs RuleSet) Evaluate(receipt Receipt) []Result {
+	results := make([]Result, len(rs.Rules))
+	for i, rule := range rs.Rules {
+		results[i] = Result{rule.Name(), rule.Description(), rule.Evaluate(receipt)}
+	}
+	return results
+}
+
+// Registry holds rule sets with non-overlapping effective dates.
+type Registry []RuleSet
+
+// Default returns a registry holding only the default rules.
+func Default() Registry {
+	return Registry{DefaultConfig().RuleSet()}
+}
+
+// ForDate returns the rule set in effect on date.
+func (reg Registry) ForDate(date time.Time) (RuleSet, bool) {
+	for _, rs := range reg {
+		if rs.covers(date) {
+			return rs, true
+		}
+	}
+	return RuleSet{}, false
+}
+
+// Version returns the rule set with version v, e.g. to explain a score
+// recorded under rules that are no longer in effect.
+func (reg Registry) Version(v string) (RuleSet, bool) {
+	for _, rs := range reg {
+		if rs.Version == v {
+			return rs, true
+		}
+	}
+	return RuleSet{}, false
+}
+
+// Validate sorts reg by EffectiveFrom and checks that versions are unique
+// and effective dates do not overlap.
+func (reg Registry) Validate() error {
+	sort.Slice(reg, func(i, j int) bool { return reg[i].EffectiveFrom.Before(reg[j].EffectiveFrom) })
+	seen := make(map[string]bool)
+	for i, rs := range reg {
+		if seen[rs.Version] {
+			return fmt.Errorf("duplicate rule set version %q", rs.Version)
+		}
+		seen[rs.Version] = true
+		if i > 0 {
+			prev := reg[i-1]
+			if prev.EffectiveTo.IsZero() || prev.EffectiveTo.After(rs.EffectiveFrom) {
+				return fmt.Errorf("rule sets %q and %q have overlapping effective dates", prev.Version, rs.Version)
+			}
+		}
+	}
+	return nil
+}
+
+// Score scores a receipt with the rule set in effect on its purchase date
+// and reports which version was used. It does not Validate the receipt.
+func (reg Registry) Score(receipt Receipt) (string, []Result, error) {
+	date, err := time.Parse(DateLayout, receipt.PurchaseDate)
+	if err != nil {
+		return "", nil, ErrInvalidReceipt
+	}
+	rs, ok := reg.ForDate(date)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %w on %s", ErrInvalidReceipt, ErrNoRuleSet, receipt.PurchaseDate)
+	}
+	return rs.Version, rs.Evaluate(receipt), nil
+}
+
+// Total sums the points in results.
+func Total(results []Result) int {
+	total := 0
+	for _, r := range results {
+		total += r.Points
+	}
+	return total
+}
+
+func boolPoints(ok bool, points int) int {
+	if ok {
+		return points
+	}
+	return 0
+}
+
+// scoredTotal returns the total the total rules score: the receipt's total,
+// or its total less tax if preTax is set.
+func scoredTotal(receipt Receipt, preTax bool) Money {
+	if preTax {
+		return receipt.PreTaxTotal()
+	}
+	m, _ := ParseAmount(receipt.Total, receipt.Currency)
+	return m
+}
+
+// totalLabel names the total the total rules score.
+func totalLabel(preTax bool) string {
+	if preTax {
+		return "pre-tax total"
+	}
+	return "total"
+}
+
+// retailerNameRule counts ASCII letters and digits, as version "1" of the
+// rules did, unless unicode is set.
+type retailerNameRule struct {
+	pointsPerChar int
+	unicode       bool
+}
+
+func (r retailerNameRule) Name() string { return "retailerName" }
+
+func (r retailerNameRule) Description() string {
+	if r.unicode {
+		return fmt.Sprintf("%d points per letter or digit in the retailer name", r.pointsPerChar)
+	}
+	return fmt.Sprintf("%d points per alphanumeric character in the retailer name", r.pointsPerChar)
+}
+
+func (r retailerNameRule) Evaluate(receipt Receipt) int {
+	alnum := 0
+	for _, ch := range receipt.Retailer {
+		if r.unicode {
+			if unicode.IsLetter(ch) || unicode.IsDigit(ch) {
+				alnum++
+			}
+		} else if (ch >= '0' && ch <= '9') || (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') {
+			alnum++
+		}
+	}
+	return alnum * r.pointsPerChar
+}
+
+// roundDollarRule and quarterMultipleRule take the dollar to be the
+// receipt currency's roundUnit.
+type roundDollarRule struct {
+	points int
+	preTax bool
+}
+
+func (r roundDollarRule) Name() string { return "roundDollarTotal" }
+
+func (r roundDollarRule) Description() string {
+	return fmt.Sprintf("%d points if the %s is a round dollar amount", r.points, totalLabel(r.preTax))
+}
+
+func (r roundDollarRule) Evaluate(receipt Receipt) int {
+	return boolPoints(scoredTotal(receipt, r.preTax)%roundUnit(receipt.Currency) == 0, r.points)
+}
+
+type quarterMultipleRule struct {
+	points int
+	preTax bool
+}
+
+func (r quarterMultipleRule) Name() string { return "quarterMultipleTotal" }
+
+func (r quarterMultipleRule) Description() string {
+	return fmt.Sprintf("%d points if the %s is a multiple of 0.25", r.points, totalLabel(r.preTax))
+}
+
+func (r quarterMultipleRule) Evaluate(receipt Receipt) int {
+	return boolPoints(scoredTotal(receipt, r.preTax)%(roundUnit(receipt.Currency)/4) == 0, r.points)
+}
+
+// itemPairsRule counts receipt lines, as version "1" of the rules did, unless
+// units is set, when it counts the units each line is for.
+type itemPairsRule struct {
+	points int
+	units  bool
+}
+
+func (r itemPairsRule) Name() string { return "itemPairs" }
+
+func (r itemPairsRule) Description() string {
+	if r.units {
+		return fmt.Sprintf("%d points for every two units purchased", r.points)
+	}
+	return fmt.Sprintf("%d points for every two items", r.points)
+}
+
+func (r itemPairsRule) Evaluate(receipt Receipt) int {
+	n := 0
+	for _, item := range receipt.Items {
+		switch {
+		case item.Returned():
+		case r.units:
+			n += item.Units()
+		default:
+			n++
+		}
+	}
+	return (n / 2) * r.points
+}
+
+type itemDescriptionRule struct {
+	lengthMultiple  int
+	priceMultiplier float64
+	factor          *big.Rat
+}
+
+func newItemDescriptionRule(lengthMultiple int, priceMultiplier float64) itemDescriptionRule {
+	return itemDescriptionRule{lengthMultiple, priceMultiplier, exactFactor(priceMultiplier)}
+}
+
+func (r itemDescriptionRule) Name() string { return "itemDescription" }
+
+func (r itemDescriptionRule) Description() string {
+	return fmt.Sprintf("price * %g rounded up for items whose trimmed description length is a multiple of %d",
+		r.priceMultiplier, r.lengthMultiple)
+}
+
+func (r itemDescriptionRule) Evaluate(receipt Receipt) int {
+	points := 0
+	for _, item := range receipt.Items {
+		desc := strings.TrimSpace(item.ShortDescription)
+		if len(desc)%r.lengthMultiple == 0 && !item.Returned() {
+			if price, err := ParseAmount(item.Price, receipt.Currency); err == nil {
+				points += int(price.mulCeil(r.factor, MinorUnits(receipt.Currency)))
+			}
+		}
+	}
+	return points
+}
+
+const itemCategoryRuleName = "itemCategory"
+
+// itemCategoryRule awards points per item by category, ignoring case and
+// surrounding whitespace.
+type itemCategoryRule struct{ points map[string]int }
+
+func newItemCategoryRule(points map[string]int) itemCategoryRule {
+	r := itemCategoryRule{make(map[string]int, len(points))}
+	for category, p := range points {
+		r.points[normalizeCategory(category)] = p
+	}
+	return r
+}
+
+func normalizeCategory(category string) string {
+	return strings.ToLower(strings.TrimSpace(category))
+}
+
+func (r itemCategoryRule) Name() string { return itemCategoryRuleName }
+
+func (r itemCategoryRule) Description() string {
+	categories := make([]string, 0, len(r.points))
+	for category := range r.points {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	parts := make([]string, len(categories))
+	for i, category := range categories {
+		parts[i] = fmt.Sprintf("%d per %s item", r.points[category], category)
+	}
+	return "points by item category: " + strings.Join(parts, ", ")
+}
+
+func (r itemCategoryRule) Evaluate(receipt Receipt) int {
+	points := 0
+	for _, item := range receipt.Items {
+		if !item.Returned() {
+			points += r.points[normalizeCategory(item.Category)]
+		}
+	}
+	return points
+}
+
+type oddDayRule struct{ points int }
+
+func (r oddDayRule) Name() string { return "oddPurchaseDay" }
+
+func (r oddDayRule) Description() string {
+	return fmt.Sprintf("%d points if the purchase day is odd", r.points)
+}
+
+func (r oddDayRule) Evaluate(receipt Receipt) int {
+	date, err := time.Parse(DateLayout, receipt.PurchaseDate)
+	return boolPoints(err == nil && date.Day()%2 == 1, r.points)
+}
+
+type timeWindowRule struct {
+	points     int
+	start, end time.Time
+}
+
+func (r timeWindowRule) Name() string { return "afternoonPurchase" }
+
+func (r timeWindowRule) Description() string {
+	return fmt.Sprintf("%d points if purchased after %s and before %s",
+		r.points, r.start.Format(TimeLayout), r.end.Format(TimeLayout))
+}
+
+func (r timeWindowRule) Evaluate(receipt Receipt) int {
+	t, err := time.Parse(TimeLayout, receipt.PurchaseTime)
+	return boolPoints(err == nil && t.After(r.start) && t.Before(r.end), r.points)
+}
@@ -0,0 +1,94 @@
+package points
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// commaAmount matches an amount with a decimal comma, its thousands
+	// optionally grouped with dots or spaces: 12,50 or 1.234,50.
+	commaAmount = regexp.MustCompile(`^(-?)(\d{1,3}(?:[. ]\d{3})+|\d+),(\d{2})$`)
+	// groupedAmount matches an amount with its thousands grouped with
+	// commas: 1,234.50.
+	groupedAmount = regexp.MustCompile(`^(-?)(\d{1,3}(?:,\d{3})+)\.(\d{2})$`)
+	// dayFirstDate matches a day, month and four-digit year separated by
+	// slashes, dots or dashes: 31/12/2022 or 31.12.2022.
+	dayFirstDate = regexp.MustCompile(`^(\d{1,2})[./-](\d{1,2})[./-](\d{4})$`)
+	// clock12 matches a 12-hour time: 1:05 PM, 01:05pm or 1.05 p.m.
+	clock12 = regexp.MustCompile(`^(\d{1,2})[:.](\d{2})\s*([AaPp])\.?\s*[Mm]\.?$`)
+)
+
+// Normalize returns receipt with amounts, dates and times written in common
+// international formats rewritten in the canonical ones the schema requires,
+// if val is Lenient; otherwise it returns receipt as it is. Values already
+// canonical, and those it does not recognize, are left for Validate to
+// judge.
+func (val Validator) Normalize(receipt Receipt) Receipt {
+	if !val.Lenient {
+		return receipt
+	}
+	receipt.PurchaseDate = normalizeDate(receipt.PurchaseDate)
+	receipt.PurchaseTime = normalizeTime(receipt.PurchaseTime)
+	receipt.Total = normalizeAmount(receipt.Total)
+	receipt.Tax = normalizeAmount(receipt.Tax)
+	receipt.Discounts = append([]Discount(nil), receipt.Discounts...)
+	for i := range receipt.Discounts {
+		receipt.Discounts[i].Amount = normalizeAmount(receipt.Discounts[i].Amount)
+	}
+	receipt.Items = append([]Item(nil), receipt.Items...)
+	for i := range receipt.Items {
+		receipt.Items[i].Price = normalizeAmount(receipt.Items[i].Price)
+		receipt.Items[i].UnitPrice = normalizeAmount(receipt.Items[i].UnitPrice)
+	}
+	return receipt
+}
+
+// normalizeAmount rewrites 12,50, 1.234,50 and 1,234.50 as 12.50, 1234.50
+// and 1234.50.
+func normalizeAmount(s string) string {
+	t := strings.TrimSpace(s)
+	if m := commaAmount.FindStringSubmatch(t); m != nil {
+		return m[1] + strings.NewReplacer(".", "", " ", "").Replace(m[2]) + "." + m[3]
+	}
+	if m := groupedAmount.FindStringSubmatch(t); m != nil {
+		return m[1] + strings.ReplaceAll(m[2], ",", "") + "." + m[3]
+	}
+	return s
+}
+
+// normalizeDate rewrites a day-first date such as 31/12/2022 as 2022-12-31.
+func normalizeDate(s string) string {
+	m := dayFirstDate.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return s
+	}
+	day, _ := strconv.Atoi(m[1])
+	month, _ := strconv.Atoi(m[2])
+	date := fmt.Sprintf("%s-%02d-%02d", m[3], month, day)
+	if _, err := time.Parse(DateLayout, date); err != nil {
+		return s
+	}
+	return date
+}
+
+// normalizeTime rewrites a 12-hour time such as 1:05 PM as 13:05.
+func normalizeTime(s string) string {
+	m := clock12.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return s
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	if hour < 1 || hour > 12 || minute > 59 {
+		return s
+	}
+	hour %= 12
+	if m[3] == "p" || m[3] == "P" {
+		hour += 12
+	}
+	return fmt.Sprintf("%02d:%02d", hour, minute)
+}
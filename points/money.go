@@ -0,0 +1,106 @@
+package points
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in the minor units of its currency: cents for USD and
+// for receipts that name no currency, yen for JPY, fils for KWD. Receipt
+// prices and totals are scored as Money so that no rule depends on float64
+// rounding.
+type Money int64
+
+// ParseMoney parses a price with two decimal places, such as "6.49", as
+// ParseAmount does for a receipt that names no currency.
+func ParseMoney(s string) (Money, error) {
+	return ParseAmount(s, "")
+}
+
+// ParseAmount parses an amount in currency, written with as many decimal
+// places as the currency has minor units: "6.49" USD, "1200" JPY or
+// "12.345" KWD. It accepts exactly the amounts Validate does, negative if
+// Validator.AllowNegative would allow it.
+func ParseAmount(s, currency string) (Money, error) {
+	if !amountPattern(currency, true).MatchString(s) {
+		return 0, fmt.Errorf("invalid price %q", s)
+	}
+	digits := strings.Replace(s, ".", "", 1)
+	if MinorUnits(currency) == 0 {
+		digits = strings.TrimSuffix(s, ".00")
+	}
+	c, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid price %q: %w", s, err)
+	}
+	return Money(c), nil
+}
+
+// DollarsToMoney converts a dollar amount such as 0.05, e.g. from a flag, to
+// the nearest cent.
+func DollarsToMoney(dollars float64) Money {
+	return Money(math.Round(dollars * 100))
+}
+
+// String formats m with two decimal places, as an amount in a currency with
+// cents.
+func (m Money) String() string {
+	return m.Format("")
+}
+
+// Format writes m as an amount in currency, as ParseAmount reads it.
+func (m Money) Format(currency string) string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	digits := MinorUnits(currency)
+	if digits == 0 {
+		return fmt.Sprintf("%s%d", sign, m)
+	}
+	unit := Money(pow10(digits))
+	return fmt.Sprintf("%s%d.%0*d", sign, m/unit, digits, m%unit)
+}
+
+// MulCeil returns m*factor in dollars, rounded up to a whole number.
+func (m Money) MulCeil(factor *big.Rat) int64 {
+	return m.mulCeil(factor, 2)
+}
+
+// mulCeil returns m*factor in whole units of a currency with digits minor
+// units, rounded up to a whole number.
+func (m Money) mulCeil(factor *big.Rat, digits int) int64 {
+	r := new(big.Rat).Mul(big.NewRat(int64(m), pow10(digits)), factor)
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	return q.Int64()
+}
+
+// Rescale converts m from minor units with from decimal places to minor
+// units with to, truncating toward zero when to is fewer.
+func (m Money) Rescale(from, to int) Money {
+	if to >= from {
+		return m * Money(pow10(to-from))
+	}
+	return m / Money(pow10(from-to))
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for range n {
+		p *= 10
+	}
+	return p
+}
+
+// exactFactor converts a multiplier from a rules file to the decimal it was
+// written as, so that 0.2 means 1/5 rather than the nearest float64.
+func exactFactor(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	return r
+}
@@ -0,0 +1,87 @@
+package points
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{in: "0.05", want: 5},
+		{in: "333.33", want: 33333},
+		{in: "6.49", want: 649},
+		{in: "0.00", want: 0},
+		{in: "-1.50", want: -150},
+		{in: "1.5", wantErr: true},
+		{in: "1.005", wantErr: true},
+		{in: ".05", wantErr: true},
+		{in: "1,50", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{5, "0.05"},
+		{33333, "333.33"},
+		{0, "0.00"},
+		{-150, "-1.50"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestMulCeil covers the item description rule's price multiplier, 0.2,
+// which float64 cannot hold exactly: a price whose product is a whole
+// number must not be rounded up past it.
+func TestMulCeil(t *testing.T) {
+	tests := []struct {
+		price  string
+		factor float64
+		want   int64
+	}{
+		{"0.05", 0.2, 1},
+		{"333.33", 0.2, 67},
+		{"5.00", 0.2, 1},
+		{"15.00", 0.2, 3},
+		{"12.25", 0.2, 3},
+		{"0.00", 0.2, 0},
+		{"6.49", 0.2, 2},
+		{"333.33", 1, 334},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.price)
+		if err != nil {
+			t.Fatalf("ParseMoney(%q): %v", tt.price, err)
+		}
+		if got := m.MulCeil(exactFactor(tt.factor)); got != tt.want {
+			t.Errorf("%s × %v rounded up = %d, want %d", tt.price, tt.factor, got, tt.want)
+		}
+	}
+}
+
+func TestExactFactor(t *testing.T) {
+	if got, want := exactFactor(0.2), big.NewRat(1, 5); got.Cmp(want) != 0 {
+		t.Errorf("exactFactor(0.2) = %v, want %v", got, want)
+	}
+}
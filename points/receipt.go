@@ -0,0 +1,365 @@
+// Package points validates receipts and scores them with versioned rule
+// sets, independently of how the receipts are stored or served.
+//
+//	version, results, err := points.Default().Score(receipt)
+//	total := points.Total(results)
+package points
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipt is a receipt as submitted. PurchaseDate and PurchaseTime are the
+// local date and time the receipt was printed with, which the rules score;
+// Timezone, if set, says where that was, as an IANA name such as
+// America/Chicago or a UTC offset such as -05:00. Currency, if set, is the
+// ISO 4217 code of the currency the prices and total are in, which are
+// written with its minor units: 12.00 EUR, 1200 JPY, 12.000 KWD. The rules
+// score amounts in that currency as written, so a round amount is 12.00 EUR
+// as much as 12.00 USD. A receipt with a negative total is a refund, which may
+// name the receipt it refunds in RefundOf. Tax and Discounts, if given, are
+// the tax charged and the discounts taken off the items, so that the total
+// is the item prices plus Tax less Discounts.
+type Receipt struct {
+	Retailer     string     `json:"retailer"`
+	PurchaseDate string     `json:"purchaseDate"`
+	PurchaseTime string     `json:"purchaseTime"`
+	Timezone     string     `json:"timezone,omitempty"`
+	Items        []Item     `json:"items"`
+	Total        string     `json:"total"`
+	Tax          string     `json:"tax,omitempty"`
+	Discounts    []Discount `json:"discounts,omitempty"`
+	Currency     string     `json:"currency,omitempty"`
+	RefundOf     string     `json:"refundOf,omitempty"`
+}
+
+// Discount is an amount taken off a receipt's items, such as a coupon.
+type Discount struct {
+	Description string `json:"description,omitempty"`
+	Amount      string `json:"amount"`
+}
+
+// PreTaxTotal returns the total less Tax.
+func (r Receipt) PreTaxTotal() Money {
+	total, _ := ParseAmount(r.Total, r.Currency)
+	tax, _ := ParseAmount(r.Tax, r.Currency)
+	return total - tax
+}
+
+// IsRefund reports whether the receipt's total is negative.
+func (r Receipt) IsRefund() bool {
+	total, err := ParseAmount(r.Total, r.Currency)
+	return err == nil && total < 0
+}
+
+// NormalizeRetailer folds case and collapses runs of whitespace in a
+// retailer name, so that names differing only in those compare equal.
+func NormalizeRetailer(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Location returns the zone Timezone names, or nil if it is empty.
+func (r Receipt) Location() (*time.Location, error) {
+	if r.Timezone == "" {
+		return nil, nil
+	}
+	if m := offsetPattern.FindStringSubmatch(r.Timezone); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset, limit := time.Duration(hours)*time.Hour+time.Duration(minutes)*time.Minute, maxZoneAhead
+		if m[1] == "-" {
+			offset, limit = -offset, maxZoneBehind
+		}
+		if offset.Abs() > limit || minutes >= 60 {
+			return nil, fmt.Errorf("UTC offset %s is out of range", r.Timezone)
+		}
+		return time.FixedZone(r.Timezone, int(offset.Seconds())), nil
+	}
+	if r.Timezone == "Local" {
+		// LoadLocation would return the server's zone.
+		return nil, errors.New("unknown time zone Local")
+	}
+	return time.LoadLocation(r.Timezone)
+}
+
+// PurchasedAt returns when the receipt was purchased: its PurchaseDate and
+// PurchaseTime read in its Location, or in UTC if it has none.
+func (r Receipt) PurchasedAt() (time.Time, error) {
+	loc, err := r.Location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return time.ParseInLocation(DateLayout+" "+TimeLayout, r.PurchaseDate+" "+r.PurchaseTime, loc)
+}
+
+// Item is one line of a receipt. Category and SKU are optional; only
+// Category is scored, by rule sets with categoryPoints. Quantity and
+// UnitPrice are optional too: Price is what the line came to, which must be
+// Quantity units at UnitPrice, to the cent. Rule sets with countItemUnits
+// count an item's units, rather than its line, toward item pairs.
+type Item struct {
+	ShortDescription string      `json:"shortDescription"`
+	Price            string      `json:"price"`
+	Quantity         json.Number `json:"quantity,omitempty"`
+	UnitPrice        string      `json:"unitPrice,omitempty"`
+	Category         string      `json:"category,omitempty"`
+	SKU              string      `json:"sku,omitempty"`
+}
+
+// quantity returns Quantity in thousandths, 1000 if it is empty, or false
+// if it is not a positive number with at most three decimal places.
+func (it Item) quantity() (int64, bool) {
+	if it.Quantity == "" {
+		return 1000, true
+	}
+	m := quantityPattern.FindStringSubmatch(it.Quantity.String())
+	if m == nil {
+		return 0, false
+	}
+	whole, _ := strconv.ParseInt(m[1], 10, 64)
+	frac, _ := strconv.ParseInt((m[2] + "000")[:3], 10, 64)
+	q := whole*1000 + frac
+	return q, q > 0
+}
+
+// Returned reports whether the item's price is negative, as for goods
+// returned or a discount taken off. The rules score no returned items.
+func (it Item) Returned() bool {
+	return strings.HasPrefix(it.Price, "-")
+}
+
+// Units returns how many units the item is: its Quantity if that is a
+// whole number, or else 1, as for goods sold by weight.
+func (it Item) Units() int {
+	if q, ok := it.quantity(); ok && q%1000 == 0 {
+		return int(q / 1000)
+	}
+	return 1
+}
+
+// Layouts of Receipt.PurchaseDate and Receipt.PurchaseTime.
+const (
+	DateLayout = "2006-01-02"
+	TimeLayout = "15:04"
+)
+
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+var (
+	retailerPattern  = regexp.MustCompile(`^[\p{L}\p{M}\p{N}_\s\-&]+$`)
+	shortDescPattern = regexp.MustCompile(`^[\p{L}\p{M}\p{N}_\s\-]+$`)
+	offsetPattern    = regexp.MustCompile(`^([+-])(\d{2}):(\d{2})$`)
+	quantityPattern  = regexp.MustCompile(`^(\d{1,9})(?:\.(\d{1,3}))?$`)
+)
+
+// FieldError describes one field of a receipt that failed validation, e.g.
+// Field "items[2].price" with Message "must match ^\d+\.\d{2}$".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a receipt that failed validation.
+// errors.Is reports it as ErrInvalidReceipt.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid receipt: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidReceipt
+}
+
+// Validate returns a *ValidationError if receipt does not match the API's
+// Receipt schema.
+func Validate(receipt Receipt) error {
+	return Validator{}.Validate(receipt)
+}
+
+// Validator checks receipts against the schema, as Validate does, plus
+// optional consistency rules. The zero Validator applies none of them.
+type Validator struct {
+	// CheckTotal rejects receipts whose item prices do not sum to the total,
+	// allowing a difference of up to TotalTolerance either way, in
+	// hundredths of the receipt's major unit. Receipts with tax or
+	// discounts are checked whether or not it is set, against the item
+	// prices plus tax less discounts.
+	CheckTotal     bool
+	TotalTolerance Money
+
+	// RejectFuture rejects receipts purchased later than the current time
+	// in their time zone, or in every time zone if they have none.
+	// MaxAgeDays, when positive, rejects receipts purchased more than that
+	// many days ago, likewise.
+	RejectFuture bool
+	MaxAgeDays   int
+
+	// Lenient has Normalize accept amounts with a decimal comma, day-first
+	// dates and 12-hour times.
+	Lenient bool
+
+	// AllowNegative accepts negative item prices and totals, for returned
+	// items and refunds.
+	AllowNegative bool
+
+	// Now returns the current time for the date bounds; nil means time.Now.
+	Now func() time.Time
+}
+
+// Purchase times without a zone could be in any, so the date bounds allow
+// for the furthest zones ahead of and behind UTC.
+const (
+	maxZoneAhead  = 14 * time.Hour
+	maxZoneBehind = 12 * time.Hour
+)
+
+// Validate returns a *ValidationError listing every schema field and
+// consistency rule that receipt fails.
+func (val Validator) Validate(receipt Receipt) error {
+	var v ValidationError
+	amounts := amountPattern(receipt.Currency, val.AllowNegative)
+	parse := func(s string) (Money, error) { return ParseAmount(s, receipt.Currency) }
+	check := func(field, value string, ok bool, msg string) {
+		switch {
+		case value == "":
+			v.Fields = append(v.Fields, FieldError{field, "is required"})
+		case !ok:
+			v.Fields = append(v.Fields, FieldError{field, msg})
+		}
+	}
+
+	check("retailer", receipt.Retailer, retailerPattern.MatchString(receipt.Retailer), "must match "+retailerPattern.String())
+	date, dateErr := time.Parse(DateLayout, receipt.PurchaseDate)
+	check("purchaseDate", receipt.PurchaseDate, dateErr == nil, "not a valid date (YYYY-MM-DD)")
+	clock, timeErr := time.Parse(TimeLayout, receipt.PurchaseTime)
+	check("purchaseTime", receipt.PurchaseTime, timeErr == nil, "not a valid 24-hour time (HH:MM)")
+	loc, zoneErr := receipt.Location()
+	if zoneErr != nil {
+		v.Fields = append(v.Fields, FieldError{"timezone", "must be an IANA time zone such as America/Chicago or a UTC offset such as -05:00"})
+	}
+	if dateErr == nil && timeErr == nil && zoneErr == nil {
+		purchased := date.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+		v.Fields = append(v.Fields, val.checkDate(purchased, loc)...)
+	}
+	if len(receipt.Items) < 1 {
+		v.Fields = append(v.Fields, FieldError{"items", "must contain at least one item"})
+	}
+	for i, item := range receipt.Items {
+		prefix := fmt.Sprintf("items[%d].", i)
+		check(prefix+"shortDescription", item.ShortDescription, shortDescPattern.MatchString(item.ShortDescription), "must match "+shortDescPattern.String())
+		check(prefix+"price", item.Price, amounts.MatchString(item.Price), "must match "+amounts.String())
+		q, ok := item.quantity()
+		if !ok {
+			v.Fields = append(v.Fields, FieldError{prefix + "quantity", "must be a positive number with at most 3 decimal places"})
+		}
+		if item.UnitPrice == "" {
+			continue
+		}
+		unit, err := parse(item.UnitPrice)
+		if err != nil || !amounts.MatchString(item.UnitPrice) {
+			v.Fields = append(v.Fields, FieldError{prefix + "unitPrice", "must match " + amounts.String()})
+			continue
+		}
+		if price, err := parse(item.Price); err == nil && amounts.MatchString(item.Price) && ok {
+			// Round half up to the minor unit, and allow one either way
+			// for however the retailer rounded.
+			extended := new(big.Int).Mul(big.NewInt(int64(unit)), big.NewInt(q))
+			extended.Add(extended, big.NewInt(500)).Quo(extended, big.NewInt(1000))
+			if diff := new(big.Int).Sub(extended, big.NewInt(int64(price))); diff.CmpAbs(big.NewInt(1)) > 0 {
+				v.Fields = append(v.Fields, FieldError{prefix + "price", fmt.Sprintf("does not match quantity × unitPrice, which come to %s", Money(extended.Int64()).Format(receipt.Currency))})
+			}
+		}
+	}
+	check("total", receipt.Total, amounts.MatchString(receipt.Total), "must match "+amounts.String())
+	if receipt.Tax != "" && !amounts.MatchString(receipt.Tax) {
+		v.Fields = append(v.Fields, FieldError{"tax", "must match " + amounts.String()})
+	}
+	unsigned := amountPattern(receipt.Currency, false)
+	for i, d := range receipt.Discounts {
+		prefix := fmt.Sprintf("discounts[%d].", i)
+		check(prefix+"amount", d.Amount, unsigned.MatchString(d.Amount), "must match "+unsigned.String())
+		if d.Description != "" && !shortDescPattern.MatchString(d.Description) {
+			v.Fields = append(v.Fields, FieldError{prefix + "description", "must match " + shortDescPattern.String()})
+		}
+	}
+	if receipt.RefundOf != "" && !receipt.IsRefund() {
+		v.Fields = append(v.Fields, FieldError{"refundOf", "is only for refunds, whose total is negative"})
+	}
+	if receipt.Currency != "" && !ValidCurrency(receipt.Currency) {
+		v.Fields = append(v.Fields, FieldError{"currency", "must be an ISO 4217 currency code such as USD"})
+	}
+	// Receipts with tax or discounts are always checked, as they itemize
+	// how the total was reached.
+	itemized := receipt.Tax != "" || len(receipt.Discounts) > 0
+	if (val.CheckTotal || itemized) && len(v.Fields) == 0 {
+		var sum Money
+		for _, item := range receipt.Items {
+			price, _ := parse(item.Price)
+			sum += price
+		}
+		msg := "does not match the item prices, which sum to " + sum.Format(receipt.Currency)
+		if itemized {
+			tax, _ := parse(receipt.Tax)
+			sum += tax
+			for _, d := range receipt.Discounts {
+				amount, _ := parse(d.Amount)
+				sum -= amount
+			}
+			msg = "does not match the item prices plus tax less discounts, which come to " + sum.Format(receipt.Currency)
+		}
+		total, _ := parse(receipt.Total)
+		tolerance := val.TotalTolerance.Rescale(2, MinorUnits(receipt.Currency))
+		if diff := sum - total; diff > tolerance || -diff > tolerance {
+			v.Fields = append(v.Fields, FieldError{"total", msg})
+		}
+	}
+
+	if len(v.Fields) > 0 {
+		return &v
+	}
+	return nil
+}
+
+// checkDate applies the date bounds to a purchase time read as UTC, taken
+// to be in loc unless that is nil.
+func (val Validator) checkDate(purchased time.Time, loc *time.Location) []FieldError {
+	if !val.RejectFuture && val.MaxAgeDays <= 0 {
+		return nil
+	}
+	now := time.Now
+	if val.Now != nil {
+		now = val.Now
+	}
+	utc := now().UTC()
+	ahead, behind := maxZoneAhead, maxZoneBehind
+	if loc != nil {
+		purchased = time.Date(purchased.Year(), purchased.Month(), purchased.Day(), purchased.Hour(), purchased.Minute(), 0, 0, loc)
+		ahead, behind = 0, 0
+	}
+
+	var errs []FieldError
+	if val.RejectFuture && purchased.After(utc.Add(ahead)) {
+		errs = append(errs, FieldError{"purchaseDate", "is in the future"})
+	}
+	if val.MaxAgeDays > 0 && purchased.Before(utc.Add(-behind).AddDate(0, 0, -val.MaxAgeDays)) {
+		errs = append(errs, FieldError{"purchaseDate", fmt.Sprintf("is more than %d days old", val.MaxAgeDays)})
+	}
+	return errs
+}
@@ -0,0 +1,263 @@
+// Package receiptclient is a Go client for the Receipt Processor HTTP API.
+//
+//	c := receiptclient.New("http://localhost:8080", receiptclient.WithAPIKey(key))
+//	id, err := c.ProcessReceipt(ctx, receipt)
+//	points, err := c.GetPoints(ctx, id)
+package receiptclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidReceipt = errors.New("receiptclient: invalid receipt")
+	ErrNotFound       = errors.New("receiptclient: receipt not found")
+)
+
+// Error is returned for responses other than success, 400 and 404.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("receiptclient: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Receipt is a receipt to submit. UserID, if set, names the user credited
+// with its points.
+type Receipt struct {
+	Retailer     string     `json:"retailer"`
+	PurchaseDate string     `json:"purchaseDate"`
+	PurchaseTime string     `json:"purchaseTime"`
+	Timezone     string     `json:"timezone,omitempty"`
+	Items        []Item     `json:"items"`
+	Total        string     `json:"total"`
+	Tax          string     `json:"tax,omitempty"`
+	Discounts    []Discount `json:"discounts,omitempty"`
+	Currency     string     `json:"currency,omitempty"`
+	RefundOf     string     `json:"refundOf,omitempty"`
+	UserID       string     `json:"userId,omitempty"`
+}
+
+// Discount is an amount taken off a receipt's total, such as a coupon.
+type Discount struct {
+	Description string `json:"description,omitempty"`
+	Amount      string `json:"amount"`
+}
+
+type Item struct {
+	ShortDescription string      `json:"shortDescription"`
+	Price            string      `json:"price"`
+	Quantity         json.Number `json:"quantity,omitempty"`
+	UnitPrice        string      `json:"unitPrice,omitempty"`
+	Category         string      `json:"category,omitempty"`
+	SKU              string      `json:"sku,omitempty"`
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	tenant     string
+	retries    int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey sends key as X-API-Key on every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTenant sends tenant as X-Tenant-ID on every request.
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithRetries sets how many times a request is retried after a transport
+// error, 429 or 502-504, and the delay before the first retry, which
+// doubles on each attempt. The default is 2 retries starting at 100ms.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ProcessReceipt submits a receipt and returns its ID. When the server runs
+// with deduplication, an identical receipt returns the existing ID, which
+// also makes retries safe.
+func (c *Client) ProcessReceipt(ctx context.Context, receipt Receipt) (string, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	err = c.do(ctx, http.MethodPost, "/v1/receipts/process", body, &resp)
+	return resp.ID, err
+}
+
+// UpdateReceipt replaces the receipt with id, e.g. to correct a misread
+// price, and returns the points it is now worth. The receipt's user cannot
+// change; leave UserID empty or set it to the same user.
+func (c *Client) UpdateReceipt(ctx context.Context, id string, receipt Receipt) (int, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Points int `json:"points"`
+	}
+	err = c.do(ctx, http.MethodPut, "/v1/receipts/"+url.PathEscape(id), body, &resp)
+	return resp.Points, err
+}
+
+func (c *Client) GetPoints(ctx context.Context, id string) (int, error) {
+	var resp struct {
+		Points int `json:"points"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/receipts/"+url.PathEscape(id)+"/points", nil, &resp)
+	return resp.Points, err
+}
+
+// GetPointsBatch returns the points of each receipt in ids that exists,
+// keyed by ID, in one request. The server takes at most 1000 IDs at a time.
+func (c *Client) GetPointsBatch(ctx context.Context, ids []string) (map[string]int, error) {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	var resp []struct {
+		ID     string `json:"id"`
+		Points *int   `json:"points"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/receipts/points/batch", body, &resp); err != nil {
+		return nil, err
+	}
+	found := make(map[string]int, len(resp))
+	for _, r := range resp {
+		if r.Points != nil {
+			found[r.ID] = *r.Points
+		}
+	}
+	return found, nil
+}
+
+// GetVersionPoints returns the points an earlier version of a corrected
+// receipt was scored, numbered from 1 for the receipt as first submitted.
+func (c *Client) GetVersionPoints(ctx context.Context, id string, version int) (int, error) {
+	var resp struct {
+		Points int `json:"points"`
+	}
+	path := "/v1/receipts/" + url.PathEscape(id) + "/points?version=" + strconv.Itoa(version)
+	err := c.do(ctx, http.MethodGet, path, nil, &resp)
+	return resp.Points, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out any) error {
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := c.try(ctx, method, path, body, out)
+		if !retry || attempt >= c.retries {
+			return err
+		}
+		if wait == 0 {
+			wait = delay
+			delay *= 2
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// try makes one request and reports whether it is worth retrying and, if the
+// server said so, how long to wait first.
+func (c *Client) try(ctx context.Context, method, path string, body []byte, out any) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, 0, json.NewDecoder(resp.Body).Decode(out)
+	case resp.StatusCode == http.StatusBadRequest:
+		return false, 0, ErrInvalidReceipt
+	case resp.StatusCode == http.StatusNotFound:
+		return false, 0, ErrNotFound
+	}
+
+	err = &Error{StatusCode: resp.StatusCode, Message: errorMessage(resp)}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return true, time.Duration(secs) * time.Second, err
+	}
+	return false, 0, err
+}
+
+// errorMessage returns the detail of an application/problem+json body, or
+// the raw body for any other error response.
+func errorMessage(resp *http.Response) string {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") {
+		var p struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(msg, &p) == nil {
+			if p.Detail != "" {
+				return p.Detail
+			}
+			return p.Title
+		}
+	}
+	return strings.TrimSpace(string(msg))
+}
@@ -0,0 +1,5 @@
+// Package receiptpb holds the protobuf and gRPC definitions for the receipt
+// processor. Regenerate after editing receipt.proto.
+package receiptpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative receipt.proto
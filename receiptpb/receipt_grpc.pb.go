@@ -0,0 +1,197 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: receipt.proto
+
+package receiptpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ReceiptProcessor_ProcessReceipt_FullMethodName = "/receipt.v1.ReceiptProcessor/ProcessReceipt"
+	ReceiptProcessor_GetPoints_FullMethodName      = "/receipt.v1.ReceiptProcessor/GetPoints"
+	ReceiptProcessor_GetBreakdown_FullMethodName   = "/receipt.v1.ReceiptProcessor/GetBreakdown"
+)
+
+// ReceiptProcessorClient is the client API for ReceiptProcessor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReceiptProcessorClient interface {
+	ProcessReceipt(ctx context.Context, in *ProcessReceiptRequest, opts ...grpc.CallOption) (*ProcessReceiptResponse, error)
+	GetPoints(ctx context.Context, in *GetPointsRequest, opts ...grpc.CallOption) (*GetPointsResponse, error)
+	GetBreakdown(ctx context.Context, in *GetBreakdownRequest, opts ...grpc.CallOption) (*GetBreakdownResponse, error)
+}
+
+type receiptProcessorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReceiptProcessorClient(cc grpc.ClientConnInterface) ReceiptProcessorClient {
+	return &receiptProcessorClient{cc}
+}
+
+func (c *receiptProcessorClient) ProcessReceipt(ctx context.Context, in *ProcessReceiptRequest, opts ...grpc.CallOption) (*ProcessReceiptResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProcessReceiptResponse)
+	err := c.cc.Invoke(ctx, ReceiptProcessor_ProcessReceipt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiptProcessorClient) GetPoints(ctx context.Context, in *GetPointsRequest, opts ...grpc.CallOption) (*GetPointsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetPointsResponse)
+	err := c.cc.Invoke(ctx, ReceiptProcessor_GetPoints_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiptProcessorClient) GetBreakdown(ctx context.Context, in *GetBreakdownRequest, opts ...grpc.CallOption) (*GetBreakdownResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetBreakdownResponse)
+	err := c.cc.Invoke(ctx, ReceiptProcessor_GetBreakdown_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReceiptProcessorServer is the server API for ReceiptProcessor service.
+// All implementations must embed UnimplementedReceiptProcessorServer
+// for forward compatibility.
+type ReceiptProcessorServer interface {
+	ProcessReceipt(context.Context, *ProcessReceiptRequest) (*ProcessReceiptResponse, error)
+	GetPoints(context.Context, *GetPointsRequest) (*GetPointsResponse, error)
+	GetBreakdown(context.Context, *GetBreakdownRequest) (*GetBreakdownResponse, error)
+	mustEmbedUnimplementedReceiptProcessorServer()
+}
+
+// UnimplementedReceiptProcessorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedReceiptProcessorServer struct{}
+
+func (UnimplementedReceiptProcessorServer) ProcessReceipt(context.Context, *ProcessReceiptRequest) (*ProcessReceiptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProcessReceipt not implemented")
+}
+func (UnimplementedReceiptProcessorServer) GetPoints(context.Context, *GetPointsRequest) (*GetPointsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPoints not implemented")
+}
+func (UnimplementedReceiptProcessorServer) GetBreakdown(context.Context, *GetBreakdownRequest) (*GetBreakdownResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBreakdown not implemented")
+}
+func (UnimplementedReceiptProcessorServer) mustEmbedUnimplementedReceiptProcessorServer() {}
+func (UnimplementedReceiptProcessorServer) testEmbeddedByValue()                          {}
+
+// UnsafeReceiptProcessorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReceiptProcessorServer will
+// result in compilation errors.
+type UnsafeReceiptProcessorServer interface {
+	mustEmbedUnimplementedReceiptProcessorServer()
+}
+
+func RegisterReceiptProcessorServer(s grpc.ServiceRegistrar, srv ReceiptProcessorServer) {
+	// If the following call pancis, it indicates UnimplementedReceiptProcessorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ReceiptProcessor_ServiceDesc, srv)
+}
+
+func _ReceiptProcessor_ProcessReceipt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessReceiptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptProcessorServer).ProcessReceipt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptProcessor_ProcessReceipt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptProcessorServer).ProcessReceipt(ctx, req.(*ProcessReceiptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReceiptProcessor_GetPoints_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPointsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptProcessorServer).GetPoints(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptProcessor_GetPoints_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptProcessorServer).GetPoints(ctx, req.(*GetPointsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReceiptProcessor_GetBreakdown_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBreakdownRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptProcessorServer).GetBreakdown(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptProcessor_GetBreakdown_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptProcessorServer).GetBreakdown(ctx, req.(*GetBreakdownRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ReceiptProcessor_ServiceDesc is the grpc.ServiceDesc for ReceiptProcessor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReceiptProcessor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "receipt.v1.ReceiptProcessor",
+	HandlerType: (*ReceiptProcessorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ProcessReceipt",
+			Handler:    _ReceiptProcessor_ProcessReceipt_Handler,
+		},
+		{
+			MethodName: "GetPoints",
+			Handler:    _ReceiptProcessor_GetPoints_Handler,
+		},
+		{
+			MethodName: "GetBreakdown",
+			Handler:    _ReceiptProcessor_GetBreakdown_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "receipt.proto",
+}
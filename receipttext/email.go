@@ -0,0 +1,312 @@
+package receipttext
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"receipt-processor/points"
+)
+
+// senders maps the domains of the e-commerce sites that send the most
+// e-receipts to the retailer names they are scored under. Their emails open
+// with greetings and banners rather than the retailer's name, so it is taken
+// from the sender instead. Subdomains, such as email.target.com, match too.
+var senders = map[string]string{
+	"amazon.com":    "Amazon",
+	"apple.com":     "Apple",
+	"bestbuy.com":   "Best Buy",
+	"chewy.com":     "Chewy",
+	"costco.com":    "Costco",
+	"cvs.com":       "CVS",
+	"doordash.com":  "DoorDash",
+	"ebay.com":      "eBay",
+	"etsy.com":      "Etsy",
+	"homedepot.com": "The Home Depot",
+	"instacart.com": "Instacart",
+	"kroger.com":    "Kroger",
+	"lowes.com":     "Lowes",
+	"macys.com":     "Macys",
+	"nike.com":      "Nike",
+	"target.com":    "Target",
+	"uber.com":      "Uber",
+	"walgreens.com": "Walgreens",
+	"walmart.com":   "Walmart",
+	"wayfair.com":   "Wayfair",
+}
+
+// maxEmailDepth bounds how deeply multipart bodies and attached messages are
+// followed.
+const maxEmailDepth = 8
+
+var (
+	forwardSeparator = regexp.MustCompile(`(?i)^-+\s*(?:forwarded|original) message\s*-+$`)
+	// headerLine matches the header lines mail clients quote above a
+	// forwarded message.
+	headerLine = regexp.MustCompile(`(?i)^(from|to|cc|date|sent|subject):\s*(.*)$`)
+	address    = regexp.MustCompile(`[\w.+\-]+@[\w\-]+(?:\.[\w\-]+)+`)
+)
+
+// gmailDate is the layout Gmail uses for the date of a forwarded message.
+const gmailDate = "Mon, Jan 2, 2006 at 3:04 PM"
+
+// email is what ParseEmail gathers from a message: the candidate texts of
+// the receipt, best first, and who sent it.
+type email struct {
+	pdfs, plain, html [][]byte
+	from              []*mail.Address
+	date              time.Time
+}
+
+// ParseEmail extracts a receipt from a raw RFC 822 email message, typically
+// an e-receipt forwarded by the customer. PDF attachments are read first,
+// then the plain-text body, then the HTML body, and the first of them with a
+// receipt in it is used. The retailer is taken from the original sender, as
+// quoted in a forward or attached as a message, if it is one of the sites
+// in senders, or from the sender's display name otherwise; the purchase date
+// and time fall back to when the original message was sent.
+func ParseEmail(r io.Reader) (points.Receipt, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return points.Receipt{}, fmt.Errorf("receipttext: reading email: %w", err)
+	}
+	var e email
+	if err := e.message(msg, 0); err != nil {
+		return points.Receipt{}, err
+	}
+
+	type text struct {
+		s        string
+		fromBody bool
+	}
+	var texts []text
+	for _, data := range e.pdfs {
+		if s, err := PDFText(data); err == nil {
+			texts = append(texts, text{s, false})
+		}
+	}
+	for _, body := range e.plain {
+		texts = append(texts, text{string(body), true})
+	}
+	for _, body := range e.html {
+		texts = append(texts, text{htmlText(body), true})
+	}
+	for _, t := range texts {
+		receipt, err := Parse(e.forwarded(t.s))
+		if errors.Is(err, ErrNoReceipt) {
+			continue
+		}
+		e.fill(&receipt, t.fromBody)
+		return receipt, err
+	}
+	return points.Receipt{}, ErrNoReceipt
+}
+
+// message collects the parts of msg and its sender.
+func (e *email) message(msg *mail.Message, depth int) error {
+	if from, err := msg.Header.AddressList("From"); err == nil {
+		e.from = append(e.from, from...)
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		e.date = date
+	}
+	return e.part(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body, depth)
+}
+
+// part collects the body of one MIME part, descending into multipart bodies
+// and attached messages.
+func (e *email) part(contentType, encoding, filename string, body io.Reader, depth int) error {
+	if depth > maxEmailDepth {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("receipttext: reading email: %w", err)
+			}
+			err = e.part(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p.FileName(), p, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	case mediaType == "message/rfc822":
+		msg, err := mail.ReadMessage(body)
+		if err != nil {
+			return fmt.Errorf("receipttext: reading attached email: %w", err)
+		}
+		// The attached message is the original receipt, so its sender
+		// and date take precedence over the forwarder's.
+		e.from = nil
+		return e.message(msg, depth+1)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("receipttext: reading email: %w", err)
+	}
+	switch {
+	case mediaType == "application/pdf",
+		mediaType == "application/octet-stream" && strings.HasSuffix(strings.ToLower(filename), ".pdf"):
+		e.pdfs = append(e.pdfs, data)
+	case filename != "":
+		// Other attachments, such as images and calendar invites.
+	case mediaType == "text/plain":
+		e.plain = append(e.plain, utf8(data, params["charset"]))
+	case mediaType == "text/html":
+		e.html = append(e.html, utf8(data, params["charset"]))
+	}
+	return nil
+}
+
+// forwarded removes the header of a forwarded message quoted in text,
+// noting its sender and date, so that it is not read as part of the receipt.
+// The header starts at a separator such as "---------- Forwarded message
+// ---------" or at a From line with an email address.
+func (e *email) forwarded(text string) string {
+	var b strings.Builder
+	inHeader := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(strings.TrimLeft(line, "> "))
+		if forwardSeparator.MatchString(trimmed) {
+			inHeader = true
+			continue
+		}
+		m := headerLine.FindStringSubmatch(trimmed)
+		if m != nil && (inHeader || strings.EqualFold(m[1], "from") && address.MatchString(m[2])) {
+			inHeader = true
+			switch strings.ToLower(m[1]) {
+			case "from":
+				if a, err := mail.ParseAddress(m[2]); err == nil {
+					e.from = []*mail.Address{a}
+				} else if s := address.FindString(m[2]); s != "" {
+					e.from = []*mail.Address{{Address: s}}
+				}
+			case "date", "sent":
+				if date, err := mail.ParseDate(m[2]); err == nil {
+					e.date = date
+				} else if date, err := time.Parse(gmailDate, m[2]); err == nil {
+					e.date = date
+				}
+			}
+			continue
+		}
+		if trimmed != "" {
+			inHeader = false
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// fill sets the purchase date and time from the message date where the text
+// had none, and the retailer from the sender: always for one of the senders,
+// and from the display name when the receipt came from the message body,
+// which rarely starts with the retailer's name the way a PDF receipt does.
+func (e *email) fill(r *points.Receipt, fromBody bool) {
+	if len(e.from) > 0 {
+		if name, ok := sender(e.from[0].Address); ok {
+			r.Retailer = name
+		} else if name := clean(e.from[0].Name, true); name != "" && fromBody {
+			r.Retailer = name
+		}
+	}
+	if e.date.IsZero() {
+		return
+	}
+	if r.PurchaseDate == "" {
+		r.PurchaseDate = e.date.Format(points.DateLayout)
+	}
+	if r.PurchaseTime == "" {
+		r.PurchaseTime = e.date.Format(points.TimeLayout)
+	}
+}
+
+// sender returns the retailer name for an address at one of the senders'
+// domains or their subdomains.
+func sender(addr string) (string, bool) {
+	_, domain, _ := strings.Cut(strings.ToLower(addr), "@")
+	for domain != "" {
+		if name, ok := senders[domain]; ok {
+			return name, true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return "", false
+}
+
+// htmlText renders an HTML body as text, with a line for each block or
+// table row and the cells of a row side by side.
+func htmlText(body []byte) string {
+	var b strings.Builder
+	z := html.NewTokenizer(bytes.NewReader(body))
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(spaces.ReplaceAllString(string(z.Text()), " "))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case "br", "p", "div", "tr", "li", "table", "h1", "h2", "h3", "h4", "h5", "h6", "hr", "section":
+				b.WriteString("\n")
+			case "td", "th":
+				b.WriteString(" ")
+			}
+		}
+	}
+}
+
+// utf8 converts text in charset to UTF-8. Only Latin-1 needs converting;
+// other charsets are assumed to be UTF-8 or ASCII.
+func utf8(data []byte, charset string) []byte {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+	default:
+		return data
+	}
+	runes := make([]rune, len(data))
+	for i, c := range data {
+		runes[i] = rune(c)
+	}
+	return []byte(string(runes))
+}
@@ -0,0 +1,185 @@
+// Package receipttext reads a receipt from the plain text of a printed or
+// emailed one, such as OCR output or the text layer of a PDF.
+//
+//	receipt, err := receipttext.Parse(text)
+//	err = points.Validate(receipt)
+//
+// ParsePDF does the same for a PDF with a text layer.
+//
+// Parsing is heuristic: the first line with letters is taken as the
+// retailer, lines ending in a price before the total as items, and the first
+// date and time found as the purchase date and time. The result should be
+// validated before it is scored.
+package receipttext
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"receipt-processor/points"
+)
+
+// ErrNoReceipt is returned for text in which no items or total were found.
+var ErrNoReceipt = errors.New("receipttext: no receipt found in text")
+
+var (
+	// priceLine matches a line ending in a price, optionally followed by a
+	// tax flag such as "T" or "F".
+	priceLine = regexp.MustCompile(`^(.*?)[\s.:]*\$?\s*(-?\d{1,7})[.,](\d{2})(?:\s+[A-Z]{1,2})?$`)
+	totalLine = regexp.MustCompile(`(?i)^\W*(grand\s+|order\s+)?total\b`)
+	// skipLine matches priced lines that are neither items nor the total.
+	skipLine = regexp.MustCompile(`(?i)\b(sub\s*-?\s*total|tax|vat|change|cash|visa|mastercard|amex|discover|debit|credit|tender|balance|discount|savings|coupon|tip|gratuity|amount\s+due|paid)\b`)
+
+	isoDate   = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	slashDate = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})/(\d{4}|\d{2})\b`)
+	clock     = regexp.MustCompile(`\b(\d{1,2}):(\d{2})(?::\d{2})?\s*([AaPp]\.?[Mm]\.?)?`)
+
+	// unsafeText matches runs of characters the receipt schema does not
+	// allow in retailer names and descriptions.
+	unsafeText = regexp.MustCompile(`[^\p{L}\p{M}\p{N}_\s\-&]+`)
+	spaces     = regexp.MustCompile(`\s+`)
+)
+
+// Parse extracts a receipt from text. It returns ErrNoReceipt if nothing in
+// text looks like an item or a total; any other field it cannot find is left
+// empty for validation to report. If no total is printed, the item prices
+// are summed.
+func Parse(text string) (points.Receipt, error) {
+	var r points.Receipt
+	var sum points.Money
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if r.PurchaseDate == "" {
+			r.PurchaseDate = findDate(line)
+		}
+		if r.PurchaseTime == "" {
+			r.PurchaseTime = findTime(line)
+		}
+
+		m := priceLine.FindStringSubmatch(line)
+		if m == nil {
+			if r.Retailer == "" && len(r.Items) == 0 && isName(line) {
+				r.Retailer = clean(line, true)
+			}
+			continue
+		}
+		if r.Total != "" || strings.HasPrefix(m[2], "-") {
+			continue
+		}
+		desc := m[1]
+		price := strings.TrimLeft(m[2], "0")
+		if price == "" {
+			price = "0"
+		}
+		price += "." + m[3]
+		switch {
+		case totalLine.MatchString(desc) && !skipLine.MatchString(desc):
+			r.Total = price
+		case skipLine.MatchString(desc):
+		default:
+			desc = clean(desc, false)
+			if desc == "" {
+				continue
+			}
+			r.Items = append(r.Items, points.Item{ShortDescription: desc, Price: price})
+			if p, err := points.ParseMoney(price); err == nil {
+				sum += p
+			}
+		}
+	}
+	if len(r.Items) == 0 && r.Total == "" {
+		return r, ErrNoReceipt
+	}
+	if r.Total == "" {
+		r.Total = sum.String()
+	}
+	return r, nil
+}
+
+// isName reports whether line could be a retailer's name rather than an
+// address, phone number or date.
+func isName(line string) bool {
+	letters, digits := 0, 0
+	for _, c := range line {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case strings.ContainsRune(" -&'.", c):
+		default:
+			letters++
+		}
+	}
+	return letters >= 2 && digits <= letters/2
+}
+
+// clean reduces s to the characters a receipt may contain, as a retailer
+// name if retailer is set and an item description otherwise.
+func clean(s string, retailer bool) string {
+	if !retailer {
+		s = strings.ReplaceAll(s, "&", " ")
+	}
+	s = strings.NewReplacer("'", "", "’", "").Replace(s)
+	s = unsafeText.ReplaceAllString(s, " ")
+	return strings.TrimSpace(spaces.ReplaceAllString(s, " "))
+}
+
+// findDate returns the first date in line as YYYY-MM-DD, reading slashed
+// dates as month/day/year.
+func findDate(line string) string {
+	if m := isoDate.FindStringSubmatch(line); m != nil {
+		return validDate(m[1], m[2], m[3])
+	}
+	if m := slashDate.FindStringSubmatch(line); m != nil {
+		year := m[3]
+		if len(year) == 2 {
+			year = "20" + year
+		}
+		return validDate(year, m[1], m[2])
+	}
+	return ""
+}
+
+func validDate(year, month, day string) string {
+	s := year + "-" + pad(month) + "-" + pad(day)
+	if _, err := time.Parse(points.DateLayout, s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// findTime returns the first time of day in line as 24-hour HH:MM.
+func findTime(line string) string {
+	m := clock.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	hour, _ := strconv.Atoi(m[1])
+	switch strings.ToLower(strings.ReplaceAll(m[3], ".", "")) {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	s := pad(strconv.Itoa(hour)) + ":" + m[2]
+	if _, err := time.Parse(points.TimeLayout, s); err != nil {
+		return ""
+	}
+	return s
+}
+
+func pad(s string) string {
+	if len(s) == 1 {
+		return "0" + s
+	}
+	return s
+}
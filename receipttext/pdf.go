@@ -0,0 +1,107 @@
+package receipttext
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+
+	"receipt-processor/points"
+)
+
+// ErrNoText is returned for a PDF without a text layer, such as a scan,
+// which has to be read with OCR instead.
+var ErrNoText = errors.New("receipttext: PDF has no text layer")
+
+// ParsePDF extracts a receipt from the text layer of a PDF, as emailed by
+// many retailers. See Parse.
+func ParsePDF(data []byte) (points.Receipt, error) {
+	text, err := PDFText(data)
+	if err != nil {
+		return points.Receipt{}, err
+	}
+	return Parse(text)
+}
+
+// PDFText returns the text layer of a PDF with a line for each row of text,
+// page by page. Characters in a row are joined in order of position, with a
+// space wherever there is a gap between them, so that an item's description
+// and price printed in separate columns end up on one line.
+func PDFText(data []byte) (text string, err error) {
+	// The pdf package panics on malformed content streams.
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("receipttext: reading PDF: %v", r)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("receipttext: reading PDF: %w", err)
+	}
+	var b strings.Builder
+	for i := 1; i <= r.NumPage(); i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		for _, row := range rows(page.Content().Text) {
+			b.WriteString(row)
+			b.WriteString("\n")
+		}
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return "", ErrNoText
+	}
+	return b.String(), nil
+}
+
+// rows groups the characters of a page into lines, top to bottom.
+func rows(chars []pdf.Text) []string {
+	type row struct {
+		y     float64
+		chars []pdf.Text
+	}
+	var rs []*row
+	for _, c := range chars {
+		if c.S == "\n" || c.S == "" {
+			continue
+		}
+		var r *row
+		for _, candidate := range rs {
+			if math.Abs(candidate.y-c.Y) <= max(c.FontSize/2, 1) {
+				r = candidate
+				break
+			}
+		}
+		if r == nil {
+			r = &row{y: c.Y}
+			rs = append(rs, r)
+		}
+		r.chars = append(r.chars, c)
+	}
+	slices.SortStableFunc(rs, func(a, b *row) int { return cmp.Compare(b.y, a.y) })
+
+	lines := make([]string, 0, len(rs))
+	for _, r := range rs {
+		// Fonts without widths place every character of a run at its
+		// start, so the stable sort keeps runs in the order drawn.
+		slices.SortStableFunc(r.chars, func(a, b pdf.Text) int { return cmp.Compare(a.X, b.X) })
+		var line strings.Builder
+		for i, c := range r.chars {
+			if i > 0 {
+				prev := r.chars[i-1]
+				if c.X-(prev.X+prev.W) > prev.FontSize*0.15 {
+					line.WriteString(" ")
+				}
+			}
+			line.WriteString(c.S)
+		}
+		lines = append(lines, strings.TrimSpace(line.String()))
+	}
+	return lines
+}
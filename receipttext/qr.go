@@ -0,0 +1,162 @@
+package receipttext
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register JPEG for image.Decode
+	_ "image/png"  // register PNG for image.Decode
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+
+	"receipt-processor/points"
+)
+
+// ErrUnknownQR is returned for a QR code payload in none of the formats
+// ParseQR reads.
+var ErrUnknownQR = errors.New("receipttext: unrecognized QR code payload")
+
+// totalItem describes the single item given to receipts from fiscal codes,
+// which carry the total but not the line items.
+const totalItem = "Receipt total"
+
+var amount = regexp.MustCompile(`^(\d+)(?:\.(\d{1,2}))?$`)
+
+// DecodeQR returns the payload of the QR code in a JPEG or PNG image.
+func DecodeQR(data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("receipttext: decoding image: %w", err)
+	}
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", fmt.Errorf("receipttext: decoding image: %w", err)
+	}
+	res, err := qrcode.NewQRCodeReader().Decode(bmp, map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("receipttext: no QR code found: %w", err)
+	}
+	return res.GetText(), nil
+}
+
+// ParseQR extracts a receipt from the payload of a receipt's QR code. It
+// reads
+//
+//   - a receipt as JSON, in the form POST /receipts/process takes;
+//   - Saudi e-invoice (ZATCA) codes, base64 TLV with the seller's name, the
+//     time of the invoice and its total;
+//   - Russian fiscal receipt codes, such as
+//     t=20220103T1313&s=43.18&fn=9289000100408074&i=1234&fp=1057467352&n=1.
+//
+// The fiscal codes carry no line items, so the receipt gets a single item
+// priced at the total. Russian codes do not name the retailer either, so it
+// is named after the fiscal drive number. Any field a code lacks is left
+// empty for validation to report.
+func ParseQR(payload string) (points.Receipt, error) {
+	payload = strings.TrimSpace(payload)
+	switch {
+	case strings.HasPrefix(payload, "{"):
+		var r points.Receipt
+		if err := json.Unmarshal([]byte(payload), &r); err != nil {
+			return r, fmt.Errorf("receipttext: decoding QR code JSON: %w", err)
+		}
+		return r, nil
+	case strings.Contains(payload, "fn=") && strings.Contains(payload, "t="):
+		return parseFNS(payload)
+	}
+	if data, err := base64.StdEncoding.DecodeString(payload); err == nil {
+		if r, ok := parseZATCA(data); ok {
+			return r, nil
+		}
+	}
+	return points.Receipt{}, ErrUnknownQR
+}
+
+// parseFNS reads a Russian fiscal receipt code, a query string giving the
+// time (t), total (s) and fiscal drive number (fn).
+func parseFNS(payload string) (points.Receipt, error) {
+	if _, query, ok := strings.Cut(payload, "?"); ok {
+		payload = query
+	}
+	q, err := url.ParseQuery(payload)
+	if err != nil {
+		return points.Receipt{}, ErrUnknownQR
+	}
+	var r points.Receipt
+	for _, layout := range []string{"20060102T150405", "20060102T1504"} {
+		if t, err := time.Parse(layout, q.Get("t")); err == nil {
+			r.PurchaseDate, r.PurchaseTime = t.Format(points.DateLayout), t.Format(points.TimeLayout)
+			break
+		}
+	}
+	if fn := q.Get("fn"); fn != "" {
+		r.Retailer = "FN " + fn
+	}
+	r.Total = money(q.Get("s"))
+	setTotalItem(&r)
+	return r, nil
+}
+
+// parseZATCA reads a Saudi e-invoice code: tag-length-value fields of which
+// 1 is the seller's name, 3 the time of the invoice and 4 its total.
+func parseZATCA(data []byte) (points.Receipt, bool) {
+	var r points.Receipt
+	seen := false
+	for len(data) >= 2 {
+		tag, n := data[0], int(data[1])
+		if len(data) < 2+n {
+			return r, false
+		}
+		value := string(data[2 : 2+n])
+		data = data[2+n:]
+		switch tag {
+		case 1:
+			r.Retailer = clean(value, true)
+			seen = true
+		case 3:
+			for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+				if t, err := time.Parse(layout, value); err == nil {
+					r.PurchaseDate, r.PurchaseTime = t.Format(points.DateLayout), t.Format(points.TimeLayout)
+					break
+				}
+			}
+		case 4:
+			r.Total = money(value)
+		}
+	}
+	if !seen || len(data) != 0 {
+		return r, false
+	}
+	setTotalItem(&r)
+	return r, true
+}
+
+// money formats a decimal amount with two decimal places, or returns "" if s
+// is not one.
+func money(s string) string {
+	m := amount.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return ""
+	}
+	cents := m[2]
+	for len(cents) < 2 {
+		cents += "0"
+	}
+	return m[1] + "." + cents
+}
+
+func setTotalItem(r *points.Receipt) {
+	if r.Total != "" {
+		r.Items = []points.Item{{ShortDescription: totalItem, Price: r.Total}}
+	}
+}
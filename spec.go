@@ -0,0 +1,10 @@
+// Package receiptprocessor holds the OpenAPI definition of the Receipt
+// Processor API so that the server and clients can share it.
+package receiptprocessor
+
+import _ "embed"
+
+// OpenAPISpec is the contents of api.yml.
+//
+//go:embed api.yml
+var OpenAPISpec []byte